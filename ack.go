@@ -0,0 +1,71 @@
+package proxyhouse
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// synchronous inserts, response is held until the batch with body is sent to clickhouse
+
+const syncHeader = "X-Proxyhouse-Sync"
+
+// chError is an error response of clickhouse
+type chError struct {
+	status int
+	text   string
+}
+
+func (e *chError) Error() string {
+	return fmt.Sprintf("Error: clickhouse response %d: %s", e.status, strings.TrimSpace(e.text))
+}
+
+// spooledError is a send error of the batch kept by proxy, in errors dir or in store,
+// batch is resent later, so insert is accepted
+type spooledError struct {
+	err error
+}
+
+func (e *spooledError) Error() string {
+	return "Accepted: batch is not sent, it will be resent later: " + e.err.Error()
+}
+
+// isSync report if client wait for acknowledgement, with header or sync=1 param
+func isSync(r *http.Request) bool {
+	v := r.Header.Get(syncHeader)
+	if v == "" {
+		v = r.URL.Query().Get("sync")
+	}
+	return v == "1" || strings.EqualFold(v, "true")
+}
+
+// writeAck wait for send result of the batch and write it to client
+// batch kept to resend is answered with 202, clickhouse errors of dropped batch are returned
+// with clickhouse status, other errors with 502
+// error of dropped batch is returned, timeout and kept batch are not errors as the batch is sent later
+func (p *Proxy) writeAck(w http.ResponseWriter, ack <-chan error) error {
+	timer := time.NewTimer(time.Duration(p.conf().SyncTimeout) * time.Second)
+	defer timer.Stop()
+	select {
+	case err := <-ack:
+		if err == nil {
+			return nil
+		}
+		if e, ok := err.(*spooledError); ok {
+			w.WriteHeader(http.StatusAccepted)
+			fmt.Fprint(w, e.Error())
+			return nil
+		}
+		if e, ok := err.(*chError); ok {
+			http.Error(w, e.text, e.status)
+			return err
+		}
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return err
+	case <-timer.C:
+		p.metrics.Increment(p.conf().GraphitePrefixCnt+".sync_timeouts", 1)
+		http.Error(w, "Timeout: batch is not sent yet, it will be sent later", http.StatusGatewayTimeout)
+	}
+	return nil
+}
@@ -0,0 +1,93 @@
+package proxyhouse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// syncRequest run request and flush store until it is answered
+func syncRequest(t *testing.T, p *Proxy, req *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	done := make(chan *httptest.ResponseRecorder)
+	go func() {
+		rr := httptest.NewRecorder()
+		p.dorequest(rr, req)
+		done <- rr
+	}()
+	for {
+		select {
+		case rr := <-done:
+			return rr
+		case <-time.After(10 * time.Millisecond):
+			for key, buf := range p.store.drain() {
+				p.flush(key, buf)
+			}
+		}
+	}
+}
+
+func TestSyncInsert(t *testing.T) {
+	var gotQuery string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.RawQuery
+		if strings.Contains(r.URL.Query().Get("query"), "bad") {
+			http.Error(w, "Code: 60. DB::Exception: Table default.bad doesn't exist", http.StatusNotFound)
+		}
+	}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	req := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES&sync=1", strings.NewReader("(1)"))
+	if rr := syncRequest(t, p, req); rr.Code != http.StatusOK {
+		t.Errorf("want 200; got %d %s", rr.Code, rr.Body)
+	}
+	if strings.Contains(gotQuery, "sync") {
+		t.Errorf("sync param must not be forwarded: %s", gotQuery)
+	}
+
+	req = httptest.NewRequest("POST", "/?query=INSERT%20INTO%20bad%20VALUES", strings.NewReader("(1)"))
+	req.Header.Set(syncHeader, "1")
+	rr := syncRequest(t, p, req)
+	if rr.Code != http.StatusAccepted || !strings.Contains(rr.Body.String(), "Code: 60") {
+		t.Errorf("want batch accepted with clickhouse error; got %d %s", rr.Code, rr.Body)
+	}
+	if files, _ := p.spoolFiles(); len(files) != 1 {
+		t.Errorf("want failed batch spooled; got %+v", files)
+	}
+
+	// dropped batch is answered with clickhouse error
+	p = newTestProxy(t, func(c *Config) { c.Fwd, c.SpoolFull, c.SpoolMaxFiles = ts.URL, spoolDropNewest, 1 })
+	if err := p.saveToErrors("/?query=INSERT%20INTO%20bad%20VALUES", []byte("(0)"), 1, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	req = httptest.NewRequest("POST", "/?query=INSERT%20INTO%20bad%20VALUES&sync=1", strings.NewReader("(1)"))
+	if rr = syncRequest(t, p, req); rr.Code != http.StatusNotFound {
+		t.Errorf("want clickhouse error of dropped batch; got %d %s", rr.Code, rr.Body)
+	}
+}
+
+func TestSyncInsertTimeout(t *testing.T) {
+	p := newTestProxy(t, func(c *Config) {
+		c.SyncTimeout = 1
+		c.Rules = []*Rule{{Match: "slow", TableConfig: TableConfig{SyncSec: 60}}}
+	})
+	key := "?query=INSERT%20INTO%20slow%20VALUES"
+
+	req := httptest.NewRequest("POST", "/"+key+"&sync=1", strings.NewReader("(1)"))
+	rr := httptest.NewRecorder()
+	p.dorequest(rr, req)
+	if rr.Code != http.StatusGatewayTimeout {
+		t.Errorf("want 504; got %d %s", rr.Code, rr.Body)
+	}
+
+	// async insert is answered at once
+	req = httptest.NewRequest("POST", "/"+key, strings.NewReader("(2)"))
+	rr = httptest.NewRecorder()
+	p.dorequest(rr, req)
+	if rr.Code != http.StatusOK {
+		t.Errorf("want 200; got %d %s", rr.Code, rr.Body)
+	}
+}
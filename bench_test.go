@@ -1,21 +1,22 @@
-package main
+package proxyhouse
 
 import (
 	"fmt"
-	"github.com/marpaia/graphite-golang"
 	"net/http"
 	"net/http/httptest"
+	"runtime"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 )
 
 func BenchmarkReq(b *testing.B) {
-	metricStorage = NewMetricStorage()
-	*graphitehost = ""
-	gr = graphite.NewGraphiteNop(*graphitehost, *graphiteport)
+	p := newTestProxy(b, nil)
+	ms := p.metrics.(*MetricStorage)
 	rr := httptest.NewRecorder()
-	handler := http.HandlerFunc(dorequest)
+	handler := http.HandlerFunc(p.dorequest)
 	cnt := 0
 	table := "t"
 	for i := 0; i < b.N; i++ {
@@ -32,6 +33,88 @@ func BenchmarkReq(b *testing.B) {
 			b.Fatal(err)
 		}
 		handler.ServeHTTP(rr, req)
-		metricStorage.storage = make(map[string]int)
+		ms.storage = make(map[string]int)
+	}
+}
+
+// BenchmarkStorePut show store scaling with GOMAXPROCS: go test -bench StorePut -cpu 1,2,4,8
+func BenchmarkStorePut(b *testing.B) {
+	body := []byte(strings.Repeat("(1,'proxyhouse'),", 16))
+	keys := make([]string, 64)
+	for i := range keys {
+		keys[i] = "/?query=INSERT%20INTO%20t_" + strconv.Itoa(i) + "%20VALUES"
+	}
+	tc := tableConfig{syncsec: 60, maxbytes: 1 << 20}
+	for _, shards := range []int{1, storeShards} {
+		b.Run("shards="+strconv.Itoa(shards), func(b *testing.B) {
+			s := newStore(shards)
+			var next uint32
+			b.SetBytes(int64(len(body)))
+			b.RunParallel(func(pb *testing.PB) {
+				// every goroutine write its own tables, as producers do
+				i := int(atomic.AddUint32(&next, 1))
+				for pb.Next() {
+					s.put(keys[i%len(keys)], body, []byte(","), 16, tc, nil)
+					i += 7
+				}
+			})
+		})
+	}
+}
+
+func BenchmarkReqParallel(b *testing.B) {
+	p := newTestProxy(b, nil)
+	handler := http.HandlerFunc(p.dorequest)
+	var next uint32
+	b.RunParallel(func(pb *testing.PB) {
+		table := "t_" + strconv.Itoa(int(atomic.AddUint32(&next, 1)))
+		uri := "/?query=INSERT%20INTO%20" + table + "%20VALUES"
+		for pb.Next() {
+			req, err := http.NewRequest("POST", uri, strings.NewReader("(1,'proxyhouse')"))
+			if err != nil {
+				b.Error(err)
+				return
+			}
+			handler.ServeHTTP(httptest.NewRecorder(), req)
+		}
+	})
+}
+
+// BenchmarkBatchCycle show allocations and gc of buffers which are filled, detached and sent:
+// go test -run XXX -bench BatchCycle -benchmem
+func BenchmarkBatchCycle(b *testing.B) {
+	body := []byte(strings.Repeat("(1,'proxyhouse'),", 16))
+	keys := make([]string, 16)
+	for i := range keys {
+		keys[i] = "/?query=INSERT%20INTO%20t_" + strconv.Itoa(i) + "%20VALUES"
+	}
+	tc := tableConfig{syncsec: 1}
+	for _, pooled := range []bool{false, true} {
+		b.Run("pooled="+strconv.FormatBool(pooled), func(b *testing.B) {
+			s := newStore(storeShards)
+			requests := make(map[string]*Buffer)
+			now := time.Now()
+			var stats runtime.MemStats
+			runtime.ReadMemStats(&stats)
+			gcs := stats.NumGC
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				// a batch of 1000 inserts for every table
+				for j := 0; j < 1000; j++ {
+					s.put(keys[j%len(keys)], body, []byte(","), 16, tc, nil)
+				}
+				now = now.Add(time.Hour)
+				requests = s.due(now, requests)
+				for key, buf := range requests {
+					if pooled {
+						putBuffer(buf.buffer)
+					}
+					delete(requests, key)
+				}
+			}
+			runtime.ReadMemStats(&stats)
+			b.ReportMetric(float64(stats.NumGC-gcs)/float64(b.N), "gc/op")
+		})
 	}
 }
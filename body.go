@@ -0,0 +1,91 @@
+package proxyhouse
+
+import (
+	"errors"
+	"io"
+	"net/http"
+)
+
+// maxBodyGrow limit buffer allocated by content length, larger body grow as it is read,
+// so client can't make proxy allocate more than it sends
+const maxBodyGrow = 1 << 20
+
+var errBodyTooLarge = errors.New("Error: request body is too large")
+
+// countReader count bytes read from request, before decompression
+type countReader struct {
+	r io.Reader
+	n int
+}
+
+func (c *countReader) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += n
+	return n, err
+}
+
+// readBody stream request body through decompressors into pooled batch buffer, return body and raw size
+// raw and decompressed body are limited by limit bytes (0 is no limit), body is taken by store
+// as buffer of new batch or must be released by putBuffer
+func readBody(r *http.Request, limit int) ([]byte, int, error) {
+	if limit > 0 && r.ContentLength > int64(limit) {
+		return nil, 0, errBodyTooLarge
+	}
+	var body io.Reader = r.Body
+	if limit > 0 {
+		body = io.LimitReader(body, int64(limit)+1)
+	}
+	raw := &countReader{r: body}
+	rd, err := decodeReader(r.Header.Get("Content-Encoding"), raw)
+	if err != nil {
+		return nil, raw.n, err
+	}
+	defer rd.Close()
+	body = rd
+	if limit > 0 {
+		body = io.LimitReader(rd, int64(limit)+1)
+	}
+	size := buffersize
+	if n := r.ContentLength; n > int64(size) {
+		// no reallocations for plain body up to maxBodyGrow
+		size = maxBodyGrow
+		if n < int64(size) {
+			size = int(n)
+		}
+	}
+	buf, err := readBuffer(body, getBuffer(size))
+	if err != nil {
+		putBuffer(buf)
+		return nil, raw.n, err
+	}
+	if limit > 0 && (raw.n > limit || len(buf) > limit) {
+		putBuffer(buf)
+		return nil, raw.n, errBodyTooLarge
+	}
+	if r.URL.Query().Get("decompress") == "1" {
+		data, err := decompressBlocks(buf, limit)
+		putBuffer(buf)
+		if err != nil {
+			return nil, raw.n, err
+		}
+		return data, raw.n, nil
+	}
+	return buf, raw.n, nil
+}
+
+// readBuffer read r to the end into b, b grow by size classes of pool
+func readBuffer(r io.Reader, b []byte) ([]byte, error) {
+	for {
+		if len(b) == cap(b) {
+			b = growBuffer(b, 1)
+		}
+		n, err := r.Read(b[len(b):cap(b)])
+		b = b[:len(b)+n]
+		if err == io.EOF {
+			return b, nil
+		}
+		if err != nil {
+			return b, err
+		}
+	}
+}
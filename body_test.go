@@ -0,0 +1,115 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestReadBodyLimit(t *testing.T) {
+	var bomb bytes.Buffer
+	zw := gzip.NewWriter(&bomb)
+	zw.Write(make([]byte, 1<<20))
+	zw.Close()
+
+	tests := []struct {
+		name     string
+		body     []byte
+		encoding string
+		chunked  bool
+		err      error
+	}{
+		{"plain", bytes.Repeat([]byte("(1),"), 25), "", false, nil},
+		{"large", bytes.Repeat([]byte("(1),"), 26), "", false, errBodyTooLarge},
+		{"chunked", bytes.Repeat([]byte("(1),"), 26), "", true, errBodyTooLarge},
+		{"bomb", bomb.Bytes(), "gzip", false, errBodyTooLarge},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES", bytes.NewReader(tt.body))
+		if tt.chunked {
+			// length is unknown until body is read
+			r.Body = ioutil.NopCloser(bytes.NewReader(tt.body))
+			r.ContentLength = -1
+		}
+		if tt.encoding != "" {
+			r.Header.Set("Content-Encoding", tt.encoding)
+		}
+		buf, _, err := readBody(r, 100)
+		if err != tt.err {
+			t.Errorf("%s: want %v; got %v", tt.name, tt.err, err)
+			continue
+		}
+		if err == nil {
+			if !bytes.Equal(buf, tt.body) {
+				t.Errorf("%s: want '%s'; got '%s'", tt.name, tt.body, buf)
+			}
+			putBuffer(buf)
+		}
+	}
+}
+
+// content length is not trusted for allocation
+func TestReadBodyGrow(t *testing.T) {
+	r := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES", strings.NewReader("(1)"))
+	r.ContentLength = 1 << 40
+	if _, _, err := readBody(r, 1<<20); err != errBodyTooLarge {
+		t.Errorf("want too large by content length; got %v", err)
+	}
+	buf, _, err := readBody(r, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer putBuffer(buf)
+	if string(buf) != "(1)" || cap(buf) > 2*maxBodyGrow {
+		t.Errorf("want bounded buffer; got '%s' cap %d", buf, cap(buf))
+	}
+}
+
+// read body become buffer of new batch without copy
+func TestAppendOwned(t *testing.T) {
+	p := newTestProxy(t, func(c *Config) { c.Tables = map[string]*TableConfig{"t": {SyncSec: 60}} })
+	key := "?query=INSERT%20INTO%20t%20VALUES"
+	read := func(body string) []byte {
+		b, _, err := readBody(httptest.NewRequest("POST", "/"+key, strings.NewReader(body)), 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return b
+	}
+	first := read("(1)")
+	if !p.append(key, "INSERT INTO t VALUES", first, nil, true) {
+		t.Fatal("want body of new batch taken")
+	}
+	second := read("(2)")
+	if p.append(key, "INSERT INTO t VALUES", second, nil, true) {
+		t.Error("want body merged into batch copied")
+	}
+	putBuffer(second)
+	buf := p.store.peek(key)
+	if string(buf.buffer) != "(1),(2)" || &buf.buffer[0] != &first[0] {
+		t.Errorf("want batch in read buffer; got '%s'", buf.buffer)
+	}
+}
+
+func TestRequestTooLarge(t *testing.T) {
+	p := newTestProxy(t, func(c *Config) {
+		c.MaxBody = 10
+		c.Tables = map[string]*TableConfig{"large": {SyncSec: 60}}
+	})
+	key := "?query=INSERT%20INTO%20large%20VALUES"
+
+	for body, code := range map[string]int{"(1),(2)": http.StatusOK, "(1),(2),(3)": http.StatusRequestEntityTooLarge} {
+		rr := httptest.NewRecorder()
+		p.dorequest(rr, httptest.NewRequest("POST", "/"+key, strings.NewReader(body)))
+		if rr.Code != code {
+			t.Errorf("%s: want %d; got %d %s", body, code, rr.Code, rr.Body)
+		}
+	}
+	if got := string(p.store.peek(key).buffer); got != "(1),(2)" {
+		t.Errorf("want only allowed body buffered; got '%s'", got)
+	}
+}
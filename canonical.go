@@ -0,0 +1,234 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// conversion of inserts into one canonical format per table, so producers sending
+// the same table as VALUES, TSV, CSV or JSONEachRow are merged into one buffer
+
+var errCanonicalValue = errors.New("Error: value can't be converted, expressions and arrays are sent as is")
+
+// canonicalFormat return format for canonical setting, empty if inserts are buffered as is
+func canonicalFormat(name string) (string, error) {
+	switch strings.ToUpper(name) {
+	case "":
+		return "", nil
+	case "TSV", "TABSEPARATED":
+		return formatTSV, nil
+	case "ROWBINARY":
+		return formatRowBinary, nil
+	}
+	return "", errors.New("must be TSV or RowBinary")
+}
+
+// canonicalize re-encode insert into canonical format of table, return key, query, body and row count
+// insert is returned as is with row count -1 if conversion is off or failed
+func (p *Proxy) canonicalize(uri, query string, body []byte) (string, string, []byte, int) {
+	cfg := p.conf()
+	table := extractTable(uri)
+	format, _ := canonicalFormat(cfg.table(table).canonical)
+	if format == "" {
+		return uri, query, body, -1
+	}
+	key, q, b, rows, err := p.convertInsert(uri, query, body, format)
+	if err != nil {
+		// buffered as is, clickhouse will parse it
+		p.metrics.Increment(cfg.GraphitePrefixCnt+".bytable."+table+".canonical_errors", 1)
+		p.log(LEVEL_ERR, "Canonical error: ", hidePassword(uri), " error: ", err)
+		return uri, query, body, -1
+	}
+	return key, q, b, rows
+}
+
+// convertInsert parse insert body and encode it in format with the key of native listener,
+// database is always explicit and all table columns are listed if insert has no column list
+func (p *Proxy) convertInsert(uri, query string, body []byte, format string) (string, string, []byte, int, error) {
+	from := queryFormat(query)
+	switch from {
+	case formatValues, formatTSV, formatCSV, formatJSONEachRow:
+	default:
+		return "", "", nil, 0, errors.New("Error: unsupported format " + from)
+	}
+	database, table, names, err := parseInsert(query)
+	if err != nil {
+		return "", "", nil, 0, err
+	}
+	params, err := url.ParseQuery(uri[strings.IndexByte(uri, '?')+1:])
+	if err != nil {
+		return "", "", nil, 0, err
+	}
+	if database == "" {
+		database = params.Get("database")
+	}
+	if database == "" {
+		database = "default"
+	}
+	user, password := params.Get("user"), params.Get("password")
+
+	var columns []Column
+	if len(names) > 0 && format == formatTSV && from != formatJSONEachRow {
+		// text values are copied, so types are not needed
+		for _, name := range names {
+			columns = append(columns, Column{Name: name})
+		}
+	} else {
+		if columns, err = p.tableColumns(database, table, user, password); err != nil {
+			return "", "", nil, 0, err
+		}
+		if columns, err = selectColumns(columns, names); err != nil {
+			return "", "", nil, 0, err
+		}
+	}
+	var rows []Row
+	if from == formatJSONEachRow {
+		rows, err = objectRows(columns, body)
+	} else {
+		rows, err = textRows(from, columns, body)
+	}
+	if err != nil {
+		return "", "", nil, 0, err
+	}
+
+	settings := make(map[string]string)
+	for name := range params {
+		switch name {
+		case "query", "database", "user", "password":
+			continue
+		}
+		settings[name] = params.Get(name)
+	}
+	key, query := nativeKey(database, table, columns, settings, user, password)
+	if format == formatTSV {
+		return key, query, encodeTSV(rows), len(rows), nil
+	}
+	loc, err := p.serverTimezone(database, table, user, password)
+	if err != nil {
+		return "", "", nil, 0, err
+	}
+	if body, err = encodeRowBinary(columns, rows, loc); err != nil {
+		return "", "", nil, 0, err
+	}
+	query = strings.TrimSuffix(query, "TSV") + formatRowBinary
+	return setQuery(key, query), query, body, len(rows), nil
+}
+
+// textRows parse Values, TSV or CSV body, expressions in VALUES can't be converted
+func textRows(format string, columns []Column, body []byte) ([]Row, error) {
+	rows, err := parseRows(format, body)
+	if err != nil {
+		return nil, err
+	}
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return nil, fmt.Errorf("Error: row %d: want %d columns; got %d", i+1, len(columns), len(row))
+		}
+		if format != formatValues {
+			continue
+		}
+		for _, f := range row {
+			if !f.Quoted && !f.Null && strings.ContainsAny(f.Value, "()[]{}'") {
+				return nil, errCanonicalValue
+			}
+		}
+	}
+	return rows, nil
+}
+
+// objectRows put JSONEachRow values in column order, missed keys are NULL so clickhouse
+// fill them with defaults, unknown keys fail conversion and are left to clickhouse settings
+func objectRows(columns []Column, body []byte) ([]Row, error) {
+	objects, err := parseJSONEachRow(body)
+	if err != nil {
+		return nil, err
+	}
+	index := make(map[string]int, len(columns))
+	for i, col := range columns {
+		index[col.Name] = i
+	}
+	rows := make([]Row, len(objects))
+	for n, obj := range objects {
+		row := make(Row, len(columns))
+		for i := range row {
+			row[i].Null = true
+		}
+		for name, raw := range obj {
+			i, ok := index[name]
+			if !ok {
+				return nil, fmt.Errorf("Error: row %d: unknown column %s", n+1, name)
+			}
+			var f Field
+			switch {
+			case len(raw) == 0:
+				f.Null = true
+			case raw[0] == '{' || raw[0] == '[':
+				return nil, errCanonicalValue
+			case raw[0] == 'n':
+				f.Null = true
+			case raw[0] == 't' || raw[0] == 'f':
+				f.Value = "0"
+				if raw[0] == 't' {
+					f.Value = "1"
+				}
+				if strings.Contains(columns[i].Type, "String") {
+					f.Value = string(raw)
+				}
+			case raw[0] == '"':
+				if err := json.Unmarshal(raw, &f.Value); err != nil {
+					return nil, err
+				}
+				f.Quoted = true
+			default:
+				f.Value = string(raw)
+			}
+			row[i] = f
+		}
+		rows[n] = row
+	}
+	return rows, nil
+}
+
+// encodeRowBinary write rows in RowBinary format, loc is a server timezone for DateTime
+// NULL is allowed in Nullable columns only, RowBinary can't ask clickhouse for defaults
+func encodeRowBinary(columns []Column, rows []Row, loc *time.Location) ([]byte, error) {
+	types := make([]*chType, len(columns))
+	for i, col := range columns {
+		t := col.Type
+		if strings.HasPrefix(t, "LowCardinality(") && strings.HasSuffix(t, ")") {
+			// encoded as inner type outside of native blocks
+			t = t[len("LowCardinality(") : len(t)-1]
+		}
+		ct, err := parseType(t, loc)
+		if err != nil {
+			return nil, err
+		}
+		types[i] = ct
+	}
+	var buf bytes.Buffer
+	w := &nativeWriter{w: &buf}
+	for n, row := range rows {
+		for i, f := range row {
+			ct := types[i]
+			if f.Null && !ct.nullable {
+				return nil, fmt.Errorf("Error: row %d column %s: NULL in not Nullable column", n+1, columns[i].Name)
+			}
+			if ct.nullable {
+				if f.Null {
+					w.byte(1)
+					continue
+				}
+				w.byte(0)
+			}
+			if err := ct.encode(w, f); err != nil {
+				return nil, fmt.Errorf("Error: row %d column %s: %s", n+1, columns[i].Name, err)
+			}
+		}
+	}
+	return buf.Bytes(), nil
+}
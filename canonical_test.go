@@ -0,0 +1,100 @@
+package proxyhouse
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConvertInsert(t *testing.T) {
+	tables := map[string]string{"db.t": "id\tUInt32\t\nname\tLowCardinality(String)\t\nts\tDateTime\tDEFAULT\nv\tNullable(Float64)\t\n"}
+	ts := httptest.NewServer(fakeSchema(t, "", tables))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	all := "/?query=INSERT+INTO+db.t+%28id%2C+name%2C+ts%2C+v%29+FORMAT+TSV"
+	tests := []struct {
+		uri, body string
+		format    string
+		key       string
+		want      string
+		rows      int
+		err       string
+	}{
+		{"?query=INSERT%20INTO%20t%20VALUES&database=db", "(1,'a\\tb','2020-01-02 03:04:05',NULL)", formatTSV,
+			all, "1\ta\\tb\t2020-01-02 03:04:05\t\\N\n", 1, ""},
+		{"?query=INSERT%20INTO%20db.t%20FORMAT%20JSONEachRow", `{"name":"b","id":2,"v":1.5}`, formatTSV,
+			all, "2\tb\t\\N\t1.5\n", 1, ""},
+		{"?query=INSERT%20INTO%20db.t%20(id,%20name)%20FORMAT%20CSV&max_insert_threads=2", "1,\"a,b\"\n2,c\n", formatTSV,
+			"/?max_insert_threads=2&query=INSERT+INTO+db.t+%28id%2C+name%29+FORMAT+TSV", "1\ta,b\n2\tc\n", 2, ""},
+		{"?query=INSERT%20INTO%20db.t%20VALUES", "(1,'a',now(),NULL)", formatTSV, "", "", 0, "can't be converted"},
+		{"?query=INSERT%20INTO%20db.t%20FORMAT%20JSONEachRow", `{"id":1,"other":1}`, formatTSV, "", "", 0, "unknown column other"},
+		{"?query=INSERT%20INTO%20db.t%20(id)%20FORMAT%20TSV", "1\t2\n", formatTSV, "", "", 0, "want 1 columns; got 2"},
+		{"?query=INSERT%20INTO%20db.t%20FORMAT%20Parquet", "PAR1", formatTSV, "", "", 0, "unsupported format"},
+		{"?query=INSERT%20INTO%20db.t%20VALUES", "(1,'a','1970-01-01 00:00:10',NULL),(2,'',0,0.5)", formatRowBinary,
+			"/?query=INSERT%20INTO%20db.t%20%28id%2C%20name%2C%20ts%2C%20v%29%20FORMAT%20RowBinary",
+			"\x01\x00\x00\x00\x01a\x0a\x00\x00\x00\x01" + "\x02\x00\x00\x00\x00\x00\x00\x00\x00" + "\x00\x00\x00\x00\x00\x00\x00\xe0\x3f", 2, ""},
+		{"?query=INSERT%20INTO%20db.t%20FORMAT%20JSONEachRow", `{"id":1}`, formatRowBinary, "", "", 0, "NULL in not Nullable column"},
+	}
+	for _, tt := range tests {
+		key, _, body, rows, err := p.convertInsert(tt.uri, mustQuery(t, tt.uri), []byte(tt.body), tt.format)
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s %s: want error '%s'; got %v", tt.uri, tt.body, tt.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s %s: %v", tt.uri, tt.body, err)
+			continue
+		}
+		if key != tt.key || string(body) != tt.want || rows != tt.rows {
+			t.Errorf("%s: want %s %q; got %s %q %d rows", tt.uri, tt.key, tt.want, key, body, rows)
+		}
+	}
+}
+
+func TestCanonicalAppend(t *testing.T) {
+	ts := httptest.NewServer(fakeSchema(t, "", map[string]string{"default.events": "id\tUInt32\t\nname\tString\t\n"}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) {
+		c.Fwd = ts.URL
+		tsv := "tsv"
+		c.Tables = map[string]*TableConfig{"events": {Canonical: &tsv, SyncSec: 60}}
+	})
+	key := "/?query=INSERT+INTO+default.events+%28id%2C+name%29+FORMAT+TSV"
+
+	for _, uri := range []string{
+		"?query=INSERT%20INTO%20events%20VALUES",
+		"?query=INSERT%20INTO%20events%20FORMAT%20TSV",
+		"?query=INSERT%20INTO%20events%20FORMAT%20JSONEachRow",
+	} {
+		body := map[string]string{
+			formatValues:      "(1,'a'),(2,'b')",
+			formatTSV:         "3\tc\n",
+			formatJSONEachRow: `{"id":4,"name":"d"}`,
+		}[queryFormat(mustQuery(t, uri))]
+		p.Append(uri, mustQuery(t, uri), []byte(body))
+	}
+	// expression is buffered as is
+	p.Append("?query=INSERT%20INTO%20events%20VALUES", "INSERT INTO events VALUES", []byte("(5,toString(5))"))
+
+	buf := p.store.peek(key)
+	if buf == nil || string(buf.buffer) != "1\ta\n2\tb\n3\tc\n4\td\n" || buf.rowcount != 4 {
+		t.Fatalf("want producers merged in one batch; got %+v", buf)
+	}
+	if buf := p.store.peek("?query=INSERT%20INTO%20events%20VALUES"); buf == nil || string(buf.buffer) != "(5,toString(5))" {
+		t.Errorf("want not converted insert as is; got %+v", buf)
+	}
+	if got := counter(p, ".bytable.events.canonical_errors"); got != 1 {
+		t.Errorf("want 1 canonical error; got %d", got)
+	}
+}
+
+func mustQuery(t *testing.T, uri string) string {
+	query, ok := keyQuery(uri)
+	if !ok {
+		t.Fatalf("%s: no query", uri)
+	}
+	return query
+}
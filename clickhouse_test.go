@@ -0,0 +1,190 @@
+package proxyhouse
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// chInsert is a batch received by fake clickhouse
+type chInsert struct {
+	query   string
+	token   string // insert_deduplication_token param
+	body    string // decompressed
+	rows    []Row
+	partial bool // failed after rows were inserted
+}
+
+// chFailure is an exception response of fake clickhouse,
+// first rows of the batch are inserted before it, as clickhouse does for blocks
+type chFailure struct {
+	status int
+	code   int
+	text   string
+	rows   int
+}
+
+// fakeClickHouse stand in for clickhouse http interface: inserts are parsed and recorded,
+// latency, exceptions and partial failures are set by the test, other queries go to schema
+type fakeClickHouse struct {
+	*httptest.Server
+	schema http.HandlerFunc
+
+	mu       sync.Mutex
+	latency  time.Duration
+	next     []chFailure
+	tables   map[string]chFailure
+	inserts  []chInsert
+	requests int
+}
+
+// newFakeClickHouse start fake clickhouse, it is closed with the test
+func newFakeClickHouse(t testing.TB) *fakeClickHouse {
+	ch := &fakeClickHouse{tables: make(map[string]chFailure)}
+	ch.Server = httptest.NewServer(http.HandlerFunc(ch.serve))
+	t.Cleanup(ch.Close)
+	return ch
+}
+
+// setLatency delay every response
+func (ch *fakeClickHouse) setLatency(d time.Duration) {
+	ch.mu.Lock()
+	ch.latency = d
+	ch.mu.Unlock()
+}
+
+// failNext fail next inserts with failures, in order
+func (ch *fakeClickHouse) failNext(failures ...chFailure) {
+	ch.mu.Lock()
+	ch.next = append(ch.next, failures...)
+	ch.mu.Unlock()
+}
+
+// failTable fail all inserts into table until it is called with zero failure
+func (ch *fakeClickHouse) failTable(table string, f chFailure) {
+	ch.mu.Lock()
+	if f.status == 0 {
+		delete(ch.tables, table)
+	} else {
+		ch.tables[table] = f
+	}
+	ch.mu.Unlock()
+}
+
+// received return recorded inserts and count of insert requests
+func (ch *fakeClickHouse) received() ([]chInsert, int) {
+	ch.mu.Lock()
+	defer ch.mu.Unlock()
+	return append([]chInsert(nil), ch.inserts...), ch.requests
+}
+
+// rowCount return count of inserted rows
+func (ch *fakeClickHouse) rowCount() int {
+	inserts, _ := ch.received()
+	n := 0
+	for _, ins := range inserts {
+		n += len(ins.rows)
+	}
+	return n
+}
+
+// waitRows wait until rows are inserted, fail the test on timeout
+func (ch *fakeClickHouse) waitRows(t testing.TB, rows int, timeout time.Duration) []chInsert {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for ch.rowCount() < rows {
+		if time.Now().After(deadline) {
+			t.Fatalf("want %d rows in clickhouse; got %d", rows, ch.rowCount())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	inserts, _ := ch.received()
+	return inserts
+}
+
+func (ch *fakeClickHouse) serve(w http.ResponseWriter, r *http.Request) {
+	params := r.URL.Query()
+	query := params.Get("query")
+	_, table, _, err := parseInsert(query)
+	if err != nil {
+		if ch.schema != nil {
+			ch.schema(w, r)
+			return
+		}
+		ch.exception(w, chFailure{status: http.StatusBadRequest, code: 62, text: "Syntax error"})
+		return
+	}
+	rd, err := decodeReader(r.Header.Get("Content-Encoding"), r.Body)
+	if err != nil {
+		ch.exception(w, chFailure{status: http.StatusBadRequest, code: 432, text: err.Error()})
+		return
+	}
+	body, err := ioutil.ReadAll(rd)
+	rd.Close()
+	if err != nil {
+		ch.exception(w, chFailure{status: http.StatusBadRequest, code: 27, text: err.Error()})
+		return
+	}
+	rows, err := parseRows(queryFormat(query), body)
+	if err != nil {
+		ch.exception(w, chFailure{status: http.StatusBadRequest, code: 27, text: "Cannot parse input: " + err.Error()})
+		return
+	}
+
+	ch.mu.Lock()
+	latency := ch.latency
+	ch.requests++
+	f, fail := ch.tables[table]
+	if !fail && len(ch.next) > 0 {
+		f, fail, ch.next = ch.next[0], true, ch.next[1:]
+	}
+	ins := chInsert{query: query, token: params.Get("insert_deduplication_token"), body: string(body), rows: rows}
+	if fail {
+		ins.partial = true
+		if f.rows < len(rows) {
+			ins.rows = rows[:f.rows]
+		}
+	}
+	if len(ins.rows) > 0 {
+		ch.inserts = append(ch.inserts, ins)
+	}
+	ch.mu.Unlock()
+
+	time.Sleep(latency)
+	if fail {
+		ch.exception(w, f)
+	}
+}
+
+// exception write error as clickhouse does
+func (ch *fakeClickHouse) exception(w http.ResponseWriter, f chFailure) {
+	w.Header().Set("X-ClickHouse-Exception-Code", strconv.Itoa(f.code))
+	http.Error(w, fmt.Sprintf("Code: %d. DB::Exception: %s", f.code, f.text), f.status)
+}
+
+// values return first field of rows of inserts, sorted by insert
+func values(inserts []chInsert) []string {
+	var res []string
+	for _, ins := range inserts {
+		for _, row := range ins.rows {
+			res = append(res, row[0].Value)
+		}
+	}
+	return res
+}
+
+// hasPrefix report if every insert query start with prefix
+func hasPrefix(inserts []chInsert, prefix string) bool {
+	for _, ins := range inserts {
+		if !strings.HasPrefix(ins.query, prefix) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,385 @@
+// Package client send rows to proxyhouse: rows are batched by table locally,
+// encoded as Values, TSV or JSONEachRow and posted with retries
+package client
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// headers of proxyhouse, see synchronous inserts and deduplication
+const (
+	syncHeader        = "X-Proxyhouse-Sync"
+	idempotencyHeader = "X-Proxyhouse-Idempotency-Key"
+)
+
+// ErrClosed is returned by Append after Close
+var ErrClosed = errors.New("client: closed")
+
+// Metrics count client events, proxyhouse MetricStorage satisfy it
+type Metrics interface {
+	Increment(name string, value int)
+}
+
+// Options of client, zero fields get defaults
+type Options struct {
+	// Addr is proxyhouse url, http://localhost:8124 by default
+	Addr string
+	// Format of batches, Values by default
+	Format string
+	// Database, User and Password are sent as query params, proxyhouse forward them to clickhouse
+	Database string
+	User     string
+	Password string
+	// BatchRows flush table batch with this many rows, 1000 by default
+	BatchRows int
+	// BatchBytes flush table batch of this size, 1MB by default
+	BatchBytes int
+	// FlushInterval flush all batches in background, 1s by default
+	FlushInterval time.Duration
+	// Retries of 429 and 503 responses and network errors, 3 by default, -1 disable retries
+	Retries int
+	// Backoff is a first retry wait, doubled on every retry, 100ms by default
+	Backoff time.Duration
+	// MaxInflight limit full batches sent by Append at once, 4 by default, Append wait for a free slot
+	MaxInflight int
+	// Sync wait until batch is sent to clickhouse and return clickhouse error,
+	// batch saved by proxyhouse to resend is not an error
+	Sync bool
+	// HTTPClient post batches, http.DefaultClient by default
+	HTTPClient *http.Client
+	// Metrics get client counters, see Stats
+	Metrics Metrics
+	// OnError get errors of background flush
+	OnError func(err error)
+}
+
+// Error is a not successful proxyhouse response, clickhouse error in sync mode
+type Error struct {
+	Status int
+	Text   string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("client: proxyhouse response %d: %s", e.Status, strings.TrimSpace(e.Text))
+}
+
+// Stats are client counters since start
+type Stats struct {
+	RowsSent     int // rows of sent batches
+	RequestsSent int // sent batches
+	BytesSent    int // bytes of sent batches
+	Retries      int // retried requests
+	Errors       int // batches failed after retries
+}
+
+// batch is encoded rows of one insert query
+type batch struct {
+	query string
+	buf   bytes.Buffer
+	rows  int
+}
+
+// Client batch rows by table and send them to proxyhouse, it is safe for concurrent use
+type Client struct {
+	opts Options
+
+	mu      sync.Mutex
+	batches map[string]*batch
+	closed  bool
+	stats   Stats
+
+	stop     chan struct{}
+	done     chan struct{}
+	inflight chan struct{} // slots of full batches sent in background
+	sending  sync.WaitGroup
+}
+
+// New create client and start background flush
+func New(opts Options) (*Client, error) {
+	if opts.Addr == "" {
+		opts.Addr = "http://localhost:8124"
+	}
+	opts.Addr = strings.TrimSuffix(opts.Addr, "/")
+	switch opts.Format {
+	case "":
+		opts.Format = FormatValues
+	case FormatValues, FormatTSV, FormatJSONEachRow:
+	default:
+		return nil, fmt.Errorf("client: unsupported format %s", opts.Format)
+	}
+	if opts.BatchRows <= 0 {
+		opts.BatchRows = 1000
+	}
+	if opts.BatchBytes <= 0 {
+		opts.BatchBytes = 1 << 20
+	}
+	if opts.FlushInterval <= 0 {
+		opts.FlushInterval = time.Second
+	}
+	if opts.Retries == 0 {
+		opts.Retries = 3
+	}
+	if opts.Backoff <= 0 {
+		opts.Backoff = 100 * time.Millisecond
+	}
+	if opts.MaxInflight <= 0 {
+		opts.MaxInflight = 4
+	}
+	if opts.HTTPClient == nil {
+		opts.HTTPClient = http.DefaultClient
+	}
+	c := &Client{
+		opts:     opts,
+		batches:  make(map[string]*batch),
+		stop:     make(chan struct{}),
+		done:     make(chan struct{}),
+		inflight: make(chan struct{}, opts.MaxInflight),
+	}
+	go c.background()
+	return c, nil
+}
+
+// Append encode row of table columns into local batch, full batch is sent at once,
+// other batches are sent every FlushInterval, send errors go to OnError
+func (c *Client) Append(table string, columns []string, row ...interface{}) error {
+	query := insertQuery(table, columns, c.opts.Format)
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return ErrClosed
+	}
+	b, ok := c.batches[query]
+	if !ok {
+		b = &batch{query: query}
+		c.batches[query] = b
+	}
+	size := b.buf.Len()
+	if err := encodeRow(&b.buf, c.opts.Format, columns, row); err != nil {
+		// row is not added
+		b.buf.Truncate(size)
+		c.mu.Unlock()
+		return err
+	}
+	b.rows++
+	full := b.rows >= c.opts.BatchRows || b.buf.Len() >= c.opts.BatchBytes
+	if full {
+		delete(c.batches, query)
+		// counted under lock, so Close wait for it
+		c.sending.Add(1)
+	}
+	c.mu.Unlock()
+	if full {
+		c.inflight <- struct{}{}
+		go func() {
+			defer func() {
+				<-c.inflight
+				c.sending.Done()
+			}()
+			c.report(c.send(context.Background(), b))
+		}()
+	}
+	return nil
+}
+
+// Send encode rows and post them at once, without local batching
+func (c *Client) Send(ctx context.Context, table string, columns []string, rows [][]interface{}) error {
+	b := &batch{query: insertQuery(table, columns, c.opts.Format)}
+	for _, row := range rows {
+		if err := encodeRow(&b.buf, c.opts.Format, columns, row); err != nil {
+			return err
+		}
+		b.rows++
+	}
+	return c.send(ctx, b)
+}
+
+// Flush send all local batches, first error is returned
+func (c *Client) Flush(ctx context.Context) error {
+	c.mu.Lock()
+	batches := c.batches
+	c.batches = make(map[string]*batch)
+	c.mu.Unlock()
+	var first error
+	for _, b := range batches {
+		if err := c.send(ctx, b); err != nil && first == nil {
+			first = err
+		}
+	}
+	return first
+}
+
+// Close stop background flush, send local batches and wait for batches sent by Append,
+// ctx error is returned if they are not sent in time, rows appended after Close are rejected
+func (c *Client) Close(ctx context.Context) error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return nil
+	}
+	c.closed = true
+	c.mu.Unlock()
+	close(c.stop)
+	<-c.done
+	err := c.Flush(ctx)
+	sent := make(chan struct{})
+	go func() {
+		c.sending.Wait()
+		close(sent)
+	}()
+	select {
+	case <-sent:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Stats return client counters
+func (c *Client) Stats() Stats {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.stats
+}
+
+func (c *Client) background() {
+	defer close(c.done)
+	ticker := time.NewTicker(c.opts.FlushInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stop:
+			return
+		case <-ticker.C:
+			c.report(c.Flush(context.Background()))
+		}
+	}
+}
+
+func (c *Client) report(err error) {
+	if err != nil && c.opts.OnError != nil {
+		c.opts.OnError(err)
+	}
+}
+
+// count add value to client counter and metric
+func (c *Client) count(counter *int, name string, value int) {
+	c.mu.Lock()
+	*counter += value
+	c.mu.Unlock()
+	if c.opts.Metrics != nil {
+		c.opts.Metrics.Increment(name, value)
+	}
+}
+
+// uri return proxyhouse url of insert query, params are sorted after query,
+// so batches of all clients with the same settings are merged by proxyhouse
+func (c *Client) uri(query string) string {
+	params := url.Values{}
+	if c.opts.Database != "" {
+		params.Set("database", c.opts.Database)
+	}
+	if c.opts.User != "" {
+		params.Set("user", c.opts.User)
+	}
+	if c.opts.Password != "" {
+		params.Set("password", c.opts.Password)
+	}
+	names := make([]string, 0, len(params))
+	for name := range params {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	uri := c.opts.Addr + "/?query=" + strings.ReplaceAll(url.QueryEscape(query), "+", "%20")
+	for _, name := range names {
+		uri += "&" + name + "=" + url.QueryEscape(params.Get(name))
+	}
+	return uri
+}
+
+// send post batch, 429, 503 and network errors are retried with the same idempotency key,
+// so proxyhouse with dedup skip batch accepted before
+func (c *Client) send(ctx context.Context, b *batch) error {
+	if b.rows == 0 {
+		return nil
+	}
+	key := make([]byte, 16)
+	rand.Read(key)
+	body := b.buf.Bytes()
+	wait := c.opts.Backoff
+	var err error
+	for attempt := 0; ; attempt++ {
+		var retry time.Duration
+		retry, err = c.post(ctx, b.query, hex.EncodeToString(key), body)
+		if err == nil {
+			c.count(&c.stats.RowsSent, "rows_sent", b.rows)
+			c.count(&c.stats.RequestsSent, "requests_sent", 1)
+			c.count(&c.stats.BytesSent, "bytes_sent", len(body))
+			return nil
+		}
+		if retry < 0 || attempt >= c.opts.Retries {
+			break
+		}
+		if retry == 0 {
+			retry = wait
+			wait *= 2
+		}
+		c.count(&c.stats.Retries, "retries", 1)
+		timer := time.NewTimer(retry)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			c.count(&c.stats.Errors, "errors", 1)
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+	c.count(&c.stats.Errors, "errors", 1)
+	return err
+}
+
+// post send batch once, return wait before retry: 0 for backoff, negative if error is final
+func (c *Client) post(ctx context.Context, query, key string, body []byte) (time.Duration, error) {
+	req, err := http.NewRequestWithContext(ctx, "POST", c.uri(query), bytes.NewReader(body))
+	if err != nil {
+		return -1, err
+	}
+	req.Header.Set(idempotencyHeader, key)
+	if c.opts.Sync {
+		req.Header.Set(syncHeader, "1")
+	}
+	resp, err := c.opts.HTTPClient.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, err
+		}
+		return 0, err
+	}
+	defer resp.Body.Close()
+	text, _ := ioutil.ReadAll(resp.Body)
+	// accepted: batch failed and proxyhouse resend it later
+	if resp.StatusCode == http.StatusOK || resp.StatusCode == http.StatusAccepted {
+		return 0, nil
+	}
+	err = &Error{Status: resp.StatusCode, Text: string(text)}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusServiceUnavailable:
+		if sec, _ := strconv.Atoi(resp.Header.Get("Retry-After")); sec > 0 {
+			return time.Duration(sec) * time.Second, err
+		}
+		return 0, err
+	}
+	return -1, err
+}
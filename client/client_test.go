@@ -0,0 +1,206 @@
+package client
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/recoilme/proxyhouse"
+)
+
+// insert is a batch received by fake clickhouse
+type insert struct {
+	query, body string
+}
+
+// startProxy start proxyhouse in front of fake clickhouse, inserts into bad table fail
+func startProxy(t *testing.T) (string, <-chan insert) {
+	t.Helper()
+	inserts := make(chan insert, 10)
+	ch := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		query := r.URL.Query().Get("query")
+		if strings.Contains(query, "bad") {
+			http.Error(w, "Code: 60. DB::Exception: Table db.bad doesn't exist", http.StatusNotFound)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		inserts <- insert{query, string(body)}
+	}))
+	t.Cleanup(ch.Close)
+	cfg := proxyhouse.DefaultConfig()
+	cfg.Fwd, cfg.Port, cfg.SyncSec = ch.URL, 0, 1
+	p, err := proxyhouse.New(proxyhouse.Options{Config: cfg, ErrorsDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(p.Handler())
+	t.Cleanup(func() {
+		ts.Close()
+		p.Shutdown(context.Background())
+	})
+	return ts.URL, inserts
+}
+
+type recordMetrics struct {
+	sync.Mutex
+	counters map[string]int
+}
+
+func (m *recordMetrics) Increment(name string, value int) {
+	m.Lock()
+	m.counters[name] += value
+	m.Unlock()
+}
+
+func TestClientProxy(t *testing.T) {
+	addr, inserts := startProxy(t)
+	metrics := &recordMetrics{counters: make(map[string]int)}
+	c, err := New(Options{Addr: addr, Sync: true, FlushInterval: time.Hour, Metrics: metrics})
+	if err != nil {
+		t.Fatal(err)
+	}
+	columns := []string{"id", "name"}
+	if err = c.Append("db.t", columns, 1, "it's"); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Append("db.t", columns, 2); err == nil {
+		t.Error("want error of short row")
+	}
+	if err = c.Append("db.t", columns, 3, nil); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-inserts:
+		if got.query != "INSERT INTO db.t (id, name) VALUES" || got.body != `(1,'it\'s'),(3,NULL)` {
+			t.Errorf("want batch of appended rows; got '%s' '%s'", got.query, got.body)
+		}
+	default:
+		t.Fatal("want batch sent to clickhouse before sync response")
+	}
+	if err = c.Append("db.t", columns, 4, "x"); err != ErrClosed {
+		t.Errorf("want ErrClosed; got %v", err)
+	}
+	stats := c.Stats()
+	if stats.RowsSent != 2 || stats.RequestsSent != 1 || stats.Errors != 0 {
+		t.Errorf("want 2 rows in 1 request; got %+v", stats)
+	}
+	if metrics.counters["rows_sent"] != 2 {
+		t.Errorf("want rows_sent metric; got %v", metrics.counters)
+	}
+
+	// batch failed in clickhouse is saved by proxyhouse, so it is accepted and not retried
+	c, err = New(Options{Addr: addr, Sync: true, Format: FormatTSV})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	if err = c.Send(context.Background(), "db.bad", columns, [][]interface{}{{1, "a"}}); err != nil {
+		t.Errorf("want spooled batch accepted; got %v", err)
+	}
+	if stats := c.Stats(); stats.Retries != 0 || stats.Errors != 0 {
+		t.Errorf("want no errors and retries; got %+v", stats)
+	}
+}
+
+func TestClientRetry(t *testing.T) {
+	var keys []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		keys = append(keys, r.Header.Get(idempotencyHeader))
+		if len(keys) < 3 {
+			http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		}
+	}))
+	defer ts.Close()
+	c, err := New(Options{Addr: ts.URL, Backoff: time.Millisecond})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close(context.Background())
+	if err = c.Send(context.Background(), "t", []string{"id"}, [][]interface{}{{1}}); err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 3 || keys[0] == "" || keys[0] != keys[1] || keys[1] != keys[2] {
+		t.Errorf("want 3 attempts with one idempotency key; got %q", keys)
+	}
+	if stats := c.Stats(); stats.Retries != 2 || stats.RequestsSent != 1 {
+		t.Errorf("want 2 retries; got %+v", stats)
+	}
+
+	keys = nil
+	c.opts.Retries = 1
+	err = c.Send(context.Background(), "t", []string{"id"}, [][]interface{}{{1}})
+	if e, ok := err.(*Error); !ok || e.Status != http.StatusServiceUnavailable || len(keys) != 2 {
+		t.Errorf("want 503 after 2 attempts; got %v %q", err, keys)
+	}
+}
+
+// full batches are sent with limited concurrency and Close wait for them
+func TestClientInflight(t *testing.T) {
+	var mu sync.Mutex
+	var current, max, received int
+	release := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		if current++; current > max {
+			max = current
+		}
+		mu.Unlock()
+		<-release
+		mu.Lock()
+		current--
+		received++
+		mu.Unlock()
+	}))
+	defer ts.Close()
+	c, err := New(Options{Addr: ts.URL, BatchRows: 1, MaxInflight: 2, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(100 * time.Millisecond)
+		close(release)
+	}()
+	for i := 0; i < 5; i++ {
+		if err = c.Append("t", []string{"id"}, i); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = c.Close(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if received != 5 || max != 2 {
+		t.Errorf("want 5 batches sent by 2 at once before Close return; got %d by %d", received, max)
+	}
+}
+
+func TestClientCloseTimeout(t *testing.T) {
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { <-hang }))
+	defer ts.Close()
+	defer close(hang)
+	c, err := New(Options{Addr: ts.URL, BatchRows: 1, FlushInterval: time.Hour})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = c.Append("t", []string{"id"}, 1); err != nil {
+		t.Fatal(err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if err = c.Close(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want deadline exceeded; got %v", err)
+	}
+}
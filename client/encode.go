@@ -0,0 +1,294 @@
+package client
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"math"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// encoding of rows in insert formats accepted by proxyhouse
+
+// Formats of batches
+const (
+	FormatValues      = "Values"
+	FormatTSV         = "TSV"
+	FormatJSONEachRow = "JSONEachRow"
+)
+
+// plainIdent report whether identifier needs no quotes
+func plainIdent(s string) bool {
+	if s == "" {
+		return false
+	}
+	for i, c := range s {
+		if !(c == '_' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || i > 0 && c >= '0' && c <= '9') {
+			return false
+		}
+	}
+	return true
+}
+
+// quoteIdent quote identifier with backquotes if needed
+func quoteIdent(s string) string {
+	if plainIdent(s) {
+		return s
+	}
+	return "`" + strings.ReplaceAll(s, "`", "\\`") + "`"
+}
+
+// insertQuery return insert query of table, JSONEachRow rows are named, so columns are not listed
+func insertQuery(table string, columns []string, format string) string {
+	var q strings.Builder
+	q.WriteString("INSERT INTO ")
+	for i, part := range strings.SplitN(table, ".", 2) {
+		if i > 0 {
+			q.WriteByte('.')
+		}
+		q.WriteString(quoteIdent(part))
+	}
+	if format != FormatJSONEachRow && len(columns) > 0 {
+		q.WriteString(" (")
+		for i, col := range columns {
+			if i > 0 {
+				q.WriteString(", ")
+			}
+			q.WriteString(quoteIdent(col))
+		}
+		q.WriteByte(')')
+	}
+	if format == FormatValues {
+		q.WriteString(" VALUES")
+	} else {
+		q.WriteString(" FORMAT " + format)
+	}
+	return q.String()
+}
+
+// encodeRow append row to batch, rows of Values are separated with comma, TSV and JSONEachRow rows end with newline
+func encodeRow(buf *bytes.Buffer, format string, columns []string, row []interface{}) error {
+	if len(row) != len(columns) {
+		return fmt.Errorf("client: want %d values; got %d", len(columns), len(row))
+	}
+	switch format {
+	case FormatValues:
+		if buf.Len() > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('(')
+		for i, v := range row {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			if err := writeLiteral(buf, v); err != nil {
+				return fmt.Errorf("client: column %s: %s", columns[i], err)
+			}
+		}
+		buf.WriteByte(')')
+	case FormatTSV:
+		var field bytes.Buffer
+		for i, v := range row {
+			if i > 0 {
+				buf.WriteByte('\t')
+			}
+			if err := writeTSV(buf, &field, v); err != nil {
+				return fmt.Errorf("client: column %s: %s", columns[i], err)
+			}
+		}
+		buf.WriteByte('\n')
+	case FormatJSONEachRow:
+		buf.WriteByte('{')
+		for i, v := range row {
+			if i > 0 {
+				buf.WriteByte(',')
+			}
+			name, _ := json.Marshal(columns[i])
+			buf.Write(name)
+			buf.WriteByte(':')
+			if err := writeJSON(buf, v); err != nil {
+				return fmt.Errorf("client: column %s: %s", columns[i], err)
+			}
+		}
+		buf.WriteString("}\n")
+	default:
+		return fmt.Errorf("client: unsupported format %s", format)
+	}
+	return nil
+}
+
+// writeLiteral write value as VALUES literal: strings are quoted, nil is NULL,
+// time is unix timestamp, slices are arrays
+func writeLiteral(buf *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("NULL")
+	case string:
+		quote(buf, v)
+	case []byte:
+		quote(buf, string(v))
+	default:
+		if s, ok := scalar(v); ok {
+			buf.WriteString(s)
+			return nil
+		}
+		rv := reflect.ValueOf(v)
+		switch rv.Kind() {
+		case reflect.Ptr:
+			if rv.IsNil() {
+				buf.WriteString("NULL")
+				return nil
+			}
+			return writeLiteral(buf, rv.Elem().Interface())
+		case reflect.Slice, reflect.Array:
+			buf.WriteByte('[')
+			for i := 0; i < rv.Len(); i++ {
+				if i > 0 {
+					buf.WriteByte(',')
+				}
+				if err := writeLiteral(buf, rv.Index(i).Interface()); err != nil {
+					return err
+				}
+			}
+			buf.WriteByte(']')
+		default:
+			return fmt.Errorf("unsupported type %T", v)
+		}
+	}
+	return nil
+}
+
+// writeTSV write value as TSV field, field buffer is reused for arrays
+func writeTSV(buf, field *bytes.Buffer, v interface{}) error {
+	switch v := v.(type) {
+	case nil:
+		buf.WriteString("\\N")
+	case string:
+		escape(buf, v)
+	case []byte:
+		escape(buf, string(v))
+	default:
+		if s, ok := scalar(v); ok {
+			buf.WriteString(s)
+			return nil
+		}
+		if rv := reflect.ValueOf(v); rv.Kind() == reflect.Ptr {
+			if rv.IsNil() {
+				buf.WriteString("\\N")
+				return nil
+			}
+			return writeTSV(buf, field, rv.Elem().Interface())
+		}
+		// arrays are written as literals and escaped as a whole
+		field.Reset()
+		if err := writeLiteral(field, v); err != nil {
+			return err
+		}
+		escape(buf, field.String())
+	}
+	return nil
+}
+
+// writeJSON write value as JSON, time is unix timestamp
+func writeJSON(buf *bytes.Buffer, v interface{}) error {
+	switch t := v.(type) {
+	case []byte:
+		v = string(t)
+	case time.Time:
+		s, _ := scalar(t)
+		buf.WriteString(s)
+		return nil
+	}
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(data)
+	return nil
+}
+
+// scalar format numbers, bools and time, ok is false for other types
+func scalar(v interface{}) (string, bool) {
+	switch v := v.(type) {
+	case bool:
+		if v {
+			return "1", true
+		}
+		return "0", true
+	case int:
+		return strconv.FormatInt(int64(v), 10), true
+	case int8:
+		return strconv.FormatInt(int64(v), 10), true
+	case int16:
+		return strconv.FormatInt(int64(v), 10), true
+	case int32:
+		return strconv.FormatInt(int64(v), 10), true
+	case int64:
+		return strconv.FormatInt(v, 10), true
+	case uint:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint8:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint16:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint32:
+		return strconv.FormatUint(uint64(v), 10), true
+	case uint64:
+		return strconv.FormatUint(v, 10), true
+	case float32:
+		return formatFloat(float64(v), 32), true
+	case float64:
+		return formatFloat(v, 64), true
+	case time.Time:
+		// DateTime and DateTime64 parse unix timestamp regardless of server timezone
+		if v.Nanosecond() == 0 {
+			return strconv.FormatInt(v.Unix(), 10), true
+		}
+		return strconv.FormatInt(v.Unix(), 10) + "." + fmt.Sprintf("%09d", v.Nanosecond()), true
+	}
+	return "", false
+}
+
+func formatFloat(f float64, bits int) string {
+	switch {
+	case math.IsNaN(f):
+		return "nan"
+	case math.IsInf(f, 1):
+		return "inf"
+	case math.IsInf(f, -1):
+		return "-inf"
+	}
+	return strconv.FormatFloat(f, 'g', -1, bits)
+}
+
+// quote write string as quoted literal
+func quote(buf *bytes.Buffer, s string) {
+	buf.WriteByte('\'')
+	escape(buf, s)
+	buf.WriteByte('\'')
+}
+
+// escape write string with escape sequences of clickhouse text formats
+func escape(buf *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\'':
+			buf.WriteString("\\'")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case 0:
+			buf.WriteString("\\0")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package client
+
+import (
+	"bytes"
+	"math"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestInsertQuery(t *testing.T) {
+	tests := []struct {
+		table, format string
+		columns       []string
+		want          string
+	}{
+		{"db.t", FormatValues, []string{"id", "name"}, "INSERT INTO db.t (id, name) VALUES"},
+		{"t", FormatTSV, nil, "INSERT INTO t FORMAT TSV"},
+		{"db.my-table", FormatTSV, []string{"1st", "a`b"}, "INSERT INTO db.`my-table` (`1st`, `a\\`b`) FORMAT TSV"},
+		{"t", FormatJSONEachRow, []string{"id"}, "INSERT INTO t FORMAT JSONEachRow"},
+	}
+	for _, tt := range tests {
+		if got := insertQuery(tt.table, tt.columns, tt.format); got != tt.want {
+			t.Errorf("want %s; got %s", tt.want, got)
+		}
+	}
+}
+
+func TestEncodeRow(t *testing.T) {
+	ts := time.Unix(1600000000, 0)
+	s := "p"
+	var nilptr *string
+	columns := []string{"i", "f", "b", "s", "n", "a", "t", "p", "np"}
+	rows := [][]interface{}{
+		{1, 1.5, true, "it's\t\\ok\n", nil, []string{"a", "b'c"}, ts, &s, nilptr},
+		{uint8(2), math.Inf(1), false, []byte("x"), nil, []int{}, ts.Add(time.Millisecond), &s, nilptr},
+	}
+	tests := map[string]string{
+		FormatValues: `(1,1.5,1,'it\'s\t\\ok\n',NULL,['a','b\'c'],1600000000,'p',NULL),` +
+			`(2,inf,0,'x',NULL,[],1600000000.001000000,'p',NULL)`,
+		FormatTSV: strings.Join([]string{"1", "1.5", "1", `it\'s\t\\ok\n`, `\N`, `[\'a\',\'b\\\'c\']`, "1600000000", "p", `\N`}, "\t") + "\n" +
+			strings.Join([]string{"2", "inf", "0", "x", `\N`, "[]", "1600000000.001000000", "p", `\N`}, "\t") + "\n",
+	}
+	for format, want := range tests {
+		var buf bytes.Buffer
+		for _, row := range rows {
+			if err := encodeRow(&buf, format, columns, row); err != nil {
+				t.Fatalf("%s: %v", format, err)
+			}
+		}
+		if buf.String() != want {
+			t.Errorf("%s:\nwant %s\ngot  %s", format, want, buf.String())
+		}
+	}
+}
+
+func TestEncodeJSON(t *testing.T) {
+	var buf bytes.Buffer
+	row := []interface{}{1, "a\"b\n", nil, []byte("x"), time.Unix(1600000000, 0), []string{"y"}}
+	if err := encodeRow(&buf, FormatJSONEachRow, []string{"id", "s", "n", "b", "t", "a"}, row); err != nil {
+		t.Fatal(err)
+	}
+	want := `{"id":1,"s":"a\"b\n","n":null,"b":"x","t":1600000000,"a":["y"]}` + "\n"
+	if buf.String() != want {
+		t.Errorf("want %s; got %s", want, buf.String())
+	}
+}
+
+func TestEncodeErrors(t *testing.T) {
+	var buf bytes.Buffer
+	if err := encodeRow(&buf, FormatValues, []string{"a", "b"}, []interface{}{1}); err == nil || !strings.Contains(err.Error(), "want 2 values; got 1") {
+		t.Errorf("want values count error; got %v", err)
+	}
+	if err := encodeRow(&buf, FormatValues, []string{"a"}, []interface{}{struct{}{}}); err == nil || !strings.Contains(err.Error(), "column a: unsupported type") {
+		t.Errorf("want unsupported type error; got %v", err)
+	}
+}
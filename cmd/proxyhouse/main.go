@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/recoilme/proxyhouse"
+)
+
+// shutdownTimeout limit wait of open requests and background loops on exit
+const shutdownTimeout = 30 * time.Second
+
+var (
+	configPath = flag.String("config", "", "yaml config file, reloaded on SIGHUP or POST /reload with -reloadapi")
+	def        = proxyhouse.DefaultConfig()
+)
+
+func init() {
+	flag.Int("p", def.Port, "TCP port number to listen on (default: 8124)")
+	flag.Int("keepalive", def.Keepalive, "keepalive connection, in seconds")
+	flag.Int("readtimeout", def.ReadTimeout, "request header read timeout, in seconds")
+	flag.String("fwd", def.Fwd, "forward to this server (clickhouse)")
+	flag.String("repl", def.Repl, "replace this string on forward")
+	flag.String("delim", def.Delim, "body delimiter")
+	flag.Int("syncsec", def.SyncSec, "sync interval, in seconds")
+	flag.String("graphitehost", def.GraphiteHost, "graphite host")
+	flag.Int("graphiteport", def.GraphitePort, "graphite port")
+	flag.String("graphiteprefixcnt", def.GraphitePrefixCnt, "graphite prefix for count")
+	flag.String("graphiteprefixavg", def.GraphitePrefixAvg, "graphite prefix for avg")
+	flag.String("grayloghost", def.GraylogHost, "graylog host")
+	flag.Int("graylogport", def.GraylogPort, "graylog port")
+	flag.Bool("isdebug", def.IsDebug, "debug requests")
+	flag.Int("resendint", def.ResendInt, "resend error interval, in seconds")
+	flag.Int("w", def.WarnLevel, "error counts for warning level")
+	flag.Int("c", def.CritLevel, "error counts for error level")
+	flag.String("compress", def.Compress, "compress forwarded inserts: gzip, zstd or lz4 (default: none)")
+	flag.String("native", def.Native, "clickhouse native protocol address for -nativetables")
+	flag.String("nativetables", def.NativeTables, "comma separated tables forwarded with native protocol")
+	flag.Int("nativeport", def.NativePort, "accept native protocol inserts on this port (default: disabled)")
+	flag.String("unixs", def.Unixs, "unix socket for http inserts (default: disabled)")
+	flag.Bool("noudp", def.NoUDP, "disable udp interface, udp listens on -p port")
+	flag.Int("synctimeout", def.SyncTimeout, "max wait of synchronous inserts, in seconds")
+	flag.String("dedup", def.Dedup, "skip repeated inserts by idempotency key header (key) or by body hash too (hash)")
+	flag.Int("dedupwindow", def.DedupWindow, "dedup window, in seconds")
+	flag.String("dedupfile", def.DedupFile, "persist dedup ids in this file (default: memory only)")
+	flag.Bool("deduptoken", def.DedupToken, "send insert_deduplication_token with batches (clickhouse 22.2+)")
+	flag.Bool("validate", def.Validate, "validate rows against table structure, bad requests are rejected with 400")
+	flag.Int("schemattl", def.SchemaTTL, "table structure cache, in seconds")
+	flag.Int("maxbody", def.MaxBody, "max request body, decompressed, in bytes, larger requests are rejected with 413 (0: no limit)")
+	flag.String("canonical", def.Canonical, "re-encode inserts of a table into one format, TSV or RowBinary, so all producers share a batch (default: as is)")
+	flag.String("errorsdir", def.ErrorsDir, "comma separated dirs of batches failed to send, batches are placed round-robin, dirs are created and locked on start")
+	flag.Int("spoolmaxbytes", def.SpoolMaxBytes, "max size of errors dir, in bytes (default: no limit)")
+	flag.Int("spoolmaxfiles", def.SpoolMaxFiles, "max batch files in errors dir (default: no limit)")
+	flag.String("spoolfull", def.SpoolFull, "when errors dir is full: reject new inserts with 503, dropoldest or dropnewest batches")
+	flag.Int("recoverybatches", def.RecoveryBatches, "max batches of errors dir resent per second (0: no limit)")
+	flag.Int("recoveryrows", def.RecoveryRows, "max rows of errors dir resent per second (default: no limit)")
+	flag.Int("recoverybytes", def.RecoveryBytes, "max bytes of errors dir resent per second (default: no limit)")
+	flag.Int("flushworkers", def.FlushWorkers, "max batches sent concurrently, flush waits for a free worker")
+	flag.Int("recoveryworkers", def.RecoveryWorkers, "errors dir files resent concurrently")
+	flag.String("recoverypriority", def.RecoveryPriority, "live: resend errors dir when no live batches are sent, equal: resend together with live batches")
+	flag.Int("recoverymerge", def.RecoveryMerge, "merge spooled batches of a table up to this size, in bytes, before resend (0: resend one by one)")
+	flag.String("faults", def.Faults, "inject faults for chaos testing, like send=10,drop=5,disk=50,latency=200ms (default: none)")
+	flag.Bool("faultsapi", def.FaultsAPI, "enable GET and POST /faults on the insert port, for chaos testing only")
+	flag.Bool("reloadapi", def.ReloadAPI, "enable POST /reload on the insert port")
+}
+
+// flagFields map flag names to config fields
+func flagFields(c *proxyhouse.Config) map[string]interface{} {
+	return map[string]interface{}{
+		"p":                 &c.Port,
+		"keepalive":         &c.Keepalive,
+		"readtimeout":       &c.ReadTimeout,
+		"fwd":               &c.Fwd,
+		"repl":              &c.Repl,
+		"delim":             &c.Delim,
+		"syncsec":           &c.SyncSec,
+		"graphitehost":      &c.GraphiteHost,
+		"graphiteport":      &c.GraphitePort,
+		"graphiteprefixcnt": &c.GraphitePrefixCnt,
+		"graphiteprefixavg": &c.GraphitePrefixAvg,
+		"grayloghost":       &c.GraylogHost,
+		"graylogport":       &c.GraylogPort,
+		"isdebug":           &c.IsDebug,
+		"resendint":         &c.ResendInt,
+		"w":                 &c.WarnLevel,
+		"c":                 &c.CritLevel,
+		"compress":          &c.Compress,
+		"native":            &c.Native,
+		"nativetables":      &c.NativeTables,
+		"nativeport":        &c.NativePort,
+		"unixs":             &c.Unixs,
+		"noudp":             &c.NoUDP,
+		"synctimeout":       &c.SyncTimeout,
+		"dedup":             &c.Dedup,
+		"dedupwindow":       &c.DedupWindow,
+		"dedupfile":         &c.DedupFile,
+		"deduptoken":        &c.DedupToken,
+		"validate":          &c.Validate,
+		"schemattl":         &c.SchemaTTL,
+		"canonical":         &c.Canonical,
+		"maxbody":           &c.MaxBody,
+		"errorsdir":         &c.ErrorsDir,
+		"spoolmaxbytes":     &c.SpoolMaxBytes,
+		"spoolmaxfiles":     &c.SpoolMaxFiles,
+		"spoolfull":         &c.SpoolFull,
+		"recoverybatches":   &c.RecoveryBatches,
+		"recoveryrows":      &c.RecoveryRows,
+		"recoverybytes":     &c.RecoveryBytes,
+		"flushworkers":      &c.FlushWorkers,
+		"recoveryworkers":   &c.RecoveryWorkers,
+		"recoverypriority":  &c.RecoveryPriority,
+		"recoverymerge":     &c.RecoveryMerge,
+		"faults":            &c.Faults,
+		"faultsapi":         &c.FaultsAPI,
+		"reloadapi":         &c.ReloadAPI,
+	}
+}
+
+// setFlags copy flags into config fields, visit is flag.Visit or flag.VisitAll
+func setFlags(c *proxyhouse.Config, visit func(fn func(*flag.Flag))) {
+	fields := flagFields(c)
+	visit(func(f *flag.Flag) {
+		field, ok := fields[f.Name]
+		if !ok {
+			return
+		}
+		getter, ok := f.Value.(flag.Getter)
+		if !ok {
+			return
+		}
+		switch p := field.(type) {
+		case *int:
+			*p = getter.Get().(int)
+		case *string:
+			*p = getter.Get().(string)
+		case *bool:
+			*p = getter.Get().(bool)
+		}
+	})
+}
+
+// loadConfig read config file over flag defaults, flags set in command line win
+func loadConfig() (*proxyhouse.Config, error) {
+	base := proxyhouse.DefaultConfig()
+	setFlags(base, flag.VisitAll)
+	return proxyhouse.LoadConfig(*configPath, base, func(c *proxyhouse.Config) {
+		setFlags(c, flag.Visit)
+	})
+}
+
+func main() {
+	flag.Parse()
+	cfg, err := loadConfig()
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+	p, err := proxyhouse.New(proxyhouse.Options{Config: cfg, Reload: loadConfig})
+	if err != nil {
+		log.Fatal("config: ", err)
+	}
+	if err = p.Start(); err != nil {
+		log.Fatal("start: ", err)
+	}
+
+	// reload config on SIGHUP, send buffered inserts on SIGINT and SIGTERM
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGHUP, syscall.SIGINT, syscall.SIGTERM)
+	for sig := range signals {
+		if sig == syscall.SIGHUP {
+			p.Reload()
+			continue
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		err = p.Shutdown(ctx)
+		cancel()
+		if err != nil {
+			log.Fatal("shutdown: ", err)
+		}
+		return
+	}
+}
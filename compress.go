@@ -0,0 +1,176 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"strings"
+
+	"github.com/klauspost/compress/zstd"
+	"github.com/pierrec/lz4/v4"
+)
+
+const (
+	// clickhouse compressed block: 16 bytes checksum, 1 byte method,
+	// 4 bytes compressed size (with header), 4 bytes decompressed size
+	chChecksumSize = 16
+	chHeaderSize   = 9
+	chMethodNone   = 0x02
+	chMethodLZ4    = 0x82
+	chMethodZSTD   = 0x90
+
+	// lz4 doesn't compress better, larger decompressed size of block is corrupted
+	maxLZ4Ratio = 255
+)
+
+var (
+	errUnsupportedEncoding = errors.New("Error: unsupported content encoding")
+	errCorruptedBlock      = errors.New("Error: corrupted compressed block")
+
+	// zstd encoder is safe for concurrent EncodeAll calls
+	zstdEncoder, _ = zstd.NewWriter(nil)
+)
+
+// decodeReader wrap body reader with decompressor by http Content-Encoding
+func decodeReader(encoding string, body io.Reader) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", "identity":
+		return ioutil.NopCloser(body), nil
+	case "gzip", "x-gzip":
+		return gzip.NewReader(body)
+	case "deflate":
+		return zlib.NewReader(body)
+	case "zstd":
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return zr.IOReadCloser(), nil
+	case "lz4":
+		return ioutil.NopCloser(lz4.NewReader(body)), nil
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// compress body with http Content-Encoding
+func compress(encoding string, body []byte) ([]byte, error) {
+	switch encoding {
+	case "":
+		return body, nil
+	case "gzip":
+		var buf bytes.Buffer
+		zw := gzip.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	case "zstd":
+		return zstdEncoder.EncodeAll(body, make([]byte, 0, len(body)/4)), nil
+	case "lz4":
+		var buf bytes.Buffer
+		zw := lz4.NewWriter(&buf)
+		if _, err := zw.Write(body); err != nil {
+			return nil, err
+		}
+		if err := zw.Close(); err != nil {
+			return nil, err
+		}
+		return buf.Bytes(), nil
+	}
+	return nil, errUnsupportedEncoding
+}
+
+// decompressBlocks unpack clickhouse native compression format (decompress=1), result is limited by limit bytes (0 is no limit)
+// checksum is not verified, clickhouse will reject broken data anyway
+// decompressed size of header is checked before allocation, as it is sent by client
+func decompressBlocks(data []byte, limit int) ([]byte, error) {
+	var res []byte
+	for len(data) > 0 {
+		if len(data) < chChecksumSize+chHeaderSize {
+			return nil, errCorruptedBlock
+		}
+		header := data[chChecksumSize : chChecksumSize+chHeaderSize]
+		method := header[0]
+		compressed := int(binary.LittleEndian.Uint32(header[1:5]))
+		size := int(binary.LittleEndian.Uint32(header[5:9]))
+		if compressed < chHeaderSize || chChecksumSize+compressed > len(data) {
+			return nil, errCorruptedBlock
+		}
+		payload := data[chChecksumSize+chHeaderSize : chChecksumSize+compressed]
+		data = data[chChecksumSize+compressed:]
+		if limit > 0 && len(res)+size > limit {
+			return nil, errBodyTooLarge
+		}
+		switch method {
+		case chMethodNone:
+			res = append(res, payload...)
+		case chMethodLZ4:
+			if size > maxLZ4Ratio*(len(payload)+1) {
+				return nil, errCorruptedBlock
+			}
+			block := make([]byte, size)
+			n, err := lz4.UncompressBlock(payload, block)
+			if err != nil {
+				return nil, err
+			}
+			if n != size {
+				return nil, errCorruptedBlock
+			}
+			res = append(res, block...)
+		case chMethodZSTD:
+			block, err := decompressZstd(payload, size)
+			if err != nil {
+				return nil, err
+			}
+			res = append(res, block...)
+		default:
+			return nil, fmt.Errorf("Error: unknown compression method 0x%x", method)
+		}
+	}
+	return res, nil
+}
+
+// decompressZstd unpack zstd block of size, buffer grow with decoded data, not by size of header,
+// window is limited by size of block
+func decompressZstd(payload []byte, size int) ([]byte, error) {
+	zr, err := zstd.NewReader(bytes.NewReader(payload), zstd.WithDecoderConcurrency(1), zstd.WithDecoderMaxMemory(uint64(size)+1<<20))
+	if err != nil {
+		return nil, err
+	}
+	defer zr.Close()
+	block, err := ioutil.ReadAll(io.LimitReader(zr, int64(size)+1))
+	if err != nil {
+		return nil, err
+	}
+	if len(block) != size {
+		return nil, errCorruptedBlock
+	}
+	return block, nil
+}
+
+// removeParam cut param from raw query, keep other params untouched
+func removeParam(rawQuery, name string) string {
+	params := strings.Split(rawQuery, "&")
+	res := params[:0]
+	for _, p := range params {
+		if p == name || strings.HasPrefix(p, name+"=") {
+			continue
+		}
+		res = append(res, p)
+	}
+	return strings.Join(res, "&")
+}
+
+// isCompressed report if request body was sent compressed
+func isCompressed(r *http.Request) bool {
+	return r.Header.Get("Content-Encoding") != "" || r.URL.Query().Get("decompress") == "1"
+}
@@ -0,0 +1,165 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"encoding/binary"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+func chBlock(method byte, payload []byte, size int) []byte {
+	block := make([]byte, chChecksumSize+chHeaderSize, chChecksumSize+chHeaderSize+len(payload))
+	block[chChecksumSize] = method
+	binary.LittleEndian.PutUint32(block[chChecksumSize+1:], uint32(chHeaderSize+len(payload)))
+	binary.LittleEndian.PutUint32(block[chChecksumSize+5:], uint32(size))
+	return append(block, payload...)
+}
+
+func TestReadBody(t *testing.T) {
+	body := []byte("(1),(2),(3)")
+
+	var gz bytes.Buffer
+	zw := gzip.NewWriter(&gz)
+	zw.Write(body)
+	zw.Close()
+
+	var zl bytes.Buffer
+	fw := zlib.NewWriter(&zl)
+	fw.Write(body)
+	fw.Close()
+
+	enc, _ := zstd.NewWriter(nil)
+	zst := enc.EncodeAll(body, nil)
+
+	tests := []struct {
+		name     string
+		encoding string
+		query    string
+		data     []byte
+	}{
+		{"plain", "", "", body},
+		{"gzip", "gzip", "", gz.Bytes()},
+		{"deflate", "deflate", "", zl.Bytes()},
+		{"zstd", "zstd", "", zst},
+		{"chnone", "", "decompress=1", append(chBlock(chMethodNone, body[:4], 4), chBlock(chMethodNone, body[4:], len(body)-4)...)},
+		{"chzstd", "", "decompress=1", chBlock(chMethodZSTD, zst, len(body))},
+	}
+	for _, tt := range tests {
+		r, _ := http.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES&"+tt.query, bytes.NewReader(tt.data))
+		if tt.encoding != "" {
+			r.Header.Set("Content-Encoding", tt.encoding)
+		}
+		got, rawsize, err := readBody(r, 0)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.name, err)
+			continue
+		}
+		if !bytes.Equal(got, body) || rawsize != len(tt.data) {
+			t.Errorf("%s: want '%s' %d; got '%s' %d", tt.name, body, len(tt.data), got, rawsize)
+		}
+		putBuffer(got)
+	}
+
+	r, _ := http.NewRequest("POST", "/", bytes.NewReader(body))
+	r.Header.Set("Content-Encoding", "br")
+	if _, _, err := readBody(r, 0); err != errUnsupportedEncoding {
+		t.Errorf("br: want errUnsupportedEncoding; got %v", err)
+	}
+	if _, err := decompressBlocks(body, 0); err != errCorruptedBlock {
+		t.Errorf("corrupted: want errCorruptedBlock; got %v", err)
+	}
+	// decompressed size of header is not allocated
+	huge := chBlock(chMethodLZ4, body, 1<<32-1)
+	if _, err := decompressBlocks(huge, 1000); err != errBodyTooLarge {
+		t.Errorf("huge: want errBodyTooLarge; got %v", err)
+	}
+	if _, err := decompressBlocks(huge, 0); err != errCorruptedBlock {
+		t.Errorf("huge lz4: want errCorruptedBlock; got %v", err)
+	}
+	if _, err := decompressBlocks(chBlock(chMethodZSTD, zst, 1<<32-1), 0); err == nil {
+		t.Error("huge zstd: want error")
+	}
+	blocks := append(chBlock(chMethodNone, body, len(body)), chBlock(chMethodNone, body, len(body))...)
+	if _, err := decompressBlocks(blocks, len(body)+1); err != errBodyTooLarge {
+		t.Errorf("total: want errBodyTooLarge; got %v", err)
+	}
+}
+
+func TestRemoveParam(t *testing.T) {
+	tests := map[string]string{
+		"query=INSERT&decompress=1":            "query=INSERT",
+		"decompress=1&query=INSERT&user=u":     "query=INSERT&user=u",
+		"query=INSERT&decompression=1":         "query=INSERT&decompression=1",
+		"query=INSERT%20INTO%20t&decompress=0": "query=INSERT%20INTO%20t",
+	}
+	for in, want := range tests {
+		if got := removeParam(in, "decompress"); got != want {
+			t.Errorf("removeParam(%s): want '%s'; got '%s'", in, want, got)
+		}
+	}
+}
+
+func TestCompress(t *testing.T) {
+	body := bytes.Repeat([]byte("(1,'proxyhouse'),"), 100)
+	for _, encoding := range []string{"", "gzip", "zstd", "lz4"} {
+		compressed, err := compress(encoding, body)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", encoding, err)
+			continue
+		}
+		rd, err := decodeReader(encoding, bytes.NewReader(compressed))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", encoding, err)
+			continue
+		}
+		got, err := ioutil.ReadAll(rd)
+		rd.Close()
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", encoding, err)
+			continue
+		}
+		if !bytes.Equal(got, body) {
+			t.Errorf("%s: roundtrip mismatch", encoding)
+		}
+	}
+	if _, err := compress("br", body); err != errUnsupportedEncoding {
+		t.Errorf("br: want errUnsupportedEncoding; got %v", err)
+	}
+}
+
+func TestSendCompressed(t *testing.T) {
+	body := []byte("(1),(2),(3)")
+	var gotEncoding, gotParam string
+	var gotBody []byte
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotEncoding = r.Header.Get("Content-Encoding")
+		gotParam = r.URL.Query().Get("enable_http_compression")
+		if rd, err := decodeReader(gotEncoding, r.Body); err == nil {
+			gotBody, _ = ioutil.ReadAll(rd)
+			rd.Close()
+		}
+	}))
+	defer ts.Close()
+
+	p := newTestProxy(t, func(c *Config) { c.Fwd, c.Compress = ts.URL, "zstd" })
+
+	if err := p.send("/?query=INSERT%20INTO%20t%20VALUES", body, 3, 0, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if gotEncoding != "zstd" || gotParam != "1" {
+		t.Errorf("want zstd encoding with enable_http_compression=1; got '%s' '%s'", gotEncoding, gotParam)
+	}
+	if !bytes.Equal(gotBody, body) {
+		t.Errorf("body: want '%s'; got '%s'", body, gotBody)
+	}
+	if counter(p, ".bytes_sent_compressed") == 0 {
+		t.Errorf("bytes_sent_compressed metric not incremented")
+	}
+}
@@ -0,0 +1,556 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path"
+	"regexp"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Config is a proxyhouse settings, made from flags and yaml config file, see DefaultConfig
+// config is replaced as a whole on reload, so it must not be changed after load
+type Config struct {
+	Port              int                     `yaml:"port"`
+	Keepalive         int                     `yaml:"keepalive"`
+	ReadTimeout       int                     `yaml:"readtimeout"`
+	Fwd               string                  `yaml:"fwd"`
+	Repl              string                  `yaml:"repl"`
+	Delim             string                  `yaml:"delim"`
+	SyncSec           int                     `yaml:"syncsec"`
+	GraphiteHost      string                  `yaml:"graphitehost"`
+	GraphitePort      int                     `yaml:"graphiteport"`
+	GraphitePrefixCnt string                  `yaml:"graphiteprefixcnt"`
+	GraphitePrefixAvg string                  `yaml:"graphiteprefixavg"`
+	GraylogHost       string                  `yaml:"grayloghost"`
+	GraylogPort       int                     `yaml:"graylogport"`
+	IsDebug           bool                    `yaml:"isdebug"`
+	ResendInt         int                     `yaml:"resendint"`
+	WarnLevel         int                     `yaml:"warnlevel"`
+	CritLevel         int                     `yaml:"critlevel"`
+	Compress          string                  `yaml:"compress"`
+	Native            string                  `yaml:"native"`
+	NativeTables      string                  `yaml:"nativetables"`
+	NativePort        int                     `yaml:"nativeport"`
+	Unixs             string                  `yaml:"unixs"`
+	NoUDP             bool                    `yaml:"noudp"`
+	SyncTimeout       int                     `yaml:"synctimeout"`
+	Dedup             string                  `yaml:"dedup"`
+	DedupWindow       int                     `yaml:"dedupwindow"`
+	DedupFile         string                  `yaml:"dedupfile"`
+	DedupToken        bool                    `yaml:"deduptoken"`
+	Validate          bool                    `yaml:"validate"`
+	SchemaTTL         int                     `yaml:"schemattl"`
+	Canonical         string                  `yaml:"canonical"`
+	MaxBody           int                     `yaml:"maxbody"`
+	FlushWorkers      int                     `yaml:"flushworkers"`
+	Faults            string                  `yaml:"faults"`
+	FaultsAPI         bool                    `yaml:"faultsapi"`
+	ReloadAPI         bool                    `yaml:"reloadapi"`
+	ErrorsDir         string                  `yaml:"errorsdir"`
+	SpoolMaxBytes     int                     `yaml:"spoolmaxbytes"`
+	SpoolMaxFiles     int                     `yaml:"spoolmaxfiles"`
+	SpoolFull         string                  `yaml:"spoolfull"`
+	RecoveryBatches   int                     `yaml:"recoverybatches"`
+	RecoveryRows      int                     `yaml:"recoveryrows"`
+	RecoveryBytes     int                     `yaml:"recoverybytes"`
+	RecoveryWorkers   int                     `yaml:"recoveryworkers"`
+	RecoveryPriority  string                  `yaml:"recoverypriority"`
+	RecoveryMerge     int                     `yaml:"recoverymerge"`
+	Tables            map[string]*TableConfig `yaml:"tables"`
+	Rules             []*Rule                 `yaml:"rules"`
+
+	nativeTables map[string]bool
+	tick         int
+}
+
+// TableConfig override global settings for table, nil or zero mean not set
+type TableConfig struct {
+	Fwd       string            `yaml:"fwd"`
+	Delim     *string           `yaml:"delim"`
+	Compress  *string           `yaml:"compress"`
+	Native    *bool             `yaml:"native"`
+	Validate  *bool             `yaml:"validate"`
+	Canonical *string           `yaml:"canonical"`
+	SyncSec   int               `yaml:"syncsec"`
+	MaxRows   int               `yaml:"maxrows"`
+	MaxBytes  int               `yaml:"maxbytes"`
+	Retries   int               `yaml:"retries"`
+	RetryWait int               `yaml:"retrywait"`
+	MaxErrors int               `yaml:"maxerrors"`
+	MaxAge    int               `yaml:"maxage"`
+	Rename    string            `yaml:"rename"`
+	Transform []TransformConfig `yaml:"transform"`
+
+	chain *transformChain
+}
+
+// Rule apply table settings to tables matched by exact name, glob or regex
+type Rule struct {
+	Match       string `yaml:"match"`
+	Regex       string `yaml:"regex"`
+	TableConfig `yaml:",inline"`
+
+	re *regexp.Regexp
+}
+
+// tableConfig is a resolved settings for table
+type tableConfig struct {
+	fwd       string
+	delim     string
+	compress  string
+	native    bool
+	validate  bool
+	canonical string
+	syncsec   int
+	maxrows   int
+	maxbytes  int
+	retries   int
+	retrywait int
+	maxerrors int
+	maxage    int
+	rename    string
+	transform *transformChain
+}
+
+const defaultMaxErrors = 10
+
+var renameRe = regexp.MustCompile(`^(` + ident + `\.)?` + ident + `$`)
+
+// DefaultConfig return settings used when config and flags don't set them
+func DefaultConfig() *Config {
+	return &Config{
+		Port:              8124,
+		Keepalive:         10,
+		ReadTimeout:       5,
+		Fwd:               "http://localhost:8123",
+		Delim:             ",",
+		SyncSec:           2,
+		GraphitePort:      2023,
+		GraphitePrefixCnt: "relap.count.proxyhouse",
+		GraphitePrefixAvg: "relap.avg.proxyhouse",
+		GraylogPort:       12201,
+		ResendInt:         60,
+		WarnLevel:         400,
+		CritLevel:         500,
+		Native:            "localhost:9000",
+		NoUDP:             true,
+		SyncTimeout:       30,
+		DedupWindow:       60,
+		DedupToken:        true,
+		SchemaTTL:         60,
+		MaxBody:           100 << 20,
+		FlushWorkers:      32,
+		ErrorsDir:         ERROR_DIR,
+		SpoolFull:         spoolReject,
+		RecoveryBatches:   1,
+		RecoveryWorkers:   1,
+		RecoveryPriority:  recoveryLive,
+		RecoveryMerge:     8 << 20,
+	}
+}
+
+// LoadConfig read config file over base settings, then override is applied,
+// so command line flags win over file, base is not changed
+func LoadConfig(path string, base *Config, override func(c *Config)) (*Config, error) {
+	// decoder add tables into existing map, prepare change tables and rules
+	c := *base.clone()
+	if path != "" {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			return nil, err
+		}
+		dec := yaml.NewDecoder(bytes.NewReader(data))
+		dec.KnownFields(true)
+		if err = dec.Decode(&c); err != nil && err != io.EOF {
+			return nil, err
+		}
+	}
+	if override != nil {
+		override(&c)
+	}
+	if err := c.validate(); err != nil {
+		return nil, err
+	}
+	c.prepare()
+	return &c, nil
+}
+
+// clone copy config with its tables and rules, as prepare change them in place
+func (c *Config) clone() *Config {
+	cp := *c
+	if c.Tables != nil {
+		cp.Tables = make(map[string]*TableConfig, len(c.Tables))
+		for name, t := range c.Tables {
+			if t != nil {
+				tc := *t
+				t = &tc
+			}
+			cp.Tables[name] = t
+		}
+	}
+	if c.Rules != nil {
+		cp.Rules = make([]*Rule, len(c.Rules))
+		for i, r := range c.Rules {
+			if r != nil {
+				rc := *r
+				r = &rc
+			}
+			cp.Rules[i] = r
+		}
+	}
+	return &cp
+}
+
+func validateFwd(fwd string) error {
+	u, err := url.Parse(fwd)
+	if err != nil {
+		return err
+	}
+	if (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return errors.New("must be http(s)://host:port")
+	}
+	return nil
+}
+
+// validate check config values
+func (c *Config) validate() error {
+	if err := validateFwd(c.Fwd); err != nil {
+		return fmt.Errorf("fwd %s: %s", c.Fwd, err)
+	}
+	if _, err := compress(c.Compress, nil); err != nil {
+		return fmt.Errorf("compress %s: %s", c.Compress, err)
+	}
+	if c.Port < 0 || c.Port > 65535 {
+		return fmt.Errorf("port %d: out of range", c.Port)
+	}
+	if c.NativePort < 0 || c.NativePort > 65535 {
+		return fmt.Errorf("nativeport %d: out of range", c.NativePort)
+	}
+	if c.SyncSec <= 0 {
+		return fmt.Errorf("syncsec %d: must be positive", c.SyncSec)
+	}
+	if c.ResendInt <= 0 {
+		return fmt.Errorf("resendint %d: must be positive", c.ResendInt)
+	}
+	if c.SyncTimeout <= 0 {
+		return fmt.Errorf("synctimeout %d: must be positive", c.SyncTimeout)
+	}
+	if err := validateDedup(c.Dedup); err != nil {
+		return fmt.Errorf("dedup %s: %s", c.Dedup, err)
+	}
+	if c.DedupWindow <= 0 {
+		return fmt.Errorf("dedupwindow %d: must be positive", c.DedupWindow)
+	}
+	if c.SchemaTTL < 0 {
+		return fmt.Errorf("schemattl %d: must not be negative", c.SchemaTTL)
+	}
+	if _, err := canonicalFormat(c.Canonical); err != nil {
+		return fmt.Errorf("canonical %s: %s", c.Canonical, err)
+	}
+	if c.MaxBody < 0 {
+		return fmt.Errorf("maxbody %d: must not be negative", c.MaxBody)
+	}
+	if _, err := parseFaults(c.Faults); err != nil {
+		return fmt.Errorf("faults %s: %s", c.Faults, err)
+	}
+	if err := validateDirs(c.ErrorsDir); err != nil {
+		return fmt.Errorf("errorsdir %s: %s", c.ErrorsDir, err)
+	}
+	if c.SpoolMaxBytes < 0 || c.SpoolMaxFiles < 0 {
+		return errors.New("spoolmaxbytes and spoolmaxfiles must not be negative")
+	}
+	if err := validateSpoolFull(c.SpoolFull); err != nil {
+		return fmt.Errorf("spoolfull %s: %s", c.SpoolFull, err)
+	}
+	if c.RecoveryBatches < 0 || c.RecoveryRows < 0 || c.RecoveryBytes < 0 || c.RecoveryMerge < 0 {
+		return errors.New("recoverybatches, recoveryrows, recoverybytes and recoverymerge must not be negative")
+	}
+	if c.FlushWorkers < 1 {
+		return fmt.Errorf("flushworkers %d: must be positive", c.FlushWorkers)
+	}
+	if c.RecoveryWorkers < 1 {
+		return fmt.Errorf("recoveryworkers %d: must be positive", c.RecoveryWorkers)
+	}
+	if err := validateRecoveryPriority(c.RecoveryPriority); err != nil {
+		return fmt.Errorf("recoverypriority %s: %s", c.RecoveryPriority, err)
+	}
+	if c.Keepalive < 0 || c.ReadTimeout < 0 {
+		return errors.New("keepalive and readtimeout must not be negative")
+	}
+	for name, t := range c.Tables {
+		if t == nil {
+			return fmt.Errorf("tables.%s: empty", name)
+		}
+		if err := t.validate(); err != nil {
+			return fmt.Errorf("tables.%s.%s", name, err)
+		}
+	}
+	for i, r := range c.Rules {
+		if r == nil || (r.Match == "") == (r.Regex == "") {
+			return fmt.Errorf("rules[%d]: one of match or regex must be set", i)
+		}
+		if r.Match != "" {
+			if _, err := path.Match(r.Match, ""); err != nil {
+				return fmt.Errorf("rules[%d].match %s: %s", i, r.Match, err)
+			}
+		}
+		if r.Regex != "" {
+			if _, err := regexp.Compile(r.Regex); err != nil {
+				return fmt.Errorf("rules[%d].regex %s: %s", i, r.Regex, err)
+			}
+		}
+		if err := r.validate(); err != nil {
+			return fmt.Errorf("rules[%d].%s", i, err)
+		}
+	}
+	return nil
+}
+
+func (t *TableConfig) validate() error {
+	if t.Fwd != "" {
+		if err := validateFwd(t.Fwd); err != nil {
+			return fmt.Errorf("fwd %s: %s", t.Fwd, err)
+		}
+	}
+	if t.Compress != nil {
+		if _, err := compress(*t.Compress, nil); err != nil {
+			return fmt.Errorf("compress %s: %s", *t.Compress, err)
+		}
+	}
+	if t.Canonical != nil {
+		if _, err := canonicalFormat(*t.Canonical); err != nil {
+			return fmt.Errorf("canonical %s: %s", *t.Canonical, err)
+		}
+	}
+	if t.SyncSec < 0 || t.MaxRows < 0 || t.MaxBytes < 0 || t.Retries < 0 || t.RetryWait < 0 || t.MaxErrors < 0 || t.MaxAge < 0 {
+		return errors.New("syncsec, maxrows, maxbytes, retries, retrywait, maxerrors and maxage must not be negative")
+	}
+	if t.MaxErrors > defaultMaxErrors {
+		return fmt.Errorf("maxerrors %d: must not exceed %d", t.MaxErrors, defaultMaxErrors)
+	}
+	if t.Rename != "" && !renameRe.MatchString(t.Rename) {
+		return fmt.Errorf("rename %s: must be table or db.table", t.Rename)
+	}
+	if _, err := newTransformChain(t.Transform); err != nil {
+		return err
+	}
+	return nil
+}
+
+// prepare build lookup maps, table names are lowercase as extractTable result
+func (c *Config) prepare() {
+	c.nativeTables = make(map[string]bool)
+	for _, table := range strings.Split(c.NativeTables, ",") {
+		if table = strings.ToLower(strings.TrimSpace(table)); table != "" {
+			c.nativeTables[table] = true
+		}
+	}
+	tables := make(map[string]*TableConfig, len(c.Tables))
+	c.tick = c.SyncSec
+	for name, t := range c.Tables {
+		tables[strings.ToLower(name)] = t
+		t.prepare()
+		if t.SyncSec > 0 && t.SyncSec < c.tick {
+			c.tick = t.SyncSec
+		}
+	}
+	c.Tables = tables
+	for _, r := range c.Rules {
+		r.prepare()
+		r.Match = strings.ToLower(r.Match)
+		if r.Regex != "" {
+			r.re = regexp.MustCompile(r.Regex)
+		}
+		if r.SyncSec > 0 && r.SyncSec < c.tick {
+			c.tick = r.SyncSec
+		}
+	}
+}
+
+// prepare build transform chain, config is validated already
+func (t *TableConfig) prepare() {
+	if len(t.Transform) > 0 {
+		t.chain, _ = newTransformChain(t.Transform)
+	}
+}
+
+// match report whether rule match lowercase table name
+func (r *Rule) match(name string) bool {
+	if r.re != nil {
+		return r.re.MatchString(name)
+	}
+	ok, _ := path.Match(r.Match, name)
+	return ok
+}
+
+// table return settings for table: global settings, then first matched rule,
+// then tables overrides, db.table is looked up first, then table
+func (c *Config) table(name string) tableConfig {
+	tc := tableConfig{
+		fwd:       c.Fwd,
+		delim:     c.Delim,
+		compress:  c.Compress,
+		native:    c.nativeTables[name],
+		validate:  c.Validate,
+		canonical: c.Canonical,
+		syncsec:   c.SyncSec,
+		maxerrors: defaultMaxErrors,
+	}
+	for _, r := range c.Rules {
+		if r.match(name) {
+			tc.apply(&r.TableConfig)
+			break
+		}
+	}
+	t, ok := c.Tables[name]
+	if !ok {
+		if pos := strings.Index(name, "."); pos >= 0 {
+			t, ok = c.Tables[name[pos+1:]]
+		}
+	}
+	if ok {
+		tc.apply(t)
+	}
+	return tc
+}
+
+func (tc *tableConfig) apply(t *TableConfig) {
+	if t.Fwd != "" {
+		tc.fwd = t.Fwd
+	}
+	if t.Delim != nil {
+		tc.delim = *t.Delim
+	}
+	if t.Compress != nil {
+		tc.compress = *t.Compress
+	}
+	if t.Native != nil {
+		tc.native = *t.Native
+	}
+	if t.Validate != nil {
+		tc.validate = *t.Validate
+	}
+	if t.Canonical != nil {
+		tc.canonical = *t.Canonical
+	}
+	if t.SyncSec > 0 {
+		tc.syncsec = t.SyncSec
+	}
+	if t.MaxRows > 0 {
+		tc.maxrows = t.MaxRows
+	}
+	if t.MaxBytes > 0 {
+		tc.maxbytes = t.MaxBytes
+	}
+	if t.Retries > 0 {
+		tc.retries = t.Retries
+	}
+	if t.RetryWait > 0 {
+		tc.retrywait = t.RetryWait
+	}
+	if t.MaxErrors > 0 {
+		tc.maxerrors = t.MaxErrors
+	}
+	if t.MaxAge > 0 {
+		tc.maxage = t.MaxAge
+	}
+	if t.Rename != "" {
+		tc.rename = t.Rename
+	}
+	if t.chain != nil {
+		tc.transform = t.chain
+	}
+}
+
+// restartRequired return settings changed in new config which are applied on start only
+func (c *Config) restartRequired(n *Config) []string {
+	var res []string
+	if c.Port != n.Port || c.NoUDP != n.NoUDP {
+		res = append(res, "port")
+	}
+	if c.Keepalive != n.Keepalive || c.ReadTimeout != n.ReadTimeout {
+		res = append(res, "keepalive/readtimeout")
+	}
+	if c.GraphiteHost != n.GraphiteHost || c.GraphitePort != n.GraphitePort {
+		res = append(res, "graphite")
+	}
+	if c.GraylogHost != n.GraylogHost || c.GraylogPort != n.GraylogPort {
+		res = append(res, "graylog")
+	}
+	if c.NativePort != n.NativePort {
+		res = append(res, "nativeport")
+	}
+	if c.Unixs != n.Unixs {
+		res = append(res, "unixs")
+	}
+	if c.DedupFile != n.DedupFile {
+		res = append(res, "dedupfile")
+	}
+	if c.FaultsAPI != n.FaultsAPI {
+		res = append(res, "faultsapi")
+	}
+	if c.ReloadAPI != n.ReloadAPI {
+		res = append(res, "reloadapi")
+	}
+	if c.FlushWorkers != n.FlushWorkers {
+		res = append(res, "flushworkers")
+	}
+	if c.ErrorsDir != n.ErrorsDir {
+		res = append(res, "errorsdir")
+	}
+	return res
+}
+
+// Reload replace config with the one returned by Options.Reload, current config is kept on error
+// store is not touched, so buffered data is not lost
+func (p *Proxy) Reload() error {
+	if p.reload == nil {
+		return errNoReload
+	}
+	p.reloadMu.Lock()
+	defer p.reloadMu.Unlock()
+	c, err := p.reload()
+	if err == nil {
+		// config may be made by caller
+		err = c.validate()
+	}
+	if err != nil {
+		p.log(LEVEL_ERR, "Config reload error: ", err)
+		return err
+	}
+	c.prepare()
+	if restart := p.conf().restartRequired(c); len(restart) > 0 {
+		p.log(LEVEL_WARN, "Config reload: restart required to apply ", strings.Join(restart, ", "))
+	}
+	if old := p.conf(); old.Faults != c.Faults {
+		// faults set by POST /faults are kept until config faults change
+		f, _ := parseFaults(c.Faults)
+		p.setFaults(f)
+	}
+	p.config.Store(c)
+	// tables may be altered with config change
+	p.resetSchema()
+	p.log(LEVEL_INFO, "Config reloaded")
+	return nil
+}
+
+func (p *Proxy) doreload(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		http.Error(w, "Sorry, only POST method is supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Server", "proxyhouse "+version)
+	if err := p.Reload(); err != nil {
+		http.Error(w, "Config error: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	fmt.Fprint(w, "Config reloaded\r\n")
+}
@@ -0,0 +1,164 @@
+package proxyhouse
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeConfig(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "proxyhouse.yaml")
+	if err := ioutil.WriteFile(path, []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestLoadConfig(t *testing.T) {
+	path := writeConfig(t, `
+fwd: http://ch1:8123
+syncsec: 5
+compress: gzip
+nativetables: db.native
+tables:
+  DB.Logs:
+    fwd: http://ch2:8123
+    compress: ""
+  events:
+    delim: "\n"
+    native: true
+rules:
+  - match: db.logs_*
+    syncsec: 1
+    maxrows: 1000
+    rename: db.logs
+  - regex: ^stat\..+_tmp$
+    retries: 2
+    retrywait: 1
+    maxerrors: 3
+  - match: "*events"
+    syncsec: 3
+    maxbytes: 4096
+  - match: db.logs_*
+    fwd: http://ch3:8123
+`)
+	c, err := LoadConfig(path, DefaultConfig(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Fwd != "http://ch1:8123" || c.SyncSec != 5 || c.Port != DefaultConfig().Port || c.tick != 1 {
+		t.Errorf("unexpected config %+v", c)
+	}
+	def := tableConfig{fwd: "http://ch1:8123", delim: c.Delim, compress: "gzip", syncsec: 5, maxerrors: defaultMaxErrors}
+	tests := map[string]func(tc *tableConfig){
+		"db.logs":   func(tc *tableConfig) { tc.fwd, tc.compress = "http://ch2:8123", "" },
+		"db.events": func(tc *tableConfig) { tc.delim, tc.native, tc.syncsec, tc.maxbytes = "\n", true, 3, 4096 },
+		"events":    func(tc *tableConfig) { tc.delim, tc.native, tc.syncsec, tc.maxbytes = "\n", true, 3, 4096 },
+		"db.native": func(tc *tableConfig) { tc.native = true },
+		"other":     func(tc *tableConfig) {},
+		"db.logs_1": func(tc *tableConfig) { tc.syncsec, tc.maxrows, tc.rename = 1, 1000, "db.logs" },
+		"stat.a_tmp": func(tc *tableConfig) {
+			tc.retries, tc.retrywait, tc.maxerrors = 2, 1, 3
+		},
+	}
+	for table, change := range tests {
+		want := def
+		change(&want)
+		if got := c.table(table); got != want {
+			t.Errorf("%s: want %+v; got %+v", table, want, got)
+		}
+	}
+}
+
+func TestLoadConfigErrors(t *testing.T) {
+	tests := map[string]string{
+		"fwd: localhost:8123":                   "fwd",
+		"compress: brotli":                      "compress",
+		"syncsec: 0":                            "syncsec",
+		"p: 8124":                               "field p not found",
+		"tables:\n  t:\n    fwd: ftp://h":       "tables.t.fwd",
+		"tables:\n  t:\n    compress: snappy":   "tables.t.compress",
+		"tables:\n  t:":                         "tables.t: empty",
+		"tables:\n  t:\n    maxerrors: 11":      "tables.t.maxerrors",
+		"tables:\n  t:\n    rename: a b":        "tables.t.rename",
+		"tables:\n  t:\n    canonical: Native":  "tables.t.canonical",
+		"canonical: CSV":                        "canonical CSV",
+		"rules:\n  - syncsec: 1":                "rules[0]: one of match or regex",
+		"rules:\n  - match: '[a'":               "rules[0].match",
+		"rules:\n  - regex: '(a'":               "rules[0].regex",
+		"rules:\n  - match: t\n    retries: -1": "rules[0].syncsec",
+	}
+	for data, want := range tests {
+		_, err := LoadConfig(writeConfig(t, data), DefaultConfig(), nil)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: want error with '%s'; got %v", data, want, err)
+		}
+	}
+}
+
+func TestLoadConfigOverride(t *testing.T) {
+	base := DefaultConfig()
+	base.Tables = map[string]*TableConfig{"base": {SyncSec: 5}}
+	path := writeConfig(t, "fwd: http://ch1:8123\nport: 9000\ntables:\n  file:\n    syncsec: 1\n")
+	c, err := LoadConfig(path, base, func(c *Config) { c.Port = 8000 })
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.Fwd != "http://ch1:8123" || c.Port != 8000 || c.table("base").syncsec != 5 || c.table("file").syncsec != 1 {
+		t.Errorf("want file over base and override over file; got %+v", c)
+	}
+	if len(base.Tables) != 1 || base.Port != DefaultConfig().Port {
+		t.Errorf("want base not changed; got %+v", base)
+	}
+}
+
+func TestReloadConfig(t *testing.T) {
+	var path string
+	reload := func() (*Config, error) { return LoadConfig(path, DefaultConfig(), nil) }
+	p, err := New(Options{Reload: reload, ErrorsDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := p.conf()
+	p.Append("/?query=INSERT%20INTO%20t%20VALUES", "INSERT INTO t VALUES", []byte("(1)"))
+
+	path = writeConfig(t, "fwd: http://ch2:8123\nport: 9000\n")
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if p.conf().Fwd != "http://ch2:8123" {
+		t.Errorf("want reloaded fwd; got %s", p.conf().Fwd)
+	}
+	if restart := old.restartRequired(p.conf()); len(restart) != 1 || restart[0] != "port" {
+		t.Errorf("want port restart; got %v", restart)
+	}
+
+	path = writeConfig(t, "fwd: nohost\n")
+	if err := p.Reload(); err == nil {
+		t.Error("want error on bad config")
+	}
+	if p.conf().Fwd != "http://ch2:8123" {
+		t.Errorf("want config kept on error; got %s", p.conf().Fwd)
+	}
+	if p.store.peek("/?query=INSERT%20INTO%20t%20VALUES") == nil {
+		t.Error("want buffers kept on reload")
+	}
+}
+
+// New copy tables and rules, as prepare change them
+func TestNewKeepConfig(t *testing.T) {
+	c := DefaultConfig()
+	c.Tables = map[string]*TableConfig{"Big": {MaxRows: 10, Transform: []TransformConfig{{Type: "drop_column", Column: "a"}}}}
+	c.Rules = []*Rule{{Match: "Logs_*"}}
+	if _, err := New(Options{Config: c, ErrorsDir: t.TempDir()}); err != nil {
+		t.Fatal(err)
+	}
+	if t2 := c.Tables["Big"]; t2 == nil || t2.chain != nil {
+		t.Errorf("want caller tables kept; got %+v", c.Tables)
+	}
+	if c.Rules[0].Match != "Logs_*" {
+		t.Errorf("want caller rules kept; got %s", c.Rules[0].Match)
+	}
+}
@@ -0,0 +1,214 @@
+package proxyhouse
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/recoilme/pudge"
+)
+
+// deduplication of repeated inserts, by idempotency key header or by body hash
+// seen ids are kept in memory for dedup window and optionally persisted with pudge
+
+const (
+	dedupOff  = ""
+	dedupKey  = "key"
+	dedupHash = "hash"
+
+	idempotencyHeader = "X-Proxyhouse-Idempotency-Key"
+	tokenParam        = "insert_deduplication_token"
+)
+
+var (
+	errDedupMode = errors.New("must be key or hash")
+
+	batchStart = time.Now().UnixNano()
+	batchSeq   uint64
+)
+
+type dedupCache struct {
+	sync.Mutex
+	seen      map[string]int64 // id -> expire, unix nano
+	nextSweep time.Time
+	db        *pudge.Db
+	logger    Logger
+}
+
+func validateDedup(mode string) error {
+	switch mode {
+	case dedupOff, dedupKey, dedupHash:
+		return nil
+	}
+	return errDedupMode
+}
+
+// dedupID return id of insert, empty if request must not be deduplicated
+// ids are scoped by uri, so same key for other table is not a duplicate
+func dedupID(mode string, r *http.Request, uri string, body []byte) string {
+	if mode == dedupOff {
+		return ""
+	}
+	h := sha256.New()
+	h.Write([]byte(uri))
+	h.Write([]byte{0})
+	if key := r.Header.Get(idempotencyHeader); key != "" {
+		h.Write([]byte(key))
+	} else if mode == dedupHash {
+		h.Write([]byte{1})
+		h.Write(body)
+	} else {
+		return ""
+	}
+	return hex.EncodeToString(h.Sum(nil)[:16])
+}
+
+// open load not expired ids from pudge file
+func (d *dedupCache) open(path string) error {
+	db, err := pudge.Open(path, &pudge.Config{FileMode: 0644, DirMode: 0755, SyncInterval: 1})
+	if err != nil {
+		return err
+	}
+	keys, err := db.Keys(nil, 0, 0, true)
+	if err != nil {
+		db.Close()
+		return err
+	}
+	now := time.Now().UnixNano()
+	d.Lock()
+	defer d.Unlock()
+	for _, key := range keys {
+		var expire int64
+		if err = db.Get(key, &expire); err != nil {
+			db.Close()
+			return err
+		}
+		if expire > now {
+			d.seen[string(key)] = expire
+		} else {
+			db.Delete(key)
+		}
+	}
+	d.db = db
+	return nil
+}
+
+// duplicate report if id was seen within window, else id is remembered
+func (d *dedupCache) duplicate(id string, window time.Duration) bool {
+	now := time.Now()
+	d.Lock()
+	defer d.Unlock()
+	if now.After(d.nextSweep) {
+		d.sweep(now.UnixNano())
+		d.nextSweep = now.Add(window)
+	}
+	if expire, ok := d.seen[id]; ok && expire > now.UnixNano() {
+		return true
+	}
+	expire := now.Add(window).UnixNano()
+	d.seen[id] = expire
+	if d.db != nil {
+		if err := d.db.Set(id, expire); err != nil {
+			if d.logger != nil {
+				d.logger.Log(LEVEL_ERR, "Dedup store error: ", err)
+			}
+		}
+	}
+	return false
+}
+
+// forget remove id of insert which is not accepted, so it may be repeated
+func (d *dedupCache) forget(id string) {
+	d.Lock()
+	defer d.Unlock()
+	delete(d.seen, id)
+	if d.db != nil {
+		d.db.Delete(id)
+	}
+}
+
+// close persisted ids file
+func (d *dedupCache) close() error {
+	d.Lock()
+	defer d.Unlock()
+	if d.db == nil {
+		return nil
+	}
+	err := d.db.Close()
+	d.db = nil
+	return err
+}
+
+// sweep remove expired ids, must be called under lock
+func (d *dedupCache) sweep(now int64) {
+	for id, expire := range d.seen {
+		if expire <= now {
+			delete(d.seen, id)
+			if d.db != nil {
+				d.db.Delete(id)
+			}
+		}
+	}
+}
+
+// newBatchID return unique id of batch
+func newBatchID() string {
+	return fmt.Sprintf("%s-%x-%x", hostname, batchStart, atomic.AddUint64(&batchSeq, 1))
+}
+
+// withToken add insert_deduplication_token to key, so clickhouse skip resent batch
+// token is a part of key, so it is saved with batch to errors dir, token set by client is kept
+func (p *Proxy) withToken(key, token string) string {
+	if !p.conf().DedupToken || hasParam(key, tokenParam) {
+		return key
+	}
+	sep := "&"
+	if !strings.Contains(key, "?") {
+		sep = "?"
+	}
+	return key + sep + tokenParam + "=" + url.QueryEscape(token)
+}
+
+// paramValue return unescaped param of key, empty if it is missed
+func paramValue(key, name string) string {
+	pos := strings.IndexByte(key, '?')
+	if pos < 0 {
+		return ""
+	}
+	for _, p := range strings.Split(key[pos+1:], "&") {
+		if strings.HasPrefix(p, name+"=") {
+			v, _ := url.QueryUnescape(p[len(name)+1:])
+			return v
+		}
+	}
+	return ""
+}
+
+// dropParam remove param from key
+func dropParam(key, name string) string {
+	pos := strings.IndexByte(key, '?')
+	if pos < 0 {
+		return key
+	}
+	return key[:pos+1] + removeParam(key[pos+1:], name)
+}
+
+func hasParam(key, name string) bool {
+	pos := strings.IndexByte(key, '?')
+	if pos < 0 {
+		return false
+	}
+	for _, p := range strings.Split(key[pos+1:], "&") {
+		if p == name || strings.HasPrefix(p, name+"=") {
+			return true
+		}
+	}
+	return false
+}
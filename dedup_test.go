@@ -0,0 +1,160 @@
+package proxyhouse
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestDedupID(t *testing.T) {
+	uri := "?query=INSERT%20INTO%20t%20VALUES"
+	req := httptest.NewRequest("POST", "/"+uri, nil)
+	keyed := httptest.NewRequest("POST", "/"+uri, nil)
+	keyed.Header.Set(idempotencyHeader, "batch-1")
+	body := []byte("(1)")
+
+	if id := dedupID(dedupOff, keyed, uri, body); id != "" {
+		t.Errorf("want no id when dedup is off; got %s", id)
+	}
+	if id := dedupID(dedupKey, req, uri, body); id != "" {
+		t.Errorf("want no id without key header; got %s", id)
+	}
+	if dedupID(dedupKey, keyed, uri, body) != dedupID(dedupHash, keyed, uri, []byte("(2)")) {
+		t.Error("want key header id regardless of body")
+	}
+	if dedupID(dedupHash, req, uri, body) == dedupID(dedupHash, req, uri, []byte("(2)")) {
+		t.Error("want different ids for different bodies")
+	}
+	if dedupID(dedupHash, req, uri, body) == dedupID(dedupHash, req, "?query=INSERT%20INTO%20t2%20VALUES", body) {
+		t.Error("want different ids for different tables")
+	}
+}
+
+func TestDedupWindow(t *testing.T) {
+	d := &dedupCache{seen: make(map[string]int64)}
+	window := 50 * time.Millisecond
+	if d.duplicate("a", window) {
+		t.Error("want first insert accepted")
+	}
+	if !d.duplicate("a", window) {
+		t.Error("want repeated insert skipped")
+	}
+	time.Sleep(2 * window)
+	if d.duplicate("a", window) {
+		t.Error("want insert accepted after window")
+	}
+	d.duplicate("b", time.Nanosecond)
+	time.Sleep(time.Millisecond)
+	d.nextSweep = time.Time{}
+	d.duplicate("c", window)
+	if _, ok := d.seen["b"]; ok {
+		t.Error("want expired id swept")
+	}
+}
+
+func TestDedupPersist(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "dedup")
+	d := &dedupCache{seen: make(map[string]int64)}
+	if err := d.open(path); err != nil {
+		t.Fatal(err)
+	}
+	d.duplicate("a", time.Minute)
+	d.duplicate("b", time.Nanosecond)
+	d.db.Close()
+
+	d = &dedupCache{seen: make(map[string]int64)}
+	if err := d.open(path); err != nil {
+		t.Fatal(err)
+	}
+	defer d.db.Close()
+	if !d.duplicate("a", time.Minute) {
+		t.Error("want persisted id skipped")
+	}
+	if _, ok := d.seen["b"]; ok {
+		t.Error("want expired id not loaded")
+	}
+}
+
+func TestDedupRequest(t *testing.T) {
+	p := newTestProxy(t, func(c *Config) {
+		c.Dedup = dedupHash
+		c.Rules = []*Rule{{Match: "dedup", TableConfig: TableConfig{SyncSec: 60}}}
+	})
+	key := "?query=INSERT%20INTO%20dedup%20VALUES"
+	for _, body := range []string{"(1)", "(1)", "(2)", "(1)"} {
+		rr := httptest.NewRecorder()
+		p.dorequest(rr, httptest.NewRequest("POST", "/"+key, strings.NewReader(body)))
+		if rr.Code != http.StatusOK {
+			t.Fatalf("want 200; got %d", rr.Code)
+		}
+	}
+	if got := string(p.store.peek(key).buffer); got != "(1),(2)" {
+		t.Errorf("want repeated bodies skipped; got '%s'", got)
+	}
+	if counter(p, ".dedup_skipped") != 2 {
+		t.Errorf("want 2 skipped; got %d", counter(p, ".dedup_skipped"))
+	}
+}
+
+// synchronous insert failed in outage is accepted, so the retry is skipped and rows are inserted once
+func TestDedupSyncOutage(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) { c.Fwd, c.Dedup, c.RecoveryBatches = ch.URL, dedupKey, 0 })
+	insert := func() int {
+		req := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20t%20VALUES&sync=1", strings.NewReader("(1),(2)"))
+		req.Header.Set(idempotencyHeader, "batch-1")
+		return syncRequest(t, p, req).Code
+	}
+	ch.failTable("t", chFailure{status: http.StatusServiceUnavailable, code: 242, text: "Table is in readonly mode"})
+	if code := insert(); code != http.StatusAccepted {
+		t.Fatalf("want failed insert accepted; got %d", code)
+	}
+	if code := insert(); code != http.StatusOK || counter(p, ".dedup_skipped") != 1 {
+		t.Fatalf("want retry skipped; got %d skipped %d", code, counter(p, ".dedup_skipped"))
+	}
+	ch.failTable("t", chFailure{})
+	if err := p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if inserts, _ := ch.received(); len(inserts) != 1 || ch.rowCount() != 2 {
+		t.Errorf("want one copy of each row; got %+v", inserts)
+	}
+}
+
+func TestWithToken(t *testing.T) {
+	p := newTestProxy(t, nil)
+	tests := map[string]string{
+		"?query=INSERT%20INTO%20t%20VALUES":                                "?query=INSERT%20INTO%20t%20VALUES&insert_deduplication_token=b-1",
+		"/?query=INSERT%20INTO%20t%20VALUES&insert_deduplication_token=c1": "/?query=INSERT%20INTO%20t%20VALUES&insert_deduplication_token=c1",
+		"/": "/?insert_deduplication_token=b-1",
+	}
+	for key, want := range tests {
+		if got := p.withToken(key, "b-1"); got != want {
+			t.Errorf("%s: want %s; got %s", key, want, got)
+		}
+	}
+	p = newTestProxy(t, func(c *Config) { c.DedupToken = false })
+	if got := p.withToken("/?query=x", "b-1"); got != "/?query=x" {
+		t.Errorf("want no token when disabled; got %s", got)
+	}
+}
+
+func TestFlushToken(t *testing.T) {
+	var tokens []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		tokens = append(tokens, r.URL.Query().Get(tokenParam))
+	}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd, c.DedupToken = ts.URL, true })
+
+	key := "?query=INSERT%20INTO%20t%20VALUES"
+	p.flush(key, &Buffer{rowcount: 1, buffer: []byte("(1)")})
+	p.flush(key, &Buffer{rowcount: 1, buffer: []byte("(1)")})
+	if len(tokens) != 2 || tokens[0] == "" || tokens[0] == tokens[1] {
+		t.Errorf("want unique token per batch; got %v", tokens)
+	}
+}
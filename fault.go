@@ -0,0 +1,183 @@
+package proxyhouse
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// fault injection to rehearse clickhouse outages and disk failures:
+// sends to clickhouse fail, are delayed or lose response, writes to errors dir fail
+
+var (
+	errFaultSend = errors.New("Error: fault injection: send failed")
+	errFaultDrop = errors.New("Error: fault injection: connection dropped")
+	errFaultDisk = errors.New("Error: fault injection: disk write failed")
+)
+
+// faults is a set of injected faults, percents are of sends or writes
+type faults struct {
+	send    int           // send fail before request
+	drop    int           // connection drop after clickhouse got the batch, so it is inserted but resent
+	disk    int           // write to errors dir fail
+	latency time.Duration // added to every send
+}
+
+// parseFaults parse comma separated faults, like send=10,drop=5,disk=50,latency=200ms
+// empty spec disable faults
+func parseFaults(spec string) (*faults, error) {
+	f := &faults{}
+	for _, item := range strings.Split(spec, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		pos := strings.IndexByte(item, '=')
+		if pos < 0 {
+			return nil, fmt.Errorf("%s: must be name=value", item)
+		}
+		name, value := item[:pos], item[pos+1:]
+		if name == "latency" {
+			d, err := time.ParseDuration(value)
+			if err != nil || d < 0 {
+				return nil, fmt.Errorf("latency %s: must be duration, like 200ms", value)
+			}
+			f.latency = d
+			continue
+		}
+		percent, err := strconv.Atoi(value)
+		if err != nil || percent < 0 || percent > 100 {
+			return nil, fmt.Errorf("%s %s: must be percent 0..100", name, value)
+		}
+		switch name {
+		case "send":
+			f.send = percent
+		case "drop":
+			f.drop = percent
+		case "disk":
+			f.disk = percent
+		default:
+			return nil, fmt.Errorf("%s: unknown fault, want send, drop, disk or latency", name)
+		}
+	}
+	return f, nil
+}
+
+// String return faults in parseFaults format, empty if none
+func (f *faults) String() string {
+	var res []string
+	if f.send > 0 {
+		res = append(res, "send="+strconv.Itoa(f.send))
+	}
+	if f.drop > 0 {
+		res = append(res, "drop="+strconv.Itoa(f.drop))
+	}
+	if f.disk > 0 {
+		res = append(res, "disk="+strconv.Itoa(f.disk))
+	}
+	if f.latency > 0 {
+		res = append(res, "latency="+f.latency.String())
+	}
+	return strings.Join(res, ",")
+}
+
+// hit report if fault of percent happens now
+func hit(percent int) bool {
+	return percent > 0 && rand.Intn(100) < percent
+}
+
+// fault return current faults
+func (p *Proxy) fault() *faults {
+	return p.faults.Load().(*faults)
+}
+
+// setFaults replace current faults
+func (p *Proxy) setFaults(f *faults) {
+	p.faults.Store(f)
+	if s := f.String(); s != "" {
+		p.log(LEVEL_WARN, "Fault injection enabled: ", s)
+	} else {
+		p.log(LEVEL_INFO, "Fault injection disabled")
+	}
+}
+
+// injected count fault in metrics
+func (p *Proxy) injected(name string) {
+	p.metrics.Increment(p.conf().GraphitePrefixCnt+".faults."+name, 1)
+}
+
+// do send request to clickhouse with injected faults
+func (p *Proxy) do(req *http.Request) (*http.Response, error) {
+	f := p.fault()
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	if hit(f.send) {
+		p.injected("send")
+		return nil, errFaultSend
+	}
+	resp, err := p.client.Do(req)
+	if err == nil && hit(f.drop) {
+		p.injected("drop")
+		ioutil.ReadAll(resp.Body)
+		resp.Body.Close()
+		return nil, errFaultDrop
+	}
+	return resp, err
+}
+
+// doNative run native insert with injected faults, as do does for http
+func (p *Proxy) doNative(insert func() error) error {
+	f := p.fault()
+	if f.latency > 0 {
+		time.Sleep(f.latency)
+	}
+	if hit(f.send) {
+		p.injected("send")
+		return errFaultSend
+	}
+	err := insert()
+	if err == nil && hit(f.drop) {
+		p.injected("drop")
+		return errFaultDrop
+	}
+	return err
+}
+
+// diskFault return injected error of write to errors dir
+func (p *Proxy) diskFault() error {
+	if hit(p.fault().disk) {
+		p.injected("disk")
+		return errFaultDisk
+	}
+	return nil
+}
+
+// dofaults show faults on GET, replace them with spec of request body on POST
+func (p *Proxy) dofaults(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "proxyhouse "+version)
+	switch r.Method {
+	case "GET":
+	case "POST":
+		spec, err := ioutil.ReadAll(http.MaxBytesReader(w, r.Body, 1024))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		f, err := parseFaults(string(spec))
+		if err != nil {
+			http.Error(w, "Faults error: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		p.setFaults(f)
+	default:
+		http.Error(w, "Sorry, only GET and POST methods are supported.", http.StatusMethodNotAllowed)
+		return
+	}
+	fmt.Fprintf(w, "faults:%s\r\n", p.fault())
+}
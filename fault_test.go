@@ -0,0 +1,147 @@
+package proxyhouse
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseFaults(t *testing.T) {
+	f, err := parseFaults(" send=10, drop=5,disk=100,latency=200ms")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if *f != (faults{send: 10, drop: 5, disk: 100, latency: 200 * time.Millisecond}) {
+		t.Errorf("want all faults; got %+v", f)
+	}
+	if s := f.String(); s != "send=10,drop=5,disk=100,latency=200ms" {
+		t.Errorf("want faults string; got %s", s)
+	}
+	if f, err = parseFaults(""); err != nil || f.String() != "" {
+		t.Errorf("want no faults; got %v %v", f, err)
+	}
+	for spec, want := range map[string]string{
+		"send":          "must be name=value",
+		"send=101":      "must be percent",
+		"latency=fast":  "must be duration",
+		"fire=1":        "unknown fault",
+		"disk=-1,drop=": "must be percent",
+	} {
+		if _, err = parseFaults(spec); err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%s: want error with '%s'; got %v", spec, want, err)
+		}
+	}
+}
+
+// no rows are lost when clickhouse and disk fail, batch is resent with its token
+func TestFaultsNoLoss(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ch.URL; c.Faults = "send=100,disk=100" })
+	key := "/?query=INSERT%20INTO%20t%20VALUES"
+	p.Append(key, "INSERT INTO t VALUES", []byte("(1),(2)"))
+
+	// send and save to errors dir fail, batch is kept in store
+	for key, buf := range p.store.drain() {
+		p.flush(key, buf)
+	}
+	buffers := p.store.buffers()
+	if len(buffers) != 1 || len(spooled(t, p.errorsDirs[0])) != 0 {
+		t.Fatalf("want batch requeued; got %d buffers %v", len(buffers), spooled(t, p.errorsDirs[0]))
+	}
+	for k, buf := range buffers {
+		if !strings.HasPrefix(k, key+"&"+tokenParam+"=") || string(buf.buffer) != "(1),(2)" || buf.rowcount != 2 {
+			t.Errorf("want batch with token; got %s '%s' %d", k, buf.buffer, buf.rowcount)
+		}
+	}
+	if counter(p, ".faults.send") != 1 || counter(p, ".faults.disk") != 1 || counter(p, ".save_errors") != 1 {
+		t.Errorf("want fault metrics; got send %d disk %d save %d",
+			counter(p, ".faults.send"), counter(p, ".faults.disk"), counter(p, ".save_errors"))
+	}
+
+	// clickhouse insert batch, but response is lost, so batch is saved to errors dir
+	p.setFaults(&faults{drop: 100})
+	for key, buf := range p.store.drain() {
+		p.flush(key, buf)
+	}
+	if files := spooled(t, p.errorsDirs[0]); len(files) != 1 {
+		t.Fatalf("want batch spooled; got %v", files)
+	}
+
+	// resent batch has the same token, so clickhouse skip it
+	p.setFaults(&faults{})
+	if err := p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	inserts, _ := ch.received()
+	if len(inserts) != 2 || inserts[0].token == "" || inserts[0].token != inserts[1].token {
+		t.Fatalf("want batch inserted twice with one token; got %+v", inserts)
+	}
+	if got := values(inserts[1:]); strings.Join(got, ",") != "1,2" {
+		t.Errorf("want all rows; got %v", got)
+	}
+}
+
+func TestFaultsHandler(t *testing.T) {
+	var faultsConf string
+	cfg := DefaultConfig()
+	cfg.FaultsAPI = true
+	p, err := New(Options{
+		Config:    cfg,
+		ErrorsDir: t.TempDir(),
+		Reload: func() (*Config, error) {
+			c := DefaultConfig()
+			c.Faults, c.FaultsAPI = faultsConf, true
+			return c, nil
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ts := httptest.NewServer(p.Handler())
+	defer ts.Close()
+	do := func(method, body string) (int, string) {
+		req, _ := http.NewRequest(method, ts.URL+"/faults", strings.NewReader(body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp.StatusCode, string(data)
+	}
+	if code, body := do("POST", "send=10,latency=1s"); code != http.StatusOK || body != "faults:send=10,latency=1s\r\n" {
+		t.Errorf("want faults set; got %d %s", code, body)
+	}
+	if code, body := do("POST", "fire=1"); code != http.StatusBadRequest || !strings.Contains(body, "unknown fault") {
+		t.Errorf("want bad faults rejected; got %d %s", code, body)
+	}
+	// reload keep faults until config faults change
+	if err = p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := do("GET", ""); code != http.StatusOK || body != "faults:send=10,latency=1s\r\n" {
+		t.Errorf("want faults kept; got %d %s", code, body)
+	}
+	faultsConf = "disk=50"
+	if err = p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if s := p.fault().String(); s != "disk=50" {
+		t.Errorf("want faults of config; got %s", s)
+	}
+	if code, body := do("POST", ""); code != http.StatusOK || body != "faults:\r\n" {
+		t.Errorf("want faults disabled; got %d %s", code, body)
+	}
+
+	// disabled by default
+	q := newTestProxy(t, nil)
+	rec := httptest.NewRecorder()
+	q.Handler().ServeHTTP(rec, httptest.NewRequest("POST", "/faults", strings.NewReader("send=100")))
+	if q.fault().send != 0 {
+		t.Errorf("want /faults disabled; got %d %s", rec.Code, q.fault())
+	}
+}
@@ -0,0 +1,409 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"io"
+	"regexp"
+	"strings"
+)
+
+const (
+	formatValues      = "Values"
+	formatTSV         = "TabSeparated"
+	formatCSV         = "CSV"
+	formatJSONEachRow = "JSONEachRow"
+	formatRowBinary   = "RowBinary"
+)
+
+var (
+	errRowFormat = errors.New("Error: malformed row")
+	errNotInsert = errors.New("Error: only INSERT queries are supported")
+
+	ident    = "(`[^`]+`|\"[^\"]+\"|\\w+)"
+	insertRe = regexp.MustCompile(`(?is)^\s*INSERT\s+INTO\s+(?:TABLE\s+)?` + ident + `(?:\s*\.\s*` + ident + `)?\s*(?:\(([^)]*)\))?`)
+)
+
+// Field is a single parsed value of a row
+type Field struct {
+	Value  string
+	Null   bool
+	Quoted bool // string literal in VALUES
+}
+
+// Row is a parsed row of insert body
+type Row []Field
+
+// queryFormat return format of insert query, Values by default
+func queryFormat(query string) string {
+	upper := strings.ToUpper(query)
+	pos := strings.LastIndex(upper, " FORMAT ")
+	if pos < 0 {
+		return formatValues
+	}
+	switch f := strings.TrimSpace(query[pos+len(" FORMAT "):]); strings.ToUpper(f) {
+	case "VALUES":
+		return formatValues
+	case "TSV", "TABSEPARATED":
+		return formatTSV
+	case "CSV":
+		return formatCSV
+	case "JSONEACHROW":
+		return formatJSONEachRow
+	case "ROWBINARY":
+		return formatRowBinary
+	default:
+		return f
+	}
+}
+
+// parseInsert return database (if any), table and column list of insert query
+func parseInsert(query string) (database, table string, columns []string, err error) {
+	m := insertRe.FindStringSubmatch(query)
+	if m == nil {
+		return "", "", nil, errNotInsert
+	}
+	table = unquoteIdent(m[1])
+	if m[2] != "" {
+		database, table = table, unquoteIdent(m[2])
+	}
+	if strings.TrimSpace(m[3]) != "" {
+		for _, col := range strings.Split(m[3], ",") {
+			columns = append(columns, unquoteIdent(col))
+		}
+	}
+	return database, table, columns, nil
+}
+
+// parseRows parse merged body in given format
+func parseRows(format string, body []byte) ([]Row, error) {
+	switch format {
+	case formatValues:
+		return parseValues(body)
+	case formatTSV:
+		return parseTSV(body), nil
+	case formatCSV:
+		return parseCSV(body)
+	}
+	return nil, errors.New("Error: unsupported format " + format)
+}
+
+// parseValues parse (1,'a'),(2,'b') tuples, any spaces or commas between tuples allowed
+func parseValues(body []byte) ([]Row, error) {
+	var rows []Row
+	i, n := 0, len(body)
+	for {
+		for i < n && (isSpace(body[i]) || body[i] == ',' || body[i] == ';') {
+			i++
+		}
+		if i >= n {
+			return rows, nil
+		}
+		if body[i] != '(' {
+			return nil, errRowFormat
+		}
+		i++
+		var row Row
+		for {
+			for i < n && isSpace(body[i]) {
+				i++
+			}
+			if i >= n {
+				return nil, errRowFormat
+			}
+			var f Field
+			if body[i] == '\'' {
+				val, next, err := unquote(body, i)
+				if err != nil {
+					return nil, err
+				}
+				f = Field{Value: val, Quoted: true}
+				i = next
+			} else {
+				start, depth := i, 0
+			raw:
+				for ; i < n; i++ {
+					switch body[i] {
+					case '(', '[':
+						depth++
+					case ']':
+						depth--
+					case ')':
+						if depth == 0 {
+							break raw
+						}
+						depth--
+					case ',':
+						if depth == 0 {
+							break raw
+						}
+					case '\'':
+						_, next, err := unquote(body, i)
+						if err != nil {
+							return nil, err
+						}
+						i = next - 1
+					}
+				}
+				val := string(bytes.TrimSpace(body[start:i]))
+				f = Field{Value: val, Null: strings.EqualFold(val, "NULL")}
+			}
+			row = append(row, f)
+			for i < n && isSpace(body[i]) {
+				i++
+			}
+			if i >= n {
+				return nil, errRowFormat
+			}
+			if body[i] == ',' {
+				i++
+				continue
+			}
+			if body[i] == ')' {
+				i++
+				break
+			}
+			return nil, errRowFormat
+		}
+		rows = append(rows, row)
+	}
+}
+
+// unquote read single quoted string started at pos, return value and position after closing quote
+func unquote(body []byte, pos int) (string, int, error) {
+	var sb strings.Builder
+	for i := pos + 1; i < len(body); i++ {
+		c := body[i]
+		switch c {
+		case '\\':
+			i++
+			if i >= len(body) {
+				return "", 0, errRowFormat
+			}
+			sb.WriteByte(unescapeByte(body[i]))
+		case '\'':
+			if i+1 < len(body) && body[i+1] == '\'' {
+				sb.WriteByte('\'')
+				i++
+				continue
+			}
+			return sb.String(), i + 1, nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return "", 0, errRowFormat
+}
+
+// parseTSV parse tab separated rows, empty lines skipped
+func parseTSV(body []byte) []Row {
+	var rows []Row
+	for _, line := range bytes.Split(body, []byte("\n")) {
+		line = bytes.TrimSuffix(line, []byte("\r"))
+		if len(line) == 0 {
+			continue
+		}
+		fields := bytes.Split(line, []byte("\t"))
+		row := make(Row, len(fields))
+		for i, f := range fields {
+			if string(f) == "\\N" {
+				row[i] = Field{Null: true}
+				continue
+			}
+			row[i] = Field{Value: unescapeTSV(f)}
+		}
+		rows = append(rows, row)
+	}
+	return rows
+}
+
+// parseCSV parse comma separated rows, \N is NULL
+func parseCSV(body []byte) ([]Row, error) {
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.LazyQuotes = true
+	var rows []Row
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			return rows, nil
+		}
+		if err != nil {
+			return nil, errRowFormat
+		}
+		row := make(Row, len(record))
+		for i, f := range record {
+			if f == "\\N" {
+				row[i] = Field{Null: true}
+				continue
+			}
+			row[i] = Field{Value: f}
+		}
+		rows = append(rows, row)
+	}
+}
+
+func unescapeTSV(f []byte) string {
+	if bytes.IndexByte(f, '\\') < 0 {
+		return string(f)
+	}
+	var sb strings.Builder
+	for i := 0; i < len(f); i++ {
+		if f[i] == '\\' && i+1 < len(f) {
+			i++
+			sb.WriteByte(unescapeByte(f[i]))
+			continue
+		}
+		sb.WriteByte(f[i])
+	}
+	return sb.String()
+}
+
+func unescapeByte(c byte) byte {
+	switch c {
+	case 'b':
+		return '\b'
+	case 'f':
+		return '\f'
+	case 'r':
+		return '\r'
+	case 'n':
+		return '\n'
+	case 't':
+		return '\t'
+	case '0':
+		return 0
+	}
+	return c
+}
+
+// encodeTSV write rows in TabSeparated format
+func encodeTSV(rows []Row) []byte {
+	var buf bytes.Buffer
+	for _, row := range rows {
+		for i, f := range row {
+			if i > 0 {
+				buf.WriteByte('\t')
+			}
+			if f.Null {
+				buf.WriteString("\\N")
+				continue
+			}
+			escapeTSV(&buf, f.Value)
+		}
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// encodeValues write rows as VALUES tuples, not quoted fields are written as is
+func encodeValues(rows []Row) []byte {
+	var buf bytes.Buffer
+	for i, row := range rows {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('(')
+		for j, f := range row {
+			if j > 0 {
+				buf.WriteByte(',')
+			}
+			switch {
+			case f.Null:
+				buf.WriteString("NULL")
+			case f.Quoted:
+				buf.WriteByte('\'')
+				escapeTSV(&buf, f.Value)
+				buf.WriteByte('\'')
+			default:
+				buf.WriteString(f.Value)
+			}
+		}
+		buf.WriteByte(')')
+	}
+	return buf.Bytes()
+}
+
+// encodeCSV write rows as comma separated, \N for NULL
+func encodeCSV(rows []Row) ([]byte, error) {
+	var buf bytes.Buffer
+	w := csv.NewWriter(&buf)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, f := range row {
+			if f.Null {
+				record[i] = "\\N"
+				continue
+			}
+			record[i] = f.Value
+		}
+		if err := w.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	w.Flush()
+	return buf.Bytes(), w.Error()
+}
+
+func escapeTSV(buf *bytes.Buffer, s string) {
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; c {
+		case '\\':
+			buf.WriteString("\\\\")
+		case '\'':
+			buf.WriteString("\\'")
+		case '\t':
+			buf.WriteString("\\t")
+		case '\n':
+			buf.WriteString("\\n")
+		case '\r':
+			buf.WriteString("\\r")
+		case 0:
+			buf.WriteString("\\0")
+		default:
+			buf.WriteByte(c)
+		}
+	}
+}
+
+func isSpace(c byte) bool {
+	return c == ' ' || c == '\t' || c == '\n' || c == '\r'
+}
+
+// parseJSONEachRow parse objects, separated with spaces or commas
+func parseJSONEachRow(body []byte) ([]map[string]json.RawMessage, error) {
+	objects := []map[string]json.RawMessage{}
+	for i := 0; ; {
+		for i < len(body) && (isSpace(body[i]) || body[i] == ',') {
+			i++
+		}
+		if i >= len(body) {
+			return objects, nil
+		}
+		var obj map[string]json.RawMessage
+		dec := json.NewDecoder(bytes.NewReader(body[i:]))
+		if err := dec.Decode(&obj); err != nil {
+			return nil, err
+		}
+		if obj == nil {
+			return nil, errRowFormat
+		}
+		objects = append(objects, obj)
+		i += int(dec.InputOffset())
+	}
+}
+
+func encodeJSONEachRow(objects []map[string]json.RawMessage) ([]byte, error) {
+	var buf bytes.Buffer
+	for _, obj := range objects {
+		data, err := json.Marshal(obj)
+		if err != nil {
+			return nil, err
+		}
+		buf.Write(data)
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes(), nil
+}
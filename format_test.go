@@ -0,0 +1,94 @@
+package proxyhouse
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestParseValues(t *testing.T) {
+	rows, err := parseValues([]byte("(1,'a,b', NULL),( 2 , 'it''s\\n', [1,2]) ,(3,'',now())"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Row{
+		{{Value: "1"}, {Value: "a,b", Quoted: true}, {Value: "NULL", Null: true}},
+		{{Value: "2"}, {Value: "it's\n", Quoted: true}, {Value: "[1,2]"}},
+		{{Value: "3"}, {Value: "", Quoted: true}, {Value: "now()"}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("want %v; got %v", want, rows)
+	}
+	for _, bad := range []string{"1,2", "(1,'a)", "(1,2"} {
+		if _, err := parseValues([]byte(bad)); err == nil {
+			t.Errorf("%s: want error", bad)
+		}
+	}
+}
+
+func TestParseTSV(t *testing.T) {
+	rows := parseTSV([]byte("1\ta\\tb\t\\N\n\n2\t\t\\\\\n"))
+	want := []Row{
+		{{Value: "1"}, {Value: "a\tb"}, {Null: true}},
+		{{Value: "2"}, {Value: ""}, {Value: "\\"}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("want %v; got %v", want, rows)
+	}
+}
+
+func TestParseCSV(t *testing.T) {
+	rows, err := parseCSV([]byte("1,\"a,\"\"b\"\"\",\\N\n\n2,c\r\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Row{
+		{{Value: "1"}, {Value: "a,\"b\""}, {Null: true}},
+		{{Value: "2"}, {Value: "c"}},
+	}
+	if !reflect.DeepEqual(rows, want) {
+		t.Errorf("want %v; got %v", want, rows)
+	}
+}
+
+func TestQueryFormat(t *testing.T) {
+	tests := map[string]string{
+		"INSERT INTO t VALUES":              formatValues,
+		"INSERT INTO t FORMAT TSV":          formatTSV,
+		"INSERT INTO t format TabSeparated": formatTSV,
+		"INSERT INTO t FORMAT jsoneachrow":  formatJSONEachRow,
+		"INSERT INTO t (a) FORMAT Values":   formatValues,
+		"INSERT INTO t FORMAT csv":          formatCSV,
+		"INSERT INTO t FORMAT Parquet":      "Parquet",
+	}
+	for in, want := range tests {
+		if got := queryFormat(in); got != want {
+			t.Errorf("queryFormat(%s): want '%s'; got '%s'", in, want, got)
+		}
+	}
+}
+
+func TestParseInsert(t *testing.T) {
+	tests := []struct {
+		query    string
+		database string
+		table    string
+		columns  []string
+	}{
+		{"INSERT INTO t VALUES", "", "t", nil},
+		{"insert into db.t (a, `b c`) format TSV", "db", "t", []string{"a", "b c"}},
+		{"INSERT INTO TABLE `db`.\"t\"(a)", "db", "t", []string{"a"}},
+	}
+	for _, tt := range tests {
+		database, table, columns, err := parseInsert(tt.query)
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.query, err)
+			continue
+		}
+		if database != tt.database || table != tt.table || !reflect.DeepEqual(columns, tt.columns) {
+			t.Errorf("%s: got %s %s %v", tt.query, database, table, columns)
+		}
+	}
+	if _, _, _, err := parseInsert("SELECT 1"); err != errNotInsert {
+		t.Errorf("select: want errNotInsert; got %v", err)
+	}
+}
@@ -0,0 +1,244 @@
+package proxyhouse
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// integration of proxy with fake clickhouse, requests go through http listener
+
+// startTestProxy start proxy in front of clickhouse with errors dir, listener on free port is returned
+func startTestProxy(t *testing.T, ch *fakeClickHouse, errorsDir string, change func(c *Config)) (*Proxy, string) {
+	t.Helper()
+	cfg := DefaultConfig()
+	cfg.Fwd, cfg.Port, cfg.SyncSec = ch.URL, freePort(t), 1
+	if change != nil {
+		change(cfg)
+	}
+	p, err := New(Options{Config: cfg, ErrorsDir: errorsDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { p.Shutdown(context.Background()) })
+	return p, "http://127.0.0.1:" + strconv.Itoa(cfg.Port)
+}
+
+// insertInto post rows into table, response status and body are returned
+func insertInto(t *testing.T, addr, table, rows string, sync bool) (int, string) {
+	t.Helper()
+	uri := addr + "/?query=" + strings.ReplaceAll("INSERT INTO "+table+" VALUES", " ", "%20")
+	if sync {
+		uri += "&sync=1"
+	}
+	resp, err := http.Post(uri, "", strings.NewReader(rows))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// spooled return batch files of errors dir
+func spooled(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, f := range files {
+		if !strings.HasSuffix(f.Name(), ".idx") && f.Name() != lockFile {
+			names = append(names, f.Name())
+		}
+	}
+	return names
+}
+
+func TestIntegrationMerge(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	_, addr := startTestProxy(t, ch, t.TempDir(), func(c *Config) { c.Compress = "gzip" })
+
+	const N = 200
+	var wg sync.WaitGroup
+	for i := 0; i < N; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if code, body := insertInto(t, addr, "t", "("+strconv.Itoa(i)+")", false); code != http.StatusOK {
+				t.Errorf("want 200; got %d %s", code, body)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	inserts := ch.waitRows(t, N, 10*time.Second)
+	if _, requests := ch.received(); requests >= N/10 {
+		t.Errorf("want requests merged into few batches; got %d", requests)
+	}
+	if !hasPrefix(inserts, "INSERT INTO t VALUES") {
+		t.Errorf("want inserts into t; got %v", inserts)
+	}
+	got := values(inserts)
+	sort.Slice(got, func(i, j int) bool {
+		a, _ := strconv.Atoi(got[i])
+		b, _ := strconv.Atoi(got[j])
+		return a < b
+	})
+	for i, v := range got {
+		if v != strconv.Itoa(i) {
+			t.Fatalf("want every row once; got %v", got)
+		}
+	}
+	for _, ins := range inserts {
+		if ins.token == "" {
+			t.Errorf("want insert_deduplication_token in %s", ins.query)
+		}
+	}
+}
+
+func TestIntegrationException(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	dir := t.TempDir()
+	_, addr := startTestProxy(t, ch, dir, nil)
+	ch.failTable("bad", chFailure{status: http.StatusNotFound, code: 60, text: "Table default.bad doesn't exist"})
+
+	code, body := insertInto(t, addr, "bad", "(1)", true)
+	if code != http.StatusAccepted || !strings.Contains(body, "Code: 60. DB::Exception: Table default.bad") {
+		t.Errorf("want batch accepted with clickhouse exception; got %d %s", code, body)
+	}
+	if code, body = insertInto(t, addr, "good", "(1)", true); code != http.StatusOK {
+		t.Errorf("want other table inserted; got %d %s", code, body)
+	}
+	if files := spooled(t, dir); len(files) != 1 || !strings.HasPrefix(files[0], "1") {
+		t.Errorf("want failed batch spooled with level 1; got %v", files)
+	}
+}
+
+func TestIntegrationRecovery(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	dir := t.TempDir()
+	ch.failNext(chFailure{status: http.StatusInternalServerError, code: 252, text: "Too many parts", rows: 1})
+	_, addr := startTestProxy(t, ch, dir, func(c *Config) { c.ResendInt = 1 })
+
+	if code, body := insertInto(t, addr, "t", "(1),(2),(3)", false); code != http.StatusOK {
+		t.Fatalf("want 200; got %d %s", code, body)
+	}
+	// partial insert, then whole batch resent from errors dir with the same token
+	inserts := ch.waitRows(t, 4, 10*time.Second)
+	if len(inserts) != 2 || !inserts[0].partial || inserts[1].partial {
+		t.Fatalf("want partial insert and resent batch; got %+v", inserts)
+	}
+	if inserts[0].token == "" || inserts[0].token != inserts[1].token {
+		t.Errorf("want resent batch with token of failed one; got '%s' '%s'", inserts[0].token, inserts[1].token)
+	}
+	if inserts[1].body != "(1),(2),(3)" {
+		t.Errorf("want whole batch resent; got '%s'", inserts[1].body)
+	}
+	deadline := time.Now().Add(5 * time.Second)
+	for len(spooled(t, dir)) > 0 {
+		if time.Now().After(deadline) {
+			t.Fatalf("want errors dir cleaned after resend; got %v", spooled(t, dir))
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestIntegrationShutdown(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	ch.setLatency(100 * time.Millisecond)
+	ch.failTable("down", chFailure{status: http.StatusServiceUnavailable, code: 242, text: "Table is in readonly mode"})
+	dir := t.TempDir()
+	p, addr := startTestProxy(t, ch, dir, func(c *Config) { c.SyncSec = 60 })
+
+	for _, table := range []string{"t1", "t2", "down"} {
+		for i := 0; i < 3; i++ {
+			if code, body := insertInto(t, addr, table, "("+strconv.Itoa(i)+")", false); code != http.StatusOK {
+				t.Fatalf("want 200; got %d %s", code, body)
+			}
+		}
+	}
+	if n := ch.rowCount(); n != 0 {
+		t.Fatalf("want rows buffered before shutdown; got %d", n)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	inserts, _ := ch.received()
+	if len(inserts) != 2 || ch.rowCount() != 6 {
+		t.Errorf("want t1 and t2 drained on shutdown; got %+v", inserts)
+	}
+	if files := spooled(t, dir); len(files) != 1 {
+		t.Fatalf("want failed batch spooled on shutdown; got %v", files)
+	}
+
+	// restarted proxy resend spooled batch
+	ch.failTable("down", chFailure{})
+	startTestProxy(t, ch, dir, func(c *Config) { c.ResendInt = 1 })
+	inserts = ch.waitRows(t, 9, 10*time.Second)
+	if last := inserts[len(inserts)-1]; !strings.HasPrefix(last.query, "INSERT INTO down VALUES") || last.body != "(0),(1),(2)" {
+		t.Errorf("want spooled batch of down table; got %+v", last)
+	}
+}
+
+// shutdown deadline abort sends in flight and spool buffers unsent
+func TestIntegrationShutdownDeadline(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	ch.setLatency(5 * time.Second)
+	dir := t.TempDir()
+	p, addr := startTestProxy(t, ch, dir, func(c *Config) {
+		c.SyncSec = 60
+		c.Tables = map[string]*TableConfig{"full": {MaxRows: 1, Retries: 3, RetryWait: 10}}
+	})
+	insertInto(t, addr, "buffered", "(1)", false)
+	insertInto(t, addr, "full", "(1)", false)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 300*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	if err := p.Shutdown(ctx); err != context.DeadlineExceeded {
+		t.Errorf("want deadline error; got %v", err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("want shutdown to respect deadline; took %v", d)
+	}
+	if files := spooled(t, dir); len(files) != 2 {
+		t.Errorf("want in flight and buffered batches spooled; got %v", files)
+	}
+}
+
+// fake clickhouse reports exception as clickhouse does
+func TestFakeClickHouse(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	ch.failNext(chFailure{status: http.StatusInternalServerError, code: 252, text: "Too many parts"})
+	resp, err := http.Post(ch.URL+"/?query=INSERT%20INTO%20t%20FORMAT%20TSV", "", strings.NewReader("1\n2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusInternalServerError || resp.Header.Get("X-ClickHouse-Exception-Code") != "252" ||
+		!strings.HasPrefix(string(body), "Code: 252. DB::Exception: Too many parts") {
+		t.Errorf("want exception; got %d %s", resp.StatusCode, body)
+	}
+	resp, err = http.Post(ch.URL+"/?query=INSERT%20INTO%20t%20FORMAT%20TSV", "", strings.NewReader("1\n2\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if inserts, requests := ch.received(); requests != 2 || len(inserts) != 1 || len(inserts[0].rows) != 2 {
+		t.Errorf("want 2 requests and 1 insert of 2 rows; got %d %+v", requests, inserts)
+	}
+}
@@ -0,0 +1,100 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"strings"
+)
+
+// udp and unix socket listeners, both feed the same store as http
+
+const maxDatagram = 64 * 1024
+
+var errDatagram = errors.New("Error: datagram must be query line and body")
+
+// listenUDP accept fire-and-forget inserts, one insert per datagram
+func (p *Proxy) listenUDP(addr string) (*net.UDPConn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		packet := make([]byte, maxDatagram)
+		for {
+			n, _, err := conn.ReadFromUDP(packet)
+			if err != nil {
+				p.log(LEVEL_INFO, "UDP listener stopped: ", err)
+				return
+			}
+			p.handleDatagram(packet[:n])
+		}
+	}()
+	return conn, nil
+}
+
+func (p *Proxy) handleDatagram(packet []byte) {
+	defer p.handlePanic("handleDatagram()")
+	key, query, body, err := parseDatagram(packet)
+	if err != nil {
+		p.metrics.Increment(p.conf().GraphitePrefixCnt+".wrong_requests", 1)
+		p.log(LEVEL_WARN, "UDP request error: ", err)
+		return
+	}
+	p.metrics.Increment(p.conf().GraphitePrefixCnt+".udp_received", 1)
+	if p.spoolFull() {
+		p.metrics.Increment(p.conf().GraphitePrefixCnt+".spool_rejected", 1)
+		return
+	}
+	// body is reused by next datagram
+	p.Append(key, query, append([]byte(nil), body...))
+}
+
+// parseDatagram split datagram on query line and body
+// query line is an uri like /?query=INSERT%20INTO%20t%20VALUES or plain INSERT query
+func parseDatagram(packet []byte) (key, query string, body []byte, err error) {
+	pos := bytes.IndexByte(packet, '\n')
+	if pos <= 0 || pos == len(packet)-1 {
+		return "", "", nil, errDatagram
+	}
+	line, body := strings.TrimSpace(string(packet[:pos])), packet[pos+1:]
+	if strings.HasPrefix(line, "/?") || strings.HasPrefix(line, "?") {
+		key = strings.TrimPrefix(line, "/")
+		params, err := url.ParseQuery(key[1:])
+		if err != nil {
+			return "", "", nil, err
+		}
+		query = params.Get("query")
+	} else {
+		query = line
+		// same escaping as http clients, so buffers will be merged
+		key = "?query=" + strings.ReplaceAll(url.QueryEscape(query), "+", "%20")
+	}
+	if _, _, _, err = parseInsert(query); err != nil {
+		return "", "", nil, err
+	}
+	return key, query, body, nil
+}
+
+// listenUnix create unix domain socket, stale socket file removed
+func listenUnix(path string) (net.Listener, error) {
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	ln, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// sidecars may run under other user
+	if err = os.Chmod(path, 0666); err != nil {
+		ln.Close()
+		return nil, err
+	}
+	return ln, nil
+}
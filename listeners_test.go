@@ -0,0 +1,91 @@
+package proxyhouse
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDatagram(t *testing.T) {
+	tests := []struct {
+		packet string
+		key    string
+		body   string
+	}{
+		{"INSERT INTO t VALUES\n(1),(2)", "?query=INSERT%20INTO%20t%20VALUES", "(1),(2)"},
+		{"/?query=INSERT%20INTO%20t%20FORMAT%20TSV&user=u\n1\n2\n", "?query=INSERT%20INTO%20t%20FORMAT%20TSV&user=u", "1\n2\n"},
+	}
+	for _, tt := range tests {
+		key, _, body, err := parseDatagram([]byte(tt.packet))
+		if err != nil {
+			t.Errorf("%s: unexpected error %s", tt.packet, err)
+			continue
+		}
+		if key != tt.key || string(body) != tt.body {
+			t.Errorf("%s: got '%s' '%s'", tt.packet, key, body)
+		}
+	}
+	for _, bad := range []string{"(1),(2)", "INSERT INTO t VALUES\n", "SELECT 1\n(1)"} {
+		if _, _, _, err := parseDatagram([]byte(bad)); err == nil {
+			t.Errorf("%s: want error", bad)
+		}
+	}
+}
+
+func TestListeners(t *testing.T) {
+	p := newTestProxy(t, nil)
+
+	conn, err := p.listenUDP("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	c, err := net.Dial("udp", conn.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	c.Write([]byte("INSERT INTO t VALUES\n(1)"))
+	c.Write([]byte("INSERT INTO t VALUES\n(2)"))
+	c.Close()
+
+	sock := filepath.Join(t.TempDir(), "proxyhouse.sock")
+	ln, err := listenUnix(sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http.Server{Handler: http.HandlerFunc(p.dorequest)}
+	go server.Serve(ln)
+	defer server.Close()
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(_ context.Context, _, _ string) (net.Conn, error) {
+			return net.Dial("unix", sock)
+		},
+	}}
+	resp, err := client.Post("http://unix/?query=INSERT%20INTO%20t%20VALUES", "", strings.NewReader("(3)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// udp is asynchronous
+	want := "(1),(2),(3)"
+	for i := 0; i < 100; i++ {
+		buf := p.store.peek("?query=INSERT%20INTO%20t%20VALUES")
+		got := ""
+		if buf != nil {
+			got = string(buf.buffer)
+		}
+		if len(got) == len(want) {
+			if !strings.Contains(got, "(3)") || buf.rowcount != 3 {
+				t.Errorf("want 3 rows %s; got %d rows %s", want, buf.rowcount, got)
+			}
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Errorf("store: want %s", want)
+}
@@ -0,0 +1,31 @@
+//go:build !windows
+
+package proxyhouse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"syscall"
+)
+
+// lockDir take exclusive lock of dir, so two proxies don't share one errors dir,
+// lock is released by returned func or on exit
+func lockDir(dir string) (func() error, error) {
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0640)
+	if err != nil {
+		return nil, err
+	}
+	if err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB); err != nil {
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("errors dir %s is used by other proxyhouse", dir)
+		}
+		return nil, err
+	}
+	f.Truncate(0)
+	f.WriteString(strconv.Itoa(os.Getpid()))
+	return f.Close, nil
+}
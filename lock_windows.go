@@ -0,0 +1,26 @@
+package proxyhouse
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+)
+
+// lockDir create lock file of dir, so two proxies don't share one errors dir,
+// lock file is removed by returned func, it is left after crash and must be removed by hand
+func lockDir(dir string) (func() error, error) {
+	path := filepath.Join(dir, lockFile)
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_EXCL|os.O_RDWR, 0640)
+	if err != nil {
+		if os.IsExist(err) {
+			return nil, fmt.Errorf("errors dir %s is used by other proxyhouse, or remove %s", dir, path)
+		}
+		return nil, err
+	}
+	f.WriteString(strconv.Itoa(os.Getpid()))
+	return func() error {
+		f.Close()
+		return os.Remove(path)
+	}, nil
+}
@@ -1,10 +1,11 @@
-package main
+package proxyhouse
 
 import (
 	"fmt"
 	"strconv"
 	"sync"
-	"time"
+
+	"github.com/marpaia/graphite-golang"
 )
 
 type MetricStorage struct {
@@ -18,35 +19,32 @@ func NewMetricStorage() *MetricStorage {
 	}
 }
 
-func (ms *MetricStorage) SendMetrics() {
-	go func() {
-		for {
-			ms.mx.Lock()
-			if len(ms.storage) != 0 {
-				var bytesSent, sendDuration int
-				if v, ok := metricStorage.storage["bytesSent"]; ok {
-					bytesSent = v
-					delete(metricStorage.storage, "bytesSent")
-				}
-				if v, ok := metricStorage.storage["sendDuration"]; ok {
-					sendDuration = v
-					delete(metricStorage.storage, "sendDuration")
-				}
-
-				if bytesSent != 0 && sendDuration != 0 {
-					gr.SimpleSend(fmt.Sprintf("%s.bytes_to_milliseconds", *graphiteprefixavg), strconv.Itoa(bytesSent/sendDuration))
-				}
-
-				for metric, value := range metricStorage.storage {
-					gr.SimpleSend(metric, strconv.Itoa(value))
-				}
-				// clear map
-				metricStorage.storage = make(map[string]int)
-			}
-			ms.mx.Unlock()
-			time.Sleep(2 * time.Second)
-		}
-	}()
+// SendMetrics send counters to graphite and clear them, avg is a prefix of bytes_to_milliseconds
+func (ms *MetricStorage) SendMetrics(gr *graphite.Graphite, avg string) {
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	if len(ms.storage) == 0 {
+		return
+	}
+	var bytesSent, sendDuration int
+	if v, ok := ms.storage["bytesSent"]; ok {
+		bytesSent = v
+		delete(ms.storage, "bytesSent")
+	}
+	if v, ok := ms.storage["sendDuration"]; ok {
+		sendDuration = v
+		delete(ms.storage, "sendDuration")
+	}
+
+	if bytesSent != 0 && sendDuration != 0 {
+		gr.SimpleSend(fmt.Sprintf("%s.bytes_to_milliseconds", avg), strconv.Itoa(bytesSent/sendDuration))
+	}
+
+	for metric, value := range ms.storage {
+		gr.SimpleSend(metric, strconv.Itoa(value))
+	}
+	// clear map
+	ms.storage = make(map[string]int)
 }
 
 func (ms *MetricStorage) Increment(name string, value int) {
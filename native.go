@@ -0,0 +1,901 @@
+package proxyhouse
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// clickhouse native protocol, just enough for inserts
+// https://clickhouse.com/docs/en/native-protocol/basics
+
+const (
+	nativeRevision = 54429 // settings serialized as strings
+	nativeTimeout  = 60 * time.Second
+	nativePoolSize = 16
+
+	revisionServerTimezone     = 54058
+	revisionQuotaKey           = 54060
+	revisionServerDisplayName  = 54372
+	revisionVersionPatch       = 54401
+	revisionClientWriteInfo    = 54420
+	revisionSettingsAsStrings  = 54429
+	revisionTotalRowsInProgess = 51554
+
+	clientHello = 0
+	clientQuery = 1
+	clientData  = 2
+	clientPing  = 4
+
+	serverHello        = 0
+	serverData         = 1
+	serverException    = 2
+	serverProgress     = 3
+	serverPong         = 4
+	serverEndOfStream  = 5
+	serverProfileInfo  = 6
+	serverTotals       = 7
+	serverExtremes     = 8
+	serverLog          = 10
+	serverTableColumns = 11
+
+	stageComplete = 2
+)
+
+// nativePool keep idle connections by address, database and user
+type nativePool struct {
+	sync.Mutex
+	conns map[string][]*nativeConn
+}
+
+var (
+	errNativeUnexpected = errors.New("Error: unexpected native packet")
+	errNativeTooLarge   = errors.New("Error: native block is too large")
+)
+
+// nativeFormatError mean batch can't be converted to native block
+type nativeFormatError struct {
+	err error
+}
+
+func (e nativeFormatError) Error() string {
+	return "native format: " + e.err.Error()
+}
+
+// nativeException is an exception sent by clickhouse server
+type nativeException struct {
+	Code    int32
+	Name    string
+	Message string
+}
+
+func (e *nativeException) Error() string {
+	return fmt.Sprintf("code: %d, %s: %s", e.Code, e.Name, e.Message)
+}
+
+// Column describe column of native block
+type Column struct {
+	Name string
+	Type string
+}
+
+// Block is a native block, stored by rows for convenience
+type Block struct {
+	Columns []Column
+	Rows    []Row
+}
+
+type nativeWriter struct {
+	w interface {
+		io.Writer
+		io.ByteWriter
+		io.StringWriter
+	}
+	buf [binary.MaxVarintLen64]byte
+}
+
+func (w *nativeWriter) uvarint(v uint64) {
+	n := binary.PutUvarint(w.buf[:], v)
+	w.w.Write(w.buf[:n])
+}
+
+func (w *nativeWriter) str(s string) {
+	w.uvarint(uint64(len(s)))
+	w.w.WriteString(s)
+}
+
+func (w *nativeWriter) byte(b byte) {
+	w.w.WriteByte(b)
+}
+
+// fixed write size bytes of v in little endian
+func (w *nativeWriter) fixed(v uint64, size int) {
+	binary.LittleEndian.PutUint64(w.buf[:], v)
+	w.w.Write(w.buf[:size])
+}
+
+type nativeReader struct {
+	r     *bufio.Reader
+	limit int // max bytes of string and cells of block, 0 is no limit
+}
+
+func (r *nativeReader) uvarint() (uint64, error) {
+	return binary.ReadUvarint(r.r)
+}
+
+func (r *nativeReader) str() (string, error) {
+	n, err := r.uvarint()
+	if err != nil {
+		return "", err
+	}
+	if n > math.MaxInt32 {
+		return "", errNativeUnexpected
+	}
+	if r.limit > 0 && n > uint64(r.limit) {
+		return "", errNativeTooLarge
+	}
+	if n <= 4096 {
+		b := make([]byte, n)
+		_, err = io.ReadFull(r.r, b)
+		return string(b), err
+	}
+	// length is sent by peer, so buffer grow with data
+	var sb strings.Builder
+	_, err = io.CopyN(&sb, r.r, int64(n))
+	return sb.String(), err
+}
+
+func (r *nativeReader) byte() (byte, error) {
+	return r.r.ReadByte()
+}
+
+func (r *nativeReader) fixed(size int) (uint64, error) {
+	var buf [8]byte
+	if _, err := io.ReadFull(r.r, buf[:size]); err != nil {
+		return 0, err
+	}
+	return binary.LittleEndian.Uint64(buf[:]), nil
+}
+
+// chType is a parsed clickhouse column type
+type chType struct {
+	base     string
+	nullable bool
+	size     int // bytes for fixed width types
+	loc      *time.Location
+}
+
+// parseType parse supported column types, loc is a server timezone for DateTime
+func parseType(t string, loc *time.Location) (*chType, error) {
+	ct := &chType{base: t, loc: loc}
+	if strings.HasPrefix(t, "Nullable(") && strings.HasSuffix(t, ")") {
+		ct.nullable = true
+		ct.base = t[len("Nullable(") : len(t)-1]
+	}
+	switch ct.base {
+	case "UInt8", "Int8", "Bool":
+		ct.size = 1
+	case "UInt16", "Int16", "Date":
+		ct.size = 2
+	case "UInt32", "Int32", "Float32", "DateTime":
+		ct.size = 4
+	case "UInt64", "Int64", "Float64":
+		ct.size = 8
+	case "String":
+	default:
+		switch {
+		case strings.HasPrefix(ct.base, "FixedString(") && strings.HasSuffix(ct.base, ")"):
+			n, err := strconv.Atoi(ct.base[len("FixedString(") : len(ct.base)-1])
+			if err != nil || n <= 0 {
+				return nil, fmt.Errorf("Error: wrong type %s", t)
+			}
+			ct.base, ct.size = "FixedString", n
+		case strings.HasPrefix(ct.base, "DateTime(") && strings.HasSuffix(ct.base, ")"):
+			tz := strings.Trim(ct.base[len("DateTime("):len(ct.base)-1], "' ")
+			l, err := time.LoadLocation(tz)
+			if err != nil {
+				return nil, err
+			}
+			ct.base, ct.size, ct.loc = "DateTime", 4, l
+		default:
+			return nil, fmt.Errorf("Error: unsupported type %s", t)
+		}
+	}
+	return ct, nil
+}
+
+// encode write text value in native binary form, NULL written as default value
+func (ct *chType) encode(w *nativeWriter, f Field) error {
+	val := f.Value
+	if f.Null {
+		val = ""
+	}
+	switch ct.base {
+	case "String":
+		w.str(val)
+		return nil
+	case "FixedString":
+		if len(val) > ct.size {
+			return fmt.Errorf("Error: too long value for FixedString(%d)", ct.size)
+		}
+		w.w.WriteString(val)
+		for i := len(val); i < ct.size; i++ {
+			w.byte(0)
+		}
+		return nil
+	}
+	if val == "" {
+		w.fixed(0, ct.size)
+		return nil
+	}
+	var v uint64
+	switch ct.base {
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		u, err := strconv.ParseUint(val, 10, ct.size*8)
+		if err != nil {
+			return err
+		}
+		v = u
+	case "Int8", "Int16", "Int32", "Int64":
+		i, err := strconv.ParseInt(val, 10, ct.size*8)
+		if err != nil {
+			return err
+		}
+		v = uint64(i)
+	case "Bool":
+		b, err := parseBool(val)
+		if err != nil {
+			return err
+		}
+		if b {
+			v = 1
+		}
+	case "Float32":
+		fl, err := strconv.ParseFloat(val, 32)
+		if err != nil {
+			return err
+		}
+		v = uint64(math.Float32bits(float32(fl)))
+	case "Float64":
+		fl, err := strconv.ParseFloat(val, 64)
+		if err != nil {
+			return err
+		}
+		v = math.Float64bits(fl)
+	case "Date":
+		d, err := parseTime(val, time.UTC, "2006-01-02")
+		if err != nil {
+			return err
+		}
+		v = uint64(d / (24 * 3600))
+	case "DateTime":
+		// clickhouse accept ISO separator and date only
+		t, err := parseTime(val, ct.loc, "2006-01-02 15:04:05", "2006-01-02T15:04:05", "2006-01-02")
+		if err != nil {
+			return err
+		}
+		v = uint64(t)
+	}
+	w.fixed(v, ct.size)
+	return nil
+}
+
+// parseTime parse time in one of layouts or unix timestamp (days for Date, first layout is date only)
+func parseTime(val string, loc *time.Location, layouts ...string) (int64, error) {
+	if i, err := strconv.ParseInt(val, 10, 64); err == nil {
+		if len(layouts[0]) == len("2006-01-02") {
+			return i * 24 * 3600, nil
+		}
+		return i, nil
+	}
+	var err error
+	for _, layout := range layouts {
+		var t time.Time
+		if t, err = time.ParseInLocation(layout, val, loc); err == nil {
+			return t.Unix(), nil
+		}
+	}
+	return 0, err
+}
+
+// parseBool parse bool as clickhouse text formats do
+func parseBool(val string) (bool, error) {
+	switch strings.ToLower(val) {
+	case "1", "true", "t", "yes", "y", "on", "enable":
+		return true, nil
+	case "0", "false", "f", "no", "n", "off", "disable":
+		return false, nil
+	}
+	return false, fmt.Errorf("Error: cannot parse bool %q", val)
+}
+
+// decode read native binary value as text
+func (ct *chType) decode(r *nativeReader) (Field, error) {
+	switch ct.base {
+	case "String":
+		s, err := r.str()
+		return Field{Value: s, Quoted: true}, err
+	case "FixedString":
+		b := make([]byte, ct.size)
+		_, err := io.ReadFull(r.r, b)
+		return Field{Value: string(b), Quoted: true}, err
+	}
+	v, err := r.fixed(ct.size)
+	if err != nil {
+		return Field{}, err
+	}
+	var s string
+	switch ct.base {
+	case "UInt8", "UInt16", "UInt32", "UInt64":
+		s = strconv.FormatUint(v, 10)
+	case "Int8":
+		s = strconv.FormatInt(int64(int8(v)), 10)
+	case "Int16":
+		s = strconv.FormatInt(int64(int16(v)), 10)
+	case "Int32":
+		s = strconv.FormatInt(int64(int32(v)), 10)
+	case "Int64":
+		s = strconv.FormatInt(int64(v), 10)
+	case "Bool":
+		s = strconv.FormatBool(v != 0)
+	case "Float32":
+		s = strconv.FormatFloat(float64(math.Float32frombits(uint32(v))), 'g', -1, 32)
+	case "Float64":
+		s = strconv.FormatFloat(math.Float64frombits(v), 'g', -1, 64)
+	case "Date":
+		return Field{Value: time.Unix(int64(v)*24*3600, 0).UTC().Format("2006-01-02"), Quoted: true}, nil
+	case "DateTime":
+		// unix timestamp is not affected by server timezone on forward
+		s = strconv.FormatUint(v, 10)
+	}
+	return Field{Value: s}, nil
+}
+
+// writeBlock write block with block info, columns encoded one by one
+func (w *nativeWriter) block(b *Block, loc *time.Location) error {
+	// block info: is_overflows = false, bucket_num = -1
+	w.uvarint(1)
+	w.byte(0)
+	w.uvarint(2)
+	w.fixed(math.MaxUint32, 4)
+	w.uvarint(0)
+
+	w.uvarint(uint64(len(b.Columns)))
+	w.uvarint(uint64(len(b.Rows)))
+	for i, col := range b.Columns {
+		w.str(col.Name)
+		w.str(col.Type)
+		if len(b.Rows) == 0 {
+			continue
+		}
+		ct, err := parseType(col.Type, loc)
+		if err != nil {
+			return err
+		}
+		if ct.nullable {
+			for _, row := range b.Rows {
+				if row[i].Null {
+					w.byte(1)
+				} else {
+					w.byte(0)
+				}
+			}
+		}
+		for _, row := range b.Rows {
+			if err := ct.encode(w, row[i]); err != nil {
+				return fmt.Errorf("column %s: %s", col.Name, err)
+			}
+		}
+	}
+	return nil
+}
+
+// block read block with block info, zero rows block has no column data
+// counts are sent by peer, so columns grow with data and cells are limited by limit
+func (r *nativeReader) block(loc *time.Location) (*Block, error) {
+	for {
+		field, err := r.uvarint()
+		if err != nil {
+			return nil, err
+		}
+		if field == 0 {
+			break
+		}
+		switch field {
+		case 1:
+			_, err = r.byte()
+		case 2:
+			_, err = r.fixed(4)
+		default:
+			err = errNativeUnexpected
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	ncols, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	nrows, err := r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	if ncols > math.MaxUint16 || nrows > math.MaxInt32 {
+		return nil, errNativeUnexpected
+	}
+	// every cell take a byte at least
+	if r.limit > 0 && ncols*nrows > uint64(r.limit) {
+		return nil, errNativeTooLarge
+	}
+	b := &Block{}
+	var columns [][]Field
+	for i := uint64(0); i < ncols; i++ {
+		var col Column
+		if col.Name, err = r.str(); err != nil {
+			return nil, err
+		}
+		if col.Type, err = r.str(); err != nil {
+			return nil, err
+		}
+		b.Columns = append(b.Columns, col)
+		if nrows == 0 {
+			continue
+		}
+		ct, err := parseType(col.Type, loc)
+		if err != nil {
+			return nil, nativeFormatError{err}
+		}
+		var nulls []bool
+		if ct.nullable {
+			for j := uint64(0); j < nrows; j++ {
+				null, err := r.byte()
+				if err != nil {
+					return nil, err
+				}
+				nulls = append(nulls, null == 1)
+			}
+		}
+		var values []Field
+		for j := uint64(0); j < nrows; j++ {
+			f, err := ct.decode(r)
+			if err != nil {
+				return nil, err
+			}
+			if nulls != nil && nulls[j] {
+				f = Field{Null: true}
+			}
+			values = append(values, f)
+		}
+		columns = append(columns, values)
+	}
+	if ncols > 0 && nrows > 0 {
+		b.Rows = make([]Row, nrows)
+		for j := range b.Rows {
+			b.Rows[j] = make(Row, ncols)
+			for i := range columns {
+				b.Rows[j][i] = columns[i][j]
+			}
+		}
+	}
+	return b, nil
+}
+
+// exception read exception packet with nested exceptions
+func (r *nativeReader) exception() error {
+	var top *nativeException
+	for {
+		e := &nativeException{}
+		code, err := r.fixed(4)
+		if err != nil {
+			return err
+		}
+		e.Code = int32(code)
+		if e.Name, err = r.str(); err != nil {
+			return err
+		}
+		if e.Message, err = r.str(); err != nil {
+			return err
+		}
+		if _, err = r.str(); err != nil { // stack trace
+			return err
+		}
+		if top == nil {
+			top = e
+		}
+		nested, err := r.byte()
+		if err != nil {
+			return err
+		}
+		if nested == 0 {
+			return top
+		}
+	}
+}
+
+// versionParts return major, minor and patch of proxyhouse version
+func versionParts() (parts [3]uint64) {
+	for i, s := range strings.SplitN(version, ".", 3) {
+		parts[i], _ = strconv.ParseUint(s, 10, 64)
+	}
+	return parts
+}
+
+// nativeConn is a client connection to clickhouse native port
+type nativeConn struct {
+	conn     net.Conn
+	bw       *bufio.Writer
+	w        *nativeWriter
+	r        *nativeReader
+	revision uint64
+	loc      *time.Location
+	key      string
+}
+
+// dialNative connect to clickhouse and make handshake
+func dialNative(addr, database, user, password string) (*nativeConn, error) {
+	conn, err := net.DialTimeout("tcp", addr, nativeTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &nativeConn{
+		conn: conn,
+		bw:   bufio.NewWriter(conn),
+		r:    &nativeReader{r: bufio.NewReader(conn)},
+		loc:  time.UTC,
+	}
+	c.w = &nativeWriter{w: c.bw}
+	if err = c.hello(database, user, password); err != nil {
+		conn.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *nativeConn) hello(database, user, password string) error {
+	c.conn.SetDeadline(time.Now().Add(nativeTimeout))
+	v := versionParts()
+	c.w.uvarint(clientHello)
+	c.w.str("proxyhouse")
+	c.w.uvarint(v[0])
+	c.w.uvarint(v[1])
+	c.w.uvarint(nativeRevision)
+	c.w.str(database)
+	c.w.str(user)
+	c.w.str(password)
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	packet, err := c.r.uvarint()
+	if err != nil {
+		return err
+	}
+	switch packet {
+	case serverException:
+		return c.r.exception()
+	case serverHello:
+	default:
+		return errNativeUnexpected
+	}
+	if _, err = c.r.str(); err != nil { // server name
+		return err
+	}
+	if _, err = c.r.uvarint(); err != nil { // major
+		return err
+	}
+	if _, err = c.r.uvarint(); err != nil { // minor
+		return err
+	}
+	if c.revision, err = c.r.uvarint(); err != nil {
+		return err
+	}
+	if c.revision > nativeRevision {
+		c.revision = nativeRevision
+	}
+	if c.revision >= revisionServerTimezone {
+		tz, err := c.r.str()
+		if err != nil {
+			return err
+		}
+		if loc, err := time.LoadLocation(tz); err == nil {
+			c.loc = loc
+		}
+	}
+	if c.revision >= revisionServerDisplayName {
+		if _, err = c.r.str(); err != nil {
+			return err
+		}
+	}
+	if c.revision >= revisionVersionPatch {
+		if _, err = c.r.uvarint(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// query send insert query with settings and empty block of external tables
+func (c *nativeConn) query(query string, settings map[string]string) {
+	v := versionParts()
+	c.w.uvarint(clientQuery)
+	c.w.str("") // query id
+	// client info
+	c.w.byte(1) // initial query
+	c.w.str("")
+	c.w.str("")
+	c.w.str("[::ffff:127.0.0.1]:0")
+	c.w.byte(1) // tcp interface
+	c.w.str(os.Getenv("USER"))
+	c.w.str(hostname)
+	c.w.str("proxyhouse")
+	c.w.uvarint(v[0])
+	c.w.uvarint(v[1])
+	c.w.uvarint(nativeRevision)
+	if c.revision >= revisionQuotaKey {
+		c.w.str("")
+	}
+	if c.revision >= revisionVersionPatch {
+		c.w.uvarint(v[2])
+	}
+	// old servers need typed settings, skip them
+	if c.revision >= revisionSettingsAsStrings {
+		for name, value := range settings {
+			c.w.str(name)
+			c.w.uvarint(0) // flags
+			c.w.str(value)
+		}
+	}
+	c.w.str("")
+	c.w.uvarint(stageComplete)
+	c.w.uvarint(0) // no compression
+	c.w.str(query)
+	c.data(&Block{})
+}
+
+func (c *nativeConn) data(b *Block) error {
+	c.w.uvarint(clientData)
+	c.w.str("")
+	return c.w.block(b, c.loc)
+}
+
+// packet read next server packet, skip progress, logs and profile info
+// return packet type and data block if any
+func (c *nativeConn) packet() (uint64, *Block, error) {
+	for {
+		packet, err := c.r.uvarint()
+		if err != nil {
+			return 0, nil, err
+		}
+		switch packet {
+		case serverData, serverTotals, serverExtremes, serverLog:
+			if _, err = c.r.str(); err != nil {
+				return 0, nil, err
+			}
+			b, err := c.r.block(c.loc)
+			if err != nil {
+				return 0, nil, err
+			}
+			if packet == serverData {
+				return packet, b, nil
+			}
+		case serverException:
+			return packet, nil, c.r.exception()
+		case serverProgress:
+			n := 2
+			if c.revision >= revisionTotalRowsInProgess {
+				n++
+			}
+			if c.revision >= revisionClientWriteInfo {
+				n += 2
+			}
+			for i := 0; i < n; i++ {
+				if _, err = c.r.uvarint(); err != nil {
+					return 0, nil, err
+				}
+			}
+		case serverProfileInfo:
+			for _, kind := range "vvvbvb" {
+				if kind == 'v' {
+					_, err = c.r.uvarint()
+				} else {
+					_, err = c.r.byte()
+				}
+				if err != nil {
+					return 0, nil, err
+				}
+			}
+		case serverTableColumns:
+			for i := 0; i < 2; i++ {
+				if _, err = c.r.str(); err != nil {
+					return 0, nil, err
+				}
+			}
+		case serverEndOfStream, serverPong:
+			return packet, nil, nil
+		default:
+			return packet, nil, errNativeUnexpected
+		}
+	}
+}
+
+// ping check pooled connection is alive
+func (c *nativeConn) ping() error {
+	c.conn.SetDeadline(time.Now().Add(nativeTimeout))
+	c.w.uvarint(clientPing)
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	packet, _, err := c.packet()
+	if err == nil && packet != serverPong {
+		err = errNativeUnexpected
+	}
+	return err
+}
+
+// insert rows, server answer with table structure to insert query
+func (c *nativeConn) insert(query string, settings map[string]string, format string, body []byte) error {
+	c.conn.SetDeadline(time.Now().Add(nativeTimeout))
+	c.query(query, settings)
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	packet, header, err := c.packet()
+	if err != nil {
+		return err
+	}
+	if packet != serverData {
+		return errNativeUnexpected
+	}
+	rows, err := parseRows(format, body)
+	if err == nil {
+		for _, row := range rows {
+			if len(row) != len(header.Columns) {
+				err = fmt.Errorf("Error: want %d columns; got %d", len(header.Columns), len(row))
+				break
+			}
+		}
+	}
+	if err != nil {
+		// connection is in the middle of insert, so it can't be reused
+		return nativeFormatError{err}
+	}
+	// encode block first, so a bad value will not break the stream
+	var buf strings.Builder
+	bw := &nativeWriter{w: &buf}
+	if err := bw.block(&Block{Columns: header.Columns, Rows: rows}, c.loc); err != nil {
+		return nativeFormatError{err}
+	}
+	c.w.uvarint(clientData)
+	c.w.str("")
+	c.bw.WriteString(buf.String())
+	c.data(&Block{})
+	if err := c.bw.Flush(); err != nil {
+		return err
+	}
+	for {
+		packet, _, err := c.packet()
+		if err != nil {
+			return err
+		}
+		if packet == serverEndOfStream {
+			return nil
+		}
+	}
+}
+
+// nativeQuery cut format from insert query, data will be sent in native blocks
+func nativeQuery(query string) string {
+	upper := strings.ToUpper(query)
+	if pos := strings.LastIndex(upper, " FORMAT "); pos >= 0 {
+		query = query[:pos]
+	} else if pos := strings.LastIndex(upper, " VALUES"); pos >= 0 {
+		query = query[:pos]
+	}
+	return strings.TrimSpace(query) + " VALUES"
+}
+
+// sendNative forward batch over native protocol with injected faults
+// nativeFormatError returned if batch can't be sent natively
+func (p *Proxy) sendNative(key string, val []byte) error {
+	params := url.Values{}
+	if pos := strings.Index(key, "?"); pos >= 0 {
+		var err error
+		if params, err = url.ParseQuery(key[pos+1:]); err != nil {
+			return nativeFormatError{err}
+		}
+	}
+	query := params.Get("query")
+	format := queryFormat(query)
+	if format != formatValues && format != formatTSV {
+		return nativeFormatError{errors.New("Error: unsupported format " + format)}
+	}
+	database, user, password := params.Get("database"), params.Get("user"), params.Get("password")
+	if database == "" {
+		database = "default"
+	}
+	if user == "" {
+		user = "default"
+	}
+	settings := make(map[string]string)
+	for name := range params {
+		switch name {
+		case "query", "database", "user", "password", "query_id", "session_id",
+			"decompress", "compress", "enable_http_compression":
+			continue
+		}
+		settings[name] = params.Get(name)
+	}
+
+	return p.doNative(func() error {
+		c, err := p.natives.get(p.conf().Native, database, user, password)
+		if err != nil {
+			return err
+		}
+		err = c.insert(nativeQuery(query), settings, format, val)
+		if err != nil {
+			// connection state is unknown after error
+			c.conn.Close()
+			return err
+		}
+		p.natives.put(c)
+		return nil
+	})
+}
+
+func (pool *nativePool) get(addr, database, user, password string) (*nativeConn, error) {
+	key := strings.Join([]string{addr, database, user, password}, "\x00")
+	for {
+		pool.Lock()
+		conns := pool.conns[key]
+		if len(conns) == 0 {
+			pool.Unlock()
+			break
+		}
+		c := conns[len(conns)-1]
+		pool.conns[key] = conns[:len(conns)-1]
+		pool.Unlock()
+		if err := c.ping(); err == nil {
+			return c, nil
+		}
+		// server closed idle connection
+		c.conn.Close()
+	}
+	c, err := dialNative(addr, database, user, password)
+	if err != nil {
+		return nil, err
+	}
+	c.key = key
+	return c, nil
+}
+
+func (pool *nativePool) put(c *nativeConn) {
+	pool.Lock()
+	defer pool.Unlock()
+	if len(pool.conns[c.key]) >= nativePoolSize {
+		c.conn.Close()
+		return
+	}
+	pool.conns[c.key] = append(pool.conns[c.key], c)
+}
+
+// close idle connections
+func (pool *nativePool) close() {
+	pool.Lock()
+	defer pool.Unlock()
+	for key, conns := range pool.conns {
+		for _, c := range conns {
+			c.conn.Close()
+		}
+		delete(pool.conns, key)
+	}
+}
@@ -0,0 +1,296 @@
+package proxyhouse
+
+import (
+	"bufio"
+	"bytes"
+	"math"
+	"net"
+	"runtime"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeNative is a clickhouse stand-in, it accept inserts into one table
+type fakeNative struct {
+	ln       net.Listener
+	columns  []Column
+	mu       sync.Mutex
+	queries  []string
+	settings map[string]string
+	rows     []Row
+	conns    int
+}
+
+func newFakeNative(t *testing.T, columns []Column) *fakeNative {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := &fakeNative{ln: ln, columns: columns, settings: map[string]string{}}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			f.mu.Lock()
+			f.conns++
+			f.mu.Unlock()
+			go f.serve(conn)
+		}
+	}()
+	return f
+}
+
+func (f *fakeNative) serve(conn net.Conn) {
+	defer conn.Close()
+	r := &nativeReader{r: bufio.NewReader(conn)}
+	bw := bufio.NewWriter(conn)
+	w := &nativeWriter{w: bw}
+	// client hello
+	if p, err := r.uvarint(); err != nil || p != clientHello {
+		return
+	}
+	for _, kind := range "svvvsss" {
+		var err error
+		if kind == 's' {
+			_, err = r.str()
+		} else {
+			_, err = r.uvarint()
+		}
+		if err != nil {
+			return
+		}
+	}
+	w.uvarint(serverHello)
+	w.str("ClickHouse")
+	w.uvarint(21)
+	w.uvarint(8)
+	w.uvarint(nativeRevision)
+	w.str("UTC")
+	w.str("fake")
+	w.uvarint(0)
+	bw.Flush()
+	for {
+		packet, err := r.uvarint()
+		if err != nil {
+			return
+		}
+		switch packet {
+		case clientPing:
+			w.uvarint(serverPong)
+			bw.Flush()
+		case clientQuery:
+			// query id and client info
+			for _, kind := range "sbsssbsssvvvsv" {
+				switch kind {
+				case 's':
+					_, err = r.str()
+				case 'v':
+					_, err = r.uvarint()
+				case 'b':
+					_, err = r.byte()
+				}
+				if err != nil {
+					return
+				}
+			}
+			for {
+				name, _ := r.str()
+				if name == "" {
+					break
+				}
+				r.uvarint()
+				value, _ := r.str()
+				f.mu.Lock()
+				f.settings[name] = value
+				f.mu.Unlock()
+			}
+			r.uvarint()
+			r.uvarint()
+			query, _ := r.str()
+			f.mu.Lock()
+			f.queries = append(f.queries, query)
+			f.mu.Unlock()
+			// external tables
+			r.uvarint()
+			r.str()
+			if _, err := r.block(time.UTC); err != nil {
+				return
+			}
+			w.uvarint(serverData)
+			w.str("")
+			w.block(&Block{Columns: f.columns}, time.UTC)
+			bw.Flush()
+			for {
+				if p, err := r.uvarint(); err != nil || p != clientData {
+					return
+				}
+				r.str()
+				b, err := r.block(time.UTC)
+				if err != nil {
+					return
+				}
+				if len(b.Columns) == 0 {
+					break
+				}
+				f.mu.Lock()
+				f.rows = append(f.rows, b.Rows...)
+				f.mu.Unlock()
+			}
+			w.uvarint(serverProgress)
+			for i := 0; i < 5; i++ {
+				w.uvarint(1)
+			}
+			w.uvarint(serverEndOfStream)
+			bw.Flush()
+		default:
+			return
+		}
+	}
+}
+
+func TestSendNative(t *testing.T) {
+	f := newFakeNative(t, []Column{
+		{Name: "id", Type: "UInt64"},
+		{Name: "name", Type: "String"},
+		{Name: "ts", Type: "DateTime"},
+		{Name: "v", Type: "Nullable(Float64)"},
+	})
+	defer f.ln.Close()
+	p := newTestProxy(t, func(c *Config) { c.Native = f.ln.Addr().String() })
+
+	key := "/?query=INSERT%20INTO%20t%20VALUES&insert_deduplicate=1&user=u"
+	err := p.sendNative(key, []byte("(1,'a','2020-01-02 03:04:05',NULL),(2,'b\\'c',1577934245,1.5)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	key = "/?query=INSERT%20INTO%20t%20FORMAT%20TSV&insert_deduplicate=1&user=u"
+	err = p.sendNative(key, []byte("3\td\\te\t2020-01-02 03:04:05\t\\N\n"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.conns != 1 {
+		t.Errorf("connections: want 1; got %d", f.conns)
+	}
+	if len(f.queries) != 2 || f.queries[0] != "INSERT INTO t VALUES" {
+		t.Errorf("queries: got %v", f.queries)
+	}
+	if f.settings["insert_deduplicate"] != "1" || f.settings["user"] != "" {
+		t.Errorf("settings: got %v", f.settings)
+	}
+	want := []string{
+		"1 a 1577934245 NULL",
+		"2 b'c 1577934245 1.5",
+		"3 d\te 1577934245 NULL",
+	}
+	if len(f.rows) != len(want) {
+		t.Fatalf("rows: want %d; got %d", len(want), len(f.rows))
+	}
+	for i, row := range f.rows {
+		got := ""
+		for j, field := range row {
+			if j > 0 {
+				got += " "
+			}
+			if field.Null {
+				got += "NULL"
+			} else {
+				got += field.Value
+			}
+		}
+		if got != want[i] {
+			t.Errorf("row %d: want '%s'; got '%s'", i, want[i], got)
+		}
+	}
+}
+
+// injected faults hit native sends as http ones
+func TestSendNativeFaults(t *testing.T) {
+	f := newFakeNative(t, []Column{{Name: "id", Type: "UInt64"}})
+	defer f.ln.Close()
+	p := newTestProxy(t, func(c *Config) { c.Native = f.ln.Addr().String(); c.Faults = "send=100" })
+
+	key := "/?query=INSERT%20INTO%20t%20VALUES"
+	if err := p.sendNative(key, []byte("(1)")); err != errFaultSend {
+		t.Errorf("want send fault; got %v", err)
+	}
+	p.setFaults(&faults{drop: 100})
+	if err := p.sendNative(key, []byte("(2)")); err != errFaultDrop {
+		t.Errorf("want drop fault; got %v", err)
+	}
+	if counter(p, ".faults.send") != 1 || counter(p, ".faults.drop") != 1 {
+		t.Errorf("want faults counted; got send %d drop %d", counter(p, ".faults.send"), counter(p, ".faults.drop"))
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.rows) != 1 || f.rows[0][0].Value != "2" {
+		t.Errorf("want dropped batch inserted only; got %v", f.rows)
+	}
+}
+
+func TestSendNativeFormatError(t *testing.T) {
+	f := newFakeNative(t, []Column{{Name: "id", Type: "UInt64"}})
+	defer f.ln.Close()
+	p := newTestProxy(t, func(c *Config) { c.Native = f.ln.Addr().String() })
+
+	tests := map[string]string{
+		"/?query=INSERT%20INTO%20t%20VALUES":               "(1,2)",
+		"/?query=INSERT%20INTO%20t%20VALUES&database=db":   "('a')",
+		"/?query=INSERT%20INTO%20t%20FORMAT%20JSONEachRow": `{"id":1}`,
+	}
+	for key, body := range tests {
+		err := p.sendNative(key, []byte(body))
+		if _, ok := err.(nativeFormatError); !ok {
+			t.Errorf("%s: want nativeFormatError; got %v", body, err)
+		}
+	}
+}
+
+func TestNativeQuery(t *testing.T) {
+	tests := map[string]string{
+		"INSERT INTO t VALUES":            "INSERT INTO t VALUES",
+		"INSERT INTO t (a, b) FORMAT TSV": "INSERT INTO t (a, b) VALUES",
+		"insert into db.t format Values":  "insert into db.t VALUES",
+		"INSERT INTO t":                   "INSERT INTO t VALUES",
+		"INSERT INTO t (a) Values":        "INSERT INTO t (a) VALUES",
+	}
+	for in, want := range tests {
+		if got := nativeQuery(in); got != want {
+			t.Errorf("nativeQuery(%s): want '%s'; got '%s'", in, want, got)
+		}
+	}
+}
+
+func TestNativeBlockLimit(t *testing.T) {
+	// block of few bytes claim max rows and columns
+	var buf bytes.Buffer
+	w := &nativeWriter{w: bufio.NewWriter(&buf)}
+	w.uvarint(0)
+	w.uvarint(math.MaxUint16)
+	w.uvarint(math.MaxInt32)
+	w.str("id")
+	w.str("UInt8")
+	w.byte(1)
+	w.w.(*bufio.Writer).Flush()
+	data := buf.Bytes()
+
+	r := &nativeReader{r: bufio.NewReader(bytes.NewReader(data)), limit: 1000}
+	if _, err := r.block(time.UTC); err != errNativeTooLarge {
+		t.Errorf("want errNativeTooLarge; got %v", err)
+	}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	r = &nativeReader{r: bufio.NewReader(bytes.NewReader(data))}
+	if _, err := r.block(time.UTC); err == nil {
+		t.Error("want truncated block error")
+	}
+	runtime.ReadMemStats(&after)
+	if alloc := after.TotalAlloc - before.TotalAlloc; alloc > 1<<20 {
+		t.Errorf("want allocations by data; got %d bytes", alloc)
+	}
+}
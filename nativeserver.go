@@ -0,0 +1,427 @@
+package proxyhouse
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"net"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// native protocol listener, accept inserts from clickhouse drivers
+// rows are merged into store as TabSeparated and sent by backgroundSender
+
+const (
+	revisionClientInfo = 54032
+	interfaceTCP       = 1
+	clientCancel       = 3
+
+	// clickhouse error codes
+	chNotImplemented  = 48
+	chUnknownTable    = 60
+	chUnknownPacket   = 101
+	chIncorrectData   = 117
+	chUnknownSettings = 115
+	chNotEnoughSpace  = 243
+	chTooManyBytes    = 307
+)
+
+var plainIdent = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type nativeSession struct {
+	conn     net.Conn
+	bw       *bufio.Writer
+	w        *nativeWriter
+	r        *nativeReader
+	revision uint64
+	database string
+	user     string
+	password string
+	proxy    *Proxy
+}
+
+// listenNative start native protocol listener on addr
+func (p *Proxy) listenNative(addr string) (net.Listener, error) {
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				p.log(LEVEL_INFO, "Native listener stopped: ", err)
+				return
+			}
+			go p.handleNative(conn)
+		}
+	}()
+	return ln, nil
+}
+
+func (p *Proxy) handleNative(conn net.Conn) {
+	defer p.handlePanic("handleNative()")
+	defer conn.Close()
+	s := &nativeSession{conn: conn, bw: bufio.NewWriter(conn), r: &nativeReader{r: bufio.NewReader(conn), limit: p.conf().MaxBody}, proxy: p}
+	s.w = &nativeWriter{w: s.bw}
+	conn.SetDeadline(time.Now().Add(nativeTimeout))
+	if err := s.hello(); err != nil {
+		p.log(LEVEL_ERR, "Native hello error: ", conn.RemoteAddr(), " error: ", err)
+		return
+	}
+	for {
+		// idle connection closed after keepalive
+		conn.SetDeadline(time.Now().Add(time.Duration(p.conf().Keepalive) * time.Second))
+		packet, err := s.r.uvarint()
+		if err != nil {
+			return
+		}
+		conn.SetDeadline(time.Now().Add(nativeTimeout))
+		switch packet {
+		case clientPing:
+			s.w.uvarint(serverPong)
+		case clientQuery:
+			err = s.query()
+		default:
+			err = fmt.Errorf("Error: unknown packet %d from client", packet)
+			s.exception(chUnknownPacket, err)
+		}
+		if ferr := s.bw.Flush(); err == nil {
+			err = ferr
+		}
+		if err != nil {
+			p.log(LEVEL_ERR, "Native request error: ", conn.RemoteAddr(), " error: ", err)
+			return
+		}
+	}
+}
+
+func (s *nativeSession) hello() (err error) {
+	packet, err := s.r.uvarint()
+	if err != nil {
+		return err
+	}
+	if packet != clientHello {
+		return errNativeUnexpected
+	}
+	if _, err = s.r.str(); err != nil { // client name
+		return err
+	}
+	if _, err = s.r.uvarint(); err != nil { // major
+		return err
+	}
+	if _, err = s.r.uvarint(); err != nil { // minor
+		return err
+	}
+	if s.revision, err = s.r.uvarint(); err != nil {
+		return err
+	}
+	if s.revision > nativeRevision {
+		s.revision = nativeRevision
+	}
+	if s.database, err = s.r.str(); err != nil {
+		return err
+	}
+	if s.user, err = s.r.str(); err != nil {
+		return err
+	}
+	if s.password, err = s.r.str(); err != nil {
+		return err
+	}
+	if s.database == "" {
+		s.database = "default"
+	}
+	v := versionParts()
+	s.w.uvarint(serverHello)
+	s.w.str("proxyhouse")
+	s.w.uvarint(v[0])
+	s.w.uvarint(v[1])
+	s.w.uvarint(nativeRevision)
+	if s.revision >= revisionServerTimezone {
+		s.w.str("UTC")
+	}
+	if s.revision >= revisionServerDisplayName {
+		s.w.str(hostname)
+	}
+	if s.revision >= revisionVersionPatch {
+		s.w.uvarint(v[2])
+	}
+	return s.bw.Flush()
+}
+
+// exception send exception to client, connection may be used further
+func (s *nativeSession) exception(code int32, err error) {
+	s.w.uvarint(serverException)
+	s.w.fixed(uint64(uint32(code)), 4)
+	s.w.str("DB::Exception")
+	s.w.str(err.Error())
+	s.w.str("")
+	s.w.byte(0)
+}
+
+// dataError send exception for broken data packet, stream is out of sync, so connection is closed after it
+func (s *nativeSession) dataError(err error) error {
+	code := int32(chIncorrectData)
+	if _, ok := err.(nativeFormatError); ok {
+		code = chNotImplemented
+	}
+	s.exception(code, err)
+	return err
+}
+
+// clientInfo skip client info of query packet
+func (s *nativeSession) clientInfo() error {
+	kind, err := s.r.byte()
+	if err != nil || kind == 0 {
+		return err
+	}
+	for i := 0; i < 3; i++ { // initial user, query id, address
+		if _, err = s.r.str(); err != nil {
+			return err
+		}
+	}
+	iface, err := s.r.byte()
+	if err != nil {
+		return err
+	}
+	if iface != interfaceTCP {
+		return errors.New("Error: unsupported client interface")
+	}
+	for _, kind := range "sssvvv" { // os user, hostname, client name, version, revision
+		if kind == 's' {
+			_, err = s.r.str()
+		} else {
+			_, err = s.r.uvarint()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	if s.revision >= revisionQuotaKey {
+		if _, err = s.r.str(); err != nil {
+			return err
+		}
+	}
+	if s.revision >= revisionVersionPatch {
+		_, err = s.r.uvarint()
+	}
+	return err
+}
+
+// settings read query settings, only string serialized settings are supported
+func (s *nativeSession) settings() (map[string]string, error) {
+	settings := make(map[string]string)
+	for {
+		name, err := s.r.str()
+		if err != nil || name == "" {
+			return settings, err
+		}
+		if s.revision < revisionSettingsAsStrings {
+			return nil, errors.New("Error: settings of old clients are not supported")
+		}
+		if _, err = s.r.uvarint(); err != nil { // flags
+			return nil, err
+		}
+		if settings[name], err = s.r.str(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// readData read data packet, return block
+func (s *nativeSession) readData() (*Block, error) {
+	packet, err := s.r.uvarint()
+	if err != nil {
+		return nil, err
+	}
+	switch packet {
+	case clientData:
+	case clientCancel:
+		return nil, errors.New("Error: query canceled by client")
+	default:
+		return nil, errNativeUnexpected
+	}
+	if _, err = s.r.str(); err != nil { // external table name
+		return nil, err
+	}
+	return s.r.block(time.UTC)
+}
+
+// query handle query packet, only inserts are accepted
+// returned error mean connection is broken and must be closed
+func (s *nativeSession) query() error {
+	if _, err := s.r.str(); err != nil { // query id
+		return err
+	}
+	if s.revision >= revisionClientInfo {
+		if err := s.clientInfo(); err != nil {
+			return err
+		}
+	}
+	settings, err := s.settings()
+	if err != nil {
+		s.exception(chUnknownSettings, err)
+		return err
+	}
+	if _, err = s.r.uvarint(); err != nil { // stage
+		return err
+	}
+	compression, err := s.r.uvarint()
+	if err != nil {
+		return err
+	}
+	query, err := s.r.str()
+	if err != nil {
+		return err
+	}
+	if compression != 0 {
+		err = errors.New("Error: compression is not supported, disable it in client")
+		s.exception(chNotImplemented, err)
+		return err
+	}
+	// external tables data, ended by empty block
+	for {
+		b, err := s.readData()
+		if err != nil {
+			return s.dataError(err)
+		}
+		if len(b.Columns) == 0 {
+			break
+		}
+	}
+
+	database, table, names, err := parseInsert(query)
+	if err != nil {
+		s.exception(chNotImplemented, err)
+		return nil
+	}
+	if database == "" {
+		database = s.database
+	}
+	columns, err := s.proxy.tableColumns(database, table, s.user, s.password)
+	if err == nil {
+		columns, err = selectColumns(columns, names)
+	}
+	if err != nil {
+		s.exception(chUnknownTable, err)
+		return nil
+	}
+	s.w.uvarint(serverData)
+	s.w.str("")
+	s.w.block(&Block{Columns: columns}, time.UTC)
+	if err = s.bw.Flush(); err != nil {
+		return err
+	}
+
+	var rows []Row
+	var blockErr error
+	size := 0
+	for {
+		b, err := s.readData()
+		if err != nil {
+			return s.dataError(err)
+		}
+		if len(b.Columns) == 0 {
+			break
+		}
+		// read all blocks anyway to keep the stream in sync
+		if blockErr == nil {
+			rows, blockErr = appendBlock(rows, b, columns)
+		}
+		// insert is limited as http body, rows are dropped once it is too large
+		if size += blockSize(b); blockErr == nil && s.r.limit > 0 && size > s.r.limit {
+			rows, blockErr = nil, errBodyTooLarge
+		}
+	}
+	if blockErr == errBodyTooLarge {
+		s.proxy.metrics.Increment(s.proxy.conf().GraphitePrefixCnt+".wrong_requests", 1)
+		s.exception(chTooManyBytes, blockErr)
+		return nil
+	}
+	if blockErr != nil {
+		s.exception(chIncorrectData, blockErr)
+		return nil
+	}
+	if len(rows) > 0 && s.proxy.spoolFull() {
+		s.proxy.metrics.Increment(s.proxy.conf().GraphitePrefixCnt+".spool_rejected", 1)
+		s.exception(chNotEnoughSpace, errSpoolFull)
+		return nil
+	}
+	if len(rows) > 0 {
+		key, query := nativeKey(database, table, columns, settings, s.user, s.password)
+		s.proxy.Append(key, query, encodeTSV(rows))
+	}
+	s.w.uvarint(serverEndOfStream)
+	return nil
+}
+
+// appendBlock append block rows ordered as columns
+func appendBlock(rows []Row, b *Block, columns []Column) ([]Row, error) {
+	if len(b.Columns) != len(columns) {
+		return nil, fmt.Errorf("Error: want %d columns; got %d", len(columns), len(b.Columns))
+	}
+	order := make([]int, len(columns))
+	for i, col := range columns {
+		order[i] = -1
+		for j, bcol := range b.Columns {
+			if bcol.Name == col.Name {
+				order[i] = j
+				break
+			}
+		}
+		if order[i] < 0 {
+			return nil, errors.New("Error: no column " + col.Name + " in block")
+		}
+	}
+	for _, brow := range b.Rows {
+		row := make(Row, len(columns))
+		for i, j := range order {
+			row[i] = brow[j]
+		}
+		rows = append(rows, row)
+	}
+	return rows, nil
+}
+
+// blockSize return size of block values as TSV
+func blockSize(b *Block) int {
+	n := 0
+	for _, row := range b.Rows {
+		for _, f := range row {
+			n += len(f.Value) + 1
+		}
+	}
+	return n
+}
+
+// nativeKey build store key and query of TabSeparated insert
+func nativeKey(database, table string, columns []Column, settings map[string]string, user, password string) (string, string) {
+	names := make([]string, len(columns))
+	for i, col := range columns {
+		names[i] = quoteIdent(col.Name)
+	}
+	query := fmt.Sprintf("INSERT INTO %s.%s (%s) FORMAT TSV", quoteIdent(database), quoteIdent(table), strings.Join(names, ", "))
+	params := url.Values{}
+	params.Set("query", query)
+	for name, value := range settings {
+		params.Set(name, value)
+	}
+	if user != "" {
+		params.Set("user", user)
+	}
+	if password != "" {
+		params.Set("password", password)
+	}
+	return "/?" + params.Encode(), query
+}
+
+// quoteIdent quote identifier with backquotes if needed
+func quoteIdent(s string) string {
+	if plainIdent.MatchString(s) {
+		return s
+	}
+	return "`" + strings.ReplaceAll(s, "`", "\\`") + "`"
+}
@@ -0,0 +1,148 @@
+package proxyhouse
+
+import (
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNativeServer(t *testing.T) {
+	ts := httptest.NewServer(fakeSchema(t, "u", map[string]string{
+		"db.t": "id\tUInt64\t\nname\tNullable(String)\t\ncnt\tUInt64\tMATERIALIZED\n",
+	}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	ln, err := p.listenNative("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+
+	c, err := dialNative(ln.Addr().String(), "db", "u", "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	settings := map[string]string{"insert_deduplicate": "1"}
+	if err = c.insert("INSERT INTO t VALUES", settings, formatValues, []byte("(1,'a\tb'),(2,NULL)")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.insert("INSERT INTO db.t (name, id) FORMAT TSV", settings, formatTSV, []byte("c\t3\n")); err != nil {
+		t.Fatal(err)
+	}
+	if err = c.insert("SELECT 1", nil, formatValues, nil); err == nil || !strings.Contains(err.Error(), "only INSERT") {
+		t.Errorf("select: want exception; got %v", err)
+	}
+	if err = c.insert("INSERT INTO other VALUES", nil, formatValues, nil); err == nil {
+		t.Errorf("unknown table: want exception")
+	}
+	if err = c.ping(); err != nil {
+		t.Errorf("ping after exception: %v", err)
+	}
+
+	buffers := p.store.buffers()
+	want := map[string]string{
+		"/?insert_deduplicate=1&password=p&query=INSERT+INTO+db.t+%28id%2C+name%29+FORMAT+TSV&user=u": "1\ta\\tb\n2\t\\N\n",
+		"/?insert_deduplicate=1&password=p&query=INSERT+INTO+db.t+%28name%2C+id%29+FORMAT+TSV&user=u": "c\t3\n",
+	}
+	if len(buffers) != len(want) {
+		t.Errorf("store: want %d keys; got %d", len(want), len(buffers))
+	}
+	for key, body := range want {
+		buf, ok := buffers[key]
+		if !ok {
+			t.Errorf("store: no key %s", key)
+			continue
+		}
+		if string(buf.buffer) != body {
+			t.Errorf("%s: want '%s'; got '%s'", key, body, buf.buffer)
+		}
+		if table := extractTable(key); table != "db.t" {
+			t.Errorf("extractTable: want 'db.t'; got '%s'", table)
+		}
+	}
+}
+
+func TestNativeServerBadBlock(t *testing.T) {
+	ts := httptest.NewServer(fakeSchema(t, "u", map[string]string{"db.t": "id\tUInt64\t\n"}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+	ln, err := p.listenNative("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := dialNative(ln.Addr().String(), "db", "u", "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	c.query("INSERT INTO t VALUES", nil)
+	if err = c.bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if packet, _, err := c.packet(); err != nil || packet != serverData {
+		t.Fatalf("want table structure; got %d %v", packet, err)
+	}
+	// block with unsupported column type
+	c.w.uvarint(clientData)
+	c.w.str("")
+	c.w.uvarint(0)
+	c.w.uvarint(1)
+	c.w.uvarint(1)
+	c.w.str("id")
+	c.w.str("AggregateFunction(sum, UInt64)")
+	c.w.byte(1)
+	if err = c.bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.packet(); err == nil || !strings.Contains(err.Error(), "unsupported type") {
+		t.Errorf("want exception; got %v", err)
+	}
+}
+
+// insert is limited by maxbody over all blocks
+func TestNativeServerTooLarge(t *testing.T) {
+	ts := httptest.NewServer(fakeSchema(t, "u", map[string]string{"db.t": "id\tUInt64\t\n"}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd, c.MaxBody = ts.URL, 100 })
+	ln, err := p.listenNative("127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	c, err := dialNative(ln.Addr().String(), "db", "u", "p")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.conn.Close()
+	c.query("INSERT INTO t VALUES", nil)
+	if err = c.bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if packet, _, err := c.packet(); err != nil || packet != serverData {
+		t.Fatalf("want table structure; got %d %v", packet, err)
+	}
+	// every block is under limit, insert is over it
+	block := &Block{Columns: []Column{{Name: "id", Type: "UInt64"}}}
+	for i := 0; i < 10; i++ {
+		block.Rows = append(block.Rows, Row{{Value: "1234567"}})
+	}
+	for i := 0; i < 5; i++ {
+		c.data(block)
+	}
+	c.data(&Block{})
+	if err = c.bw.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err = c.packet(); err == nil || !strings.Contains(err.Error(), "too large") {
+		t.Errorf("want exception; got %v", err)
+	}
+	if err = c.ping(); err != nil {
+		t.Errorf("ping after exception: %v", err)
+	}
+	if buffers := p.store.buffers(); len(buffers) != 0 {
+		t.Errorf("want insert rejected; got %d buffers", len(buffers))
+	}
+}
@@ -0,0 +1,78 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"io"
+	"sync"
+)
+
+// bufferClasses are capacities of pooled batch buffers, from buffersize up, 4 times each
+// buffers of other capacity are left to gc
+var bufferClasses = []int{8 << 10, 32 << 10, 128 << 10, 512 << 10, 2 << 20, 8 << 20, 32 << 20}
+
+var bufferPools = make([]sync.Pool, len(bufferClasses))
+
+// getBuffer return empty buffer with capacity of size or more
+func getBuffer(size int) []byte {
+	for i, class := range bufferClasses {
+		if size <= class {
+			if b, ok := bufferPools[i].Get().(*[]byte); ok {
+				return (*b)[:0]
+			}
+			return make([]byte, 0, class)
+		}
+	}
+	return make([]byte, 0, size)
+}
+
+// putBuffer return buffer to pool of its size class, buffer must not be used after it
+func putBuffer(b []byte) {
+	for i, class := range bufferClasses {
+		if cap(b) == class {
+			b = b[:0]
+			bufferPools[i].Put(&b)
+			return
+		}
+	}
+}
+
+// growBuffer make room for n more bytes, contents are moved to buffer of the next size class
+func growBuffer(b []byte, n int) []byte {
+	if len(b)+n <= cap(b) {
+		return b
+	}
+	size := len(b) + n
+	if size < 2*cap(b) {
+		size = 2 * cap(b)
+	}
+	nb := append(getBuffer(size), b...)
+	putBuffer(b)
+	return nb
+}
+
+// batchReader is a request body over pooled buffer, transport may read body after
+// response is received, so reads are stopped by Close before buffer is reused
+type batchReader struct {
+	mu sync.Mutex
+	r  *bytes.Reader
+}
+
+func newBatchReader(b []byte) *batchReader {
+	return &batchReader{r: bytes.NewReader(b)}
+}
+
+func (br *batchReader) Read(p []byte) (int, error) {
+	br.mu.Lock()
+	defer br.mu.Unlock()
+	if br.r == nil {
+		return 0, io.ErrClosedPipe
+	}
+	return br.r.Read(p)
+}
+
+func (br *batchReader) Close() error {
+	br.mu.Lock()
+	br.r = nil
+	br.mu.Unlock()
+	return nil
+}
@@ -0,0 +1,69 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestGetBuffer(t *testing.T) {
+	tests := map[int]int{0: 8 << 10, 8 << 10: 8 << 10, 8<<10 + 1: 32 << 10, 1 << 20: 2 << 20, 64 << 20: 64 << 20}
+	for size, want := range tests {
+		b := getBuffer(size)
+		if len(b) != 0 || cap(b) != want {
+			t.Errorf("getBuffer(%d): want cap %d; got len %d cap %d", size, want, len(b), cap(b))
+		}
+		putBuffer(b)
+	}
+}
+
+func TestGrowBuffer(t *testing.T) {
+	b := append(getBuffer(0), "(1)"...)
+	if got := growBuffer(b, 100); cap(got) != cap(b) {
+		t.Errorf("want buffer kept; got cap %d", cap(got))
+	}
+	body := bytes.Repeat([]byte("(1,'proxyhouse'),"), 1000)
+	b = growBuffer(b, len(body))
+	b = append(b, body...)
+	if cap(b) != 32<<10 || !bytes.HasPrefix(b, []byte("(1)(1,")) || len(b) != 3+len(body) {
+		t.Errorf("want contents moved to next class; got len %d cap %d", len(b), cap(b))
+	}
+}
+
+func TestBatchReader(t *testing.T) {
+	rd := newBatchReader([]byte("(1),(2)"))
+	p := make([]byte, 4)
+	if n, err := rd.Read(p); n != 4 || err != nil {
+		t.Fatalf("want 4 bytes; got %d %v", n, err)
+	}
+	rd.Close()
+	if _, err := ioutil.ReadAll(rd); err != io.ErrClosedPipe {
+		t.Errorf("want reads stopped after close; got %v", err)
+	}
+}
+
+func TestFlushRecycle(t *testing.T) {
+	var got string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		got = string(body)
+	}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	p.Append("/?query=INSERT%20INTO%20t%20VALUES", "INSERT INTO t VALUES", []byte("(1)"))
+	p.Append("/?query=INSERT%20INTO%20t%20VALUES", "INSERT INTO t VALUES", []byte("(2)"))
+	for key, buf := range p.store.due(time.Now().Add(time.Hour), nil) {
+		p.flush(key, buf)
+		if buf.buffer != nil {
+			t.Error("want buffer returned to pool")
+		}
+	}
+	if got != "(1),(2)" {
+		t.Errorf("want batch sent; got '%s'", got)
+	}
+}
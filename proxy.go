@@ -0,0 +1,354 @@
+package proxyhouse
+
+import (
+	"context"
+	"errors"
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/marpaia/graphite-golang"
+)
+
+// Metrics count proxy events, counters are summed by name
+// MetricStorage is used by default, it sends counters to graphite
+type Metrics interface {
+	Increment(name string, value int)
+}
+
+// Logger write proxy messages with graylog levels, Graylog satisfy it
+type Logger interface {
+	Log(level uint8, data ...interface{})
+}
+
+// Options of proxy, nil fields get defaults from config
+type Options struct {
+	// Config is a proxy settings, DefaultConfig if nil
+	Config *Config
+	// Reload return new config on SIGHUP or POST /reload with reloadapi, reload is disabled if nil
+	Reload func() (*Config, error)
+	// Client forward batches and table structure queries to clickhouse
+	Client *http.Client
+	// Metrics get proxy counters, MetricStorage sent to graphite of config if nil
+	Metrics Metrics
+	// Logger get proxy messages, graylog of config or stdout if nil
+	Logger Logger
+	// ErrorsDir keep batches failed to send, comma separated dirs, errorsdir of config if empty
+	ErrorsDir string
+}
+
+// Proxy buffer inserts by table and forward them to clickhouse in batches
+type Proxy struct {
+	config     atomic.Value // *Config
+	reloadMu   sync.Mutex
+	reload     func() (*Config, error)
+	store      *Store
+	client     *http.Client
+	metrics    Metrics
+	logger     Logger
+	errorsDirs []string
+	handler    http.Handler
+
+	// graphite is set when metrics are sent by proxy itself
+	graphite *MetricStorage
+	gr       *graphite.Graphite
+
+	faults   atomic.Value // *faults
+	spool    *spool
+	recovery *recovery
+	dedup    *dedupCache
+	schema   *schemaCache
+	natives  *nativePool
+	flushes  chan struct{} // flush workers semaphore
+	flushing sync.WaitGroup
+
+	totalConnections uint32 // Total number of connections opened since the server started running
+	currConnections  int32  // Number of open connections
+	idleConnections  int32  // Number of idle connections
+	in               uint32 //in requests
+	out              uint32 //out requests
+	errorsCheck      uint32 // Number of errors Check
+	liveFlushes      int32  // Number of live batches sending, recovery wait for them
+	spoolNext        uint32 // errors dir of next batch, round-robin
+
+	cancel  context.CancelFunc
+	sends   context.Context    // canceled when shutdown deadline pass
+	abort   context.CancelFunc // abort sends in flight
+	done    sync.WaitGroup
+	server  *http.Server
+	closers []func() error
+}
+
+var errNoReload = errors.New("Error: config reload is not configured")
+
+var errShutdown = errors.New("Error: proxy is stopped before batch is sent")
+
+// hostname is this host in metric names
+var hostname = func() string {
+	host, err := os.Hostname()
+	if err != nil {
+		host = "unknown"
+	}
+	return strings.ReplaceAll(host, ".", "_")
+}()
+
+// stdLogger print messages to stdout, if graylog is not set
+type stdLogger struct{}
+
+func (stdLogger) Log(level uint8, data ...interface{}) {
+	fmt.Println(data...)
+}
+
+// New create proxy, config is validated and copied, so it may be reused by caller
+func New(opts Options) (*Proxy, error) {
+	cfg := DefaultConfig()
+	if opts.Config != nil {
+		cfg = opts.Config.clone()
+	}
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+	cfg.prepare()
+	p := &Proxy{
+		reload:   opts.Reload,
+		store:    newStore(storeShards),
+		client:   opts.Client,
+		metrics:  opts.Metrics,
+		logger:   opts.Logger,
+		spool:    &spool{busy: make(map[string]bool)},
+		recovery: &recovery{},
+		dedup:    &dedupCache{seen: make(map[string]int64)},
+		schema:   newSchemaCache(),
+		natives:  &nativePool{conns: make(map[string][]*nativeConn)},
+		flushes:  make(chan struct{}, cfg.FlushWorkers),
+	}
+	p.sends, p.abort = context.WithCancel(context.Background())
+	p.config.Store(cfg)
+	f, _ := parseFaults(cfg.Faults)
+	p.faults.Store(f)
+	if p.client == nil {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		transport.MaxIdleConnsPerHost = 1000
+		p.client = &http.Client{Transport: transport}
+	}
+	if p.metrics == nil {
+		p.graphite = NewMetricStorage()
+		p.metrics = p.graphite
+	}
+	if p.logger == nil {
+		p.logger = stdLogger{}
+		if cfg.GraylogHost != "" {
+			p.logger = NewGraylog(Graylog{Host: cfg.GraylogHost, Port: cfg.GraylogPort})
+		}
+	}
+	p.dedup.logger = p.logger
+	if cfg.Faults != "" {
+		p.log(LEVEL_WARN, "Fault injection enabled: ", f)
+	}
+	dirs := opts.ErrorsDir
+	if dirs == "" {
+		dirs = cfg.ErrorsDir
+	}
+	if err := validateDirs(dirs); err != nil {
+		return nil, fmt.Errorf("errorsdir %s: %s", dirs, err)
+	}
+	p.errorsDirs = splitDirs(dirs)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", p.dorequest)
+	mux.HandleFunc("/status", p.showstatus)
+	mux.HandleFunc("/statistic", p.showstatistic)
+	if opts.Reload != nil && cfg.ReloadAPI {
+		// any client of the port may reload config, so it is enabled by flag
+		mux.HandleFunc("/reload", p.doreload)
+	}
+	if cfg.FaultsAPI {
+		// any client of the port may break forwarding, so it is enabled for chaos tests only
+		mux.HandleFunc("/faults", p.dofaults)
+	}
+	mux.Handle("/debug/vars", expvar.Handler())
+	p.handler = mux
+	return p, nil
+}
+
+// conf return current config
+func (p *Proxy) conf() *Config {
+	return p.config.Load().(*Config)
+}
+
+// log write message to proxy logger
+func (p *Proxy) log(level uint8, data ...interface{}) {
+	p.logger.Log(level, data...)
+}
+
+// Handler serve inserts, /status, /statistic, /reload and /faults if enabled, it may be mounted into other server
+func (p *Proxy) Handler() http.Handler {
+	return p.handler
+}
+
+// Start run background sender and recovery of errors dir, then listeners of config:
+// http and udp on port, unix socket and native protocol, port 0 disable http listener
+func (p *Proxy) Start() error {
+	cfg := p.conf()
+	if err := p.openSpool(); err != nil {
+		return err
+	}
+	if err := p.scanSpool(); err != nil {
+		p.Shutdown(context.Background())
+		return err
+	}
+	if cfg.DedupFile != "" {
+		if err := p.dedup.open(cfg.DedupFile); err != nil {
+			p.Shutdown(context.Background())
+			return fmt.Errorf("dedupfile: %s", err)
+		}
+		p.closers = append(p.closers, p.dedup.close)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	p.cancel = cancel
+	p.background(ctx, p.backgroundSender)
+	p.background(ctx, p.backgroundRecovery)
+	if p.graphite != nil {
+		if cfg.GraphiteHost != "" {
+			gr, err := graphite.NewGraphiteUDP(cfg.GraphiteHost, cfg.GraphitePort)
+			if err != nil {
+				p.Shutdown(context.Background())
+				return err
+			}
+			p.gr = gr
+		} else {
+			p.gr = graphite.NewGraphiteNop(cfg.GraphiteHost, cfg.GraphitePort)
+		}
+		p.background(ctx, p.sendMetrics)
+	}
+	p.log(LEVEL_INFO, "Start proxyhouse")
+
+	if err := p.listen(cfg); err != nil {
+		p.Shutdown(context.Background())
+		return err
+	}
+	return nil
+}
+
+// listen start listeners of config, started listeners are closed by Shutdown
+func (p *Proxy) listen(cfg *Config) error {
+	p.server = &http.Server{
+		Handler:           p.handler,
+		ReadHeaderTimeout: time.Duration(cfg.ReadTimeout) * time.Second,
+		IdleTimeout:       time.Duration(cfg.Keepalive) * time.Second,
+		ConnState:         p.statelistener,
+	}
+	if cfg.NativePort > 0 {
+		ln, err := p.listenNative(":" + strconv.Itoa(cfg.NativePort))
+		if err != nil {
+			return fmt.Errorf("listenNative: %s", err)
+		}
+		p.closers = append(p.closers, ln.Close)
+	}
+	if cfg.Port > 0 && !cfg.NoUDP {
+		conn, err := p.listenUDP(":" + strconv.Itoa(cfg.Port))
+		if err != nil {
+			return fmt.Errorf("listenUDP: %s", err)
+		}
+		p.closers = append(p.closers, conn.Close)
+	}
+	if cfg.Unixs != "" {
+		ln, err := listenUnix(cfg.Unixs)
+		if err != nil {
+			return fmt.Errorf("listenUnix: %s", err)
+		}
+		p.serve(ln)
+	}
+	if cfg.Port > 0 {
+		ln, err := net.Listen("tcp", ":"+strconv.Itoa(cfg.Port))
+		if err != nil {
+			return fmt.Errorf("listen: %s", err)
+		}
+		p.serve(ln)
+	}
+	return nil
+}
+
+func (p *Proxy) serve(ln net.Listener) {
+	go func() {
+		if err := p.server.Serve(ln); err != nil && err != http.ErrServerClosed {
+			p.log(LEVEL_ERR, "Serve error: ", ln.Addr(), " error: ", err)
+		}
+	}()
+}
+
+// background run loop until proxy is shut down
+func (p *Proxy) background(ctx context.Context, loop func(ctx context.Context)) {
+	p.done.Add(1)
+	go func() {
+		defer p.done.Done()
+		loop(ctx)
+	}()
+}
+
+// Shutdown stop listeners and background loops, then send buffered inserts,
+// batches failed to send are saved to errors dir as usual,
+// once ctx is done sends in flight are aborted and buffers are saved to errors dir unsent
+func (p *Proxy) Shutdown(ctx context.Context) error {
+	var err error
+	if p.server != nil {
+		err = p.server.Shutdown(ctx)
+	}
+	if p.cancel != nil {
+		p.cancel()
+	}
+	stopped := make(chan struct{})
+	go func() {
+		p.done.Wait()
+		p.flushing.Wait()
+		close(stopped)
+	}()
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		// recovery is resumed on next start, flush workers save their batches to errors dir
+		err = ctx.Err()
+		p.abort()
+		<-stopped
+	}
+	for key, buf := range p.store.drain() {
+		if ctx.Err() != nil {
+			p.spoolBuffer(key, buf)
+			continue
+		}
+		p.flush(key, buf)
+	}
+	// batches failed to save to errors dir are kept in store until exit
+	for key, buf := range p.store.drain() {
+		p.log(LEVEL_ERR, "Batch is lost: ", hidePassword(key), " rows: ", buf.rowcount)
+	}
+	for _, close := range p.closers {
+		close()
+	}
+	p.closers = nil
+	p.natives.close()
+	if p.gr != nil {
+		p.graphite.SendMetrics(p.gr, p.conf().GraphitePrefixAvg)
+	}
+	p.log(LEVEL_INFO, "Stop proxyhouse")
+	return err
+}
+
+// sendMetrics send counters to graphite every 2 seconds
+func (p *Proxy) sendMetrics(ctx context.Context) {
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(2 * time.Second):
+			p.recoveryMetrics()
+			p.graphite.SendMetrics(p.gr, p.conf().GraphitePrefixAvg)
+		}
+	}
+}
@@ -0,0 +1,150 @@
+package proxyhouse
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// newTestProxy return not started proxy with default config changed for the test
+// batches failed to send are saved to temp dir
+func newTestProxy(t testing.TB, change func(c *Config)) *Proxy {
+	t.Helper()
+	c := DefaultConfig()
+	if change != nil {
+		change(c)
+	}
+	p, err := New(Options{Config: c, ErrorsDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+// counter return count metric of default metrics storage
+func counter(p *Proxy, name string) int {
+	ms := p.metrics.(*MetricStorage)
+	ms.mx.Lock()
+	defer ms.mx.Unlock()
+	return ms.storage[p.conf().GraphitePrefixCnt+name]
+}
+
+// recordMetrics keep counters in memory
+type recordMetrics struct {
+	sync.Mutex
+	counters map[string]int
+}
+
+func (m *recordMetrics) Increment(name string, value int) {
+	m.Lock()
+	m.counters[name] += value
+	m.Unlock()
+}
+
+func freePort(t *testing.T) int {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ln.Close()
+	return ln.Addr().(*net.TCPAddr).Port
+}
+
+func TestProxyShutdown(t *testing.T) {
+	batches := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		batches <- string(body)
+	}))
+	defer ts.Close()
+	cfg := DefaultConfig()
+	cfg.Fwd, cfg.SyncSec, cfg.Port = ts.URL, 60, freePort(t)
+	metrics := &recordMetrics{counters: make(map[string]int)}
+	p, err := New(Options{Config: cfg, Client: ts.Client(), Metrics: metrics, ErrorsDir: t.TempDir()})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	addr := "http://127.0.0.1:" + strconv.Itoa(cfg.Port)
+	resp, err := http.Post(addr+"/?query=INSERT%20INTO%20t%20VALUES", "", strings.NewReader("(1),(2)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err = p.Shutdown(ctx); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case got := <-batches:
+		if got != "(1),(2)" {
+			t.Errorf("want buffered batch; got '%s'", got)
+		}
+	default:
+		t.Fatal("want buffered batch sent on shutdown")
+	}
+	if metrics.counters[cfg.GraphitePrefixCnt+".rows_sent"] != 2 {
+		t.Errorf("want rows_sent in injected metrics; got %v", metrics.counters)
+	}
+	if _, err = http.Post(addr, "", strings.NewReader("(3)")); err == nil {
+		t.Error("want listener closed")
+	}
+}
+
+func TestProxyHandler(t *testing.T) {
+	p := newTestProxy(t, func(c *Config) { c.Port = 0 })
+	ts := httptest.NewServer(p.Handler())
+	defer ts.Close()
+	for path, code := range map[string]int{"/status": http.StatusOK, "/statistic": http.StatusOK, "/other": http.StatusNotFound} {
+		resp, err := http.Get(ts.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != code {
+			t.Errorf("%s: want %d; got %d", path, code, resp.StatusCode)
+		}
+	}
+}
+
+// /reload is served only with loader and reloadapi
+func TestProxyReloadAPI(t *testing.T) {
+	reload := func() (*Config, error) { return DefaultConfig(), nil }
+	for _, tc := range []struct {
+		reload func() (*Config, error)
+		api    bool
+		code   int
+	}{
+		{nil, true, http.StatusNotFound},
+		{reload, false, http.StatusNotFound},
+		{reload, true, http.StatusOK},
+	} {
+		cfg := DefaultConfig()
+		cfg.ReloadAPI = tc.api
+		p, err := New(Options{Config: cfg, Reload: tc.reload, ErrorsDir: t.TempDir()})
+		if err != nil {
+			t.Fatal(err)
+		}
+		ts := httptest.NewServer(p.Handler())
+		resp, err := http.Post(ts.URL+"/reload", "", nil)
+		ts.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != tc.code {
+			t.Errorf("reload %v, reloadapi %v: want %d; got %d", tc.reload != nil, tc.api, tc.code, resp.StatusCode)
+		}
+	}
+}
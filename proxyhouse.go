@@ -0,0 +1,886 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/recoilme/pudge"
+)
+
+var (
+	errClose = errors.New("Error closed")
+	version  = "0.2.1"
+	status   = "OK\r\n"
+)
+
+// ERROR_DIR is a default dir of batches failed to send, relative to working dir
+const (
+	ERROR_DIR = "errors"
+)
+
+type Buffer struct {
+	rowcount int
+	buffer   []byte
+	flushAt  time.Time // sent by backgroundSender after this time
+	waiters  []chan error
+}
+
+// storeShards is a number of independently locked parts of store
+const storeShards = 64
+
+// Store keep buffers by key in shards, so inserts of different tables don't wait for each other
+type Store struct {
+	tick   int64 // last backgroundSender run, unix nanoseconds, first for atomic alignment
+	shards []*storeShard
+}
+
+type storeShard struct {
+	sync.Mutex
+	Req map[string]*Buffer
+}
+
+func newStore(shards int) *Store {
+	store := &Store{shards: make([]*storeShard, shards)}
+	for i := range store.shards {
+		store.shards[i] = &storeShard{Req: make(map[string]*Buffer)}
+	}
+	return store
+}
+
+var buffersize = 1024 * 8
+
+func (p *Proxy) dorequest(w http.ResponseWriter, r *http.Request) {
+	defer p.handlePanic("dorequest()")
+	cnt := p.conf().GraphitePrefixCnt
+	if r.URL.Path != "/" {
+		http.Error(w, "404 not found.", http.StatusNotFound)
+		return
+	}
+
+	switch r.Method {
+	case "GET":
+		date := time.Now().UTC().Format(http.TimeFormat)
+		w.Header().Set("Date", date)
+		w.Header().Set("Server", "proxyhouse "+version)
+		w.Header().Set("Connection", "Closed")
+		fmt.Fprint(w, "status = \"OK\"\r\n")
+		return
+
+	case "POST":
+		defer r.Body.Close()
+		if p.spoolFull() {
+			p.metrics.Increment(cnt+".spool_rejected", 1)
+			w.Header().Set("Retry-After", strconv.Itoa(p.conf().ResendInt))
+			http.Error(w, errSpoolFull.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		body, rawsize, err := readBody(r, p.conf().MaxBody)
+		if err != nil {
+			switch {
+			case err == errBodyTooLarge:
+				p.metrics.Increment(cnt+".wrong_requests", 1)
+				http.Error(w, err.Error(), http.StatusRequestEntityTooLarge)
+			case err == errUnsupportedEncoding:
+				p.metrics.Increment(cnt+".wrong_requests", 1)
+				http.Error(w, err.Error(), http.StatusUnsupportedMediaType)
+			case isCompressed(r):
+				p.metrics.Increment(cnt+".wrong_requests", 1)
+				http.Error(w, "Decompress error: "+err.Error(), http.StatusBadRequest)
+			default:
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+			}
+			return
+		}
+		// body become buffer of new batch, or it is copied into batch and read buffer is reused
+		taken := false
+		defer func() {
+			if !taken {
+				putBuffer(body)
+			}
+		}()
+		// body stored decompressed, so decompress param must not be forwarded
+		uri := r.URL.RawPath + "?" + removeParam(removeParam(r.URL.RawQuery, "decompress"), "sync")
+		if len(body) > 0 {
+			cfg := p.conf()
+			q := r.URL.Query().Get("query")
+			table := extractTable(uri)
+			if cfg.table(table).validate {
+				// rejected before dedup, so fixed insert with the same key is accepted
+				if err := p.validateInsert(r.URL.Query(), r.Header, q, body); err != nil {
+					p.metrics.Increment(cnt+".wrong_requests", 1)
+					p.metrics.Increment(cnt+".bytable."+table+".wrong_requests", 1)
+					http.Error(w, err.Error(), http.StatusBadRequest)
+					return
+				}
+			}
+			id := dedupID(cfg.Dedup, r, uri, body)
+			if id != "" && p.dedup.duplicate(id, time.Duration(cfg.DedupWindow)*time.Second) {
+				// acknowledged, but not buffered again
+				p.metrics.Increment(cnt+".dedup_skipped", 1)
+				w.Header().Set("Server", "proxyhouse "+version)
+				return
+			}
+			var ack chan error
+			if isSync(r) {
+				ack = make(chan error, 1)
+			}
+			// body must not be used after it
+			taken = p.append(uri, q, body, ack, true)
+			if isCompressed(r) {
+				p.metrics.Increment(cnt+".bytes_received_compressed", rawsize)
+				p.metrics.Increment(cnt+".bytable."+table+".bytes_received_compressed", rawsize)
+			}
+			w.Header().Set("Server", "proxyhouse "+version)
+			if ack != nil {
+				// dropped insert is not acknowledged, so it is accepted on retry
+				if err := p.writeAck(w, ack); err != nil && id != "" {
+					p.dedup.forget(id)
+				}
+				return
+			}
+			w.Header().Set("Content-type", "text/tab-separated-values; charset=UTF-8")
+		} else {
+			http.Error(w, "No data given.", http.StatusMethodNotAllowed)
+		}
+
+	default:
+		http.Error(w, "Sorry, only GET and POST methods are supported.", http.StatusMethodNotAllowed)
+	}
+}
+
+func (p *Proxy) showstatus(w http.ResponseWriter, r *http.Request) {
+	errcount := 0
+	list, err := p.spoolList()
+	if err == nil {
+		errcount = len(list)
+	}
+
+	date := time.Now().UTC().Format(http.TimeFormat)
+	w.Header().Set("Date", date)
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Connection", "Closed")
+	cfg := p.conf()
+	if errcount >= cfg.CritLevel {
+		w.WriteHeader(http.StatusInternalServerError)
+	} else if errcount >= cfg.WarnLevel {
+		w.WriteHeader(http.StatusBadRequest)
+	}
+	fmt.Fprintf(w, "status:%s", status)
+}
+
+func (p *Proxy) showstatistic(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Server", "proxyhouse "+version)
+	w.Header().Set("Connection", "Closed")
+	fmt.Fprintf(w, "total connections:%d\r\n", atomic.LoadUint32(&p.totalConnections))
+	fmt.Fprintf(w, "current connections:%d\r\n", atomic.LoadInt32(&p.currConnections))
+	fmt.Fprintf(w, "idle connections:%d\r\n", atomic.LoadInt32(&p.idleConnections))
+	fmt.Fprintf(w, "in requests:%d\r\n", atomic.LoadUint32(&p.in))
+	fmt.Fprintf(w, "out requests:%d\r\n", atomic.LoadUint32(&p.out))
+	files, bytes := p.spoolUsage()
+	fmt.Fprintf(w, "errors dir files:%d\r\n", files)
+	fmt.Fprintf(w, "errors dir bytes:%d\r\n", bytes)
+	backlog, backlogBytes, eta := p.recovery.eta()
+	fmt.Fprintf(w, "recovery backlog files:%d\r\n", backlog)
+	fmt.Fprintf(w, "recovery backlog bytes:%d\r\n", backlogBytes)
+	if eta < 0 {
+		// nothing is resent yet
+		eta = -time.Second
+	}
+	fmt.Fprintf(w, "recovery eta seconds:%d\r\n", int(eta.Seconds()))
+}
+
+func (p *Proxy) statelistener(c net.Conn, cs http.ConnState) {
+	switch cs {
+	case http.StateNew:
+		atomic.AddUint32(&p.totalConnections, 1)
+		atomic.AddInt32(&p.currConnections, 1)
+		atomic.AddInt32(&p.idleConnections, 1)
+	case http.StateActive:
+		atomic.AddInt32(&p.idleConnections, -1)
+	case http.StateIdle:
+		atomic.AddInt32(&p.idleConnections, 1)
+	case http.StateClosed:
+		atomic.AddInt32(&p.currConnections, -1)
+		atomic.AddInt32(&p.idleConnections, -1)
+	}
+}
+
+// Append merge body into buffer by uri, query define rows delimiter
+// insert is converted to canonical format of table first, if it is set
+func (p *Proxy) Append(uri, query string, body []byte) {
+	p.append(uri, query, body, nil, false)
+}
+
+// AppendAck merge body into buffer, returned channel get send result of the buffer
+func (p *Proxy) AppendAck(uri, query string, body []byte) <-chan error {
+	ack := make(chan error, 1)
+	p.append(uri, query, body, ack, false)
+	return ack
+}
+
+// append merge body into buffer, owned body of buffers pool may be taken by store,
+// then it must not be used or released by caller
+func (p *Proxy) append(uri, query string, body []byte, ack chan error, owned bool) (taken bool) {
+	uri, query, body, rows := p.canonicalize(uri, query, body)
+	// converted body is a copy
+	owned = owned && rows < 0
+	cfg := p.conf()
+	cnt := cfg.GraphitePrefixCnt
+	table := extractTable(uri)
+	tc := cfg.table(table)
+	if rows < 0 {
+		rows = countRows(query, body)
+	}
+	full, taken := p.store.add(uri, body, delimiter(query, tc), rows, tc, ack, owned)
+	if full != nil {
+		p.flushAsync(uri, full)
+	}
+	atomic.AddUint32(&p.in, 1)
+	p.metrics.Increment(cnt+".requests_received", 1)
+	p.metrics.Increment(cnt+".byhost."+hostname+".requests_received", 1)
+	p.metrics.Increment(cnt+".bytable."+table+".requests_received", 1)
+	p.metrics.Increment(cnt+".bytes_received", len(body))
+	p.metrics.Increment(cnt+".byhost."+hostname+".bytes_received", len(body))
+	p.metrics.Increment(cnt+".bytable."+table+".bytes_received", len(body))
+	return taken
+}
+
+// delimiter return separator of inserts merged into batch by query
+func delimiter(query string, tc tableConfig) []byte {
+	if strings.HasSuffix(query, "FORMAT TSV") || strings.HasSuffix(query, "FORMAT CSV") || strings.HasSuffix(query, "FORMAT "+formatRowBinary) {
+		return nil
+	}
+	return []byte(tc.delim)
+}
+
+// countRows count rows of body by query, as they are merged into batch
+func countRows(query string, body []byte) int {
+	if strings.HasSuffix(query, "FORMAT TSV") || strings.HasSuffix(query, "FORMAT CSV") {
+		return bytes.Count(body, []byte("\n"))
+	}
+	if strings.HasSuffix(query, "FORMAT "+formatRowBinary) {
+		// binary rows can't be counted, an insert is counted as a row if it is not converted
+		return 1
+	}
+	return 1 + bytes.Count(body, []byte("),"))
+}
+
+// shard return part of store by key hash
+func (store *Store) shard(key string) *storeShard {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return store.shards[h.Sum32()%uint32(len(store.shards))]
+}
+
+// put merge body into buffer by key, return the buffer if it is full and detached from store
+func (store *Store) put(key string, body, delimiter []byte, rows int, tc tableConfig, ack chan error) *Buffer {
+	full, _ := store.add(key, body, delimiter, rows, tc, ack, false)
+	return full
+}
+
+// add is put of body, owned body of pool become buffer of new batch without copy,
+// taken report it, so caller don't release body
+func (store *Store) add(key string, body, delimiter []byte, rows int, tc tableConfig, ack chan error, owned bool) (full *Buffer, taken bool) {
+	sh := store.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	buf, ok := sh.Req[key]
+	if !ok {
+		// flush on tick, so buffer wait no more than syncsec
+		flushAt := time.Unix(0, atomic.LoadInt64(&store.tick)).Add(time.Duration(tc.syncsec) * time.Second)
+		buf = &Buffer{rowcount: 0, flushAt: flushAt}
+		sh.Req[key] = buf
+		delimiter = nil
+		if taken = owned; taken {
+			buf.buffer = body
+		} else {
+			buf.buffer = getBuffer(buffersize)
+		}
+	}
+	if !taken {
+		buf.buffer = growBuffer(buf.buffer, len(delimiter)+len(body))
+		buf.buffer = append(buf.buffer, delimiter...)
+		buf.buffer = append(buf.buffer, body...)
+	}
+	buf.rowcount += rows
+	if ack != nil {
+		buf.waiters = append(buf.waiters, ack)
+	}
+	if (tc.maxrows > 0 && buf.rowcount >= tc.maxrows) || (tc.maxbytes > 0 && len(buf.buffer) >= tc.maxbytes) {
+		delete(sh.Req, key)
+		return buf, taken
+	}
+	return nil, taken
+}
+
+// backgroundSender runs continuously in the background and performs various
+// operations such as forward requests.
+func (p *Proxy) backgroundSender(ctx context.Context) {
+	// map is reused every tick
+	requests := make(map[string]*Buffer)
+	for {
+		requests = p.store.due(time.Now(), requests)
+		//keys itterator
+		for key, val := range requests {
+			p.flushAsync(key, val)
+			delete(requests, key)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(p.conf().tick) * time.Second):
+		}
+	}
+}
+
+// due move buffers with expired flush interval from store into requests, shard by shard
+func (store *Store) due(now time.Time, requests map[string]*Buffer) map[string]*Buffer {
+	if requests == nil {
+		requests = make(map[string]*Buffer)
+	}
+	atomic.StoreInt64(&store.tick, now.UnixNano())
+	for _, sh := range store.shards {
+		sh.Lock()
+		for key, buf := range sh.Req {
+			if !now.Before(buf.flushAt) {
+				requests[key] = buf
+				delete(sh.Req, key)
+			}
+		}
+		sh.Unlock()
+	}
+	return requests
+}
+
+// drain remove all buffers from store and return them
+func (store *Store) drain() map[string]*Buffer {
+	res := make(map[string]*Buffer)
+	for _, sh := range store.shards {
+		sh.Lock()
+		for key, buf := range sh.Req {
+			res[key] = buf
+		}
+		sh.Req = make(map[string]*Buffer)
+		sh.Unlock()
+	}
+	return res
+}
+
+// flushAsync send batch by flush worker, caller wait for a free one,
+// so retries of a table don't hold other tables and flushes are limited by flushworkers
+func (p *Proxy) flushAsync(key string, buf *Buffer) {
+	p.flushes <- struct{}{}
+	p.flushing.Add(1)
+	go p.flushWorker(key, buf)
+}
+
+// flushWorker send batch and free flush worker taken by caller
+func (p *Proxy) flushWorker(key string, buf *Buffer) {
+	defer func() {
+		<-p.flushes
+		p.flushing.Done()
+	}()
+	p.flush(key, buf)
+}
+
+func (p *Proxy) flush(key string, buf *Buffer) {
+	// recovery wait for live flushes
+	atomic.AddInt32(&p.liveFlushes, 1)
+	defer atomic.AddInt32(&p.liveFlushes, -1)
+	err := p.send(p.withToken(key, newBatchID()), buf.buffer, buf.rowcount, 0, time.Now())
+	atomic.AddUint32(&p.out, 1)
+	// batch is sent or saved to errors, so buffer is reused by next batches
+	putBuffer(buf.buffer)
+	buf.buffer = nil
+	for _, ack := range buf.waiters {
+		ack <- err
+	}
+}
+
+// spoolBuffer save buffer to errors dir without sending, it is resent by recovery
+func (p *Proxy) spoolBuffer(key string, buf *Buffer) {
+	key = p.withToken(key, newBatchID())
+	err := p.saveToErrors(key, buf.buffer, 1, time.Now())
+	if err != nil {
+		p.log(LEVEL_ERR, "Save to errors error: ", hidePassword(key), " error: ", err)
+		p.log(LEVEL_ERR, "Batch is lost: ", hidePassword(key), " rows: ", buf.rowcount)
+		p.metrics.Increment(p.conf().GraphitePrefixCnt+".save_errors", 1)
+	} else {
+		err = &spooledError{errShutdown}
+	}
+	putBuffer(buf.buffer)
+	buf.buffer = nil
+	for _, ack := range buf.waiters {
+		ack <- err
+	}
+}
+
+// backgroundRecovery run continuously in background and try recovery errors
+func (p *Proxy) backgroundRecovery(ctx context.Context) {
+	for {
+		atomic.AddUint32(&p.errorsCheck, 1)
+		if err := p.checkErr(ctx); err != nil && err != context.Canceled {
+			p.log(LEVEL_ERR, "Recovery error: ", err)
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(time.Duration(p.conf().ResendInt) * time.Second):
+		}
+	}
+}
+
+func extractTable(key string) string {
+	table := "unknown"
+	lowkey := strings.ToLower(key)
+	if strings.Contains(lowkey, "insert%20into%20") {
+		from := strings.Index(lowkey, "insert%20into%20")
+		if from >= 0 {
+			from += len("insert%20into%20")
+			to := strings.Index(lowkey[from:], "%20")
+			if to > 0 {
+				table = lowkey[from:(to + from)]
+			}
+		}
+	}
+	if table == "unknown" {
+		if strings.Contains(lowkey, "insert+into+") {
+			from := strings.Index(lowkey, "insert+into+")
+			if from >= 0 {
+				from += len("insert+into+")
+				to := strings.Index(lowkey[from:], "+")
+				if to > 0 {
+					table = lowkey[from:(to + from)]
+				}
+			}
+		}
+	}
+	return table
+}
+
+// вырезаем из строки password=xxxxx для логов
+func hidePassword(str string) string {
+	replace := "password="
+	pos := strings.Index(str, replace)
+	if pos < 0 {
+		return str
+	}
+	pos2 := strings.Index(str[pos:], "&")
+	if pos2 < 0 {
+		return str[0:pos+len(replace)] + "*"
+	}
+	return str[0:pos+len(replace)] + "*" + str[pos+pos2:]
+}
+
+func (p *Proxy) saveToErrors(key string, val []byte, level int, at time.Time) error {
+	if err := p.reserveSpool(int64(len(key) + len(val))); err != nil {
+		return err
+	}
+	if err := p.diskFault(); err != nil {
+		p.spoolFailed()
+		return err
+	}
+	prefix := strconv.Itoa(level)
+	if level >= p.conf().table(extractTable(key)).maxerrors {
+		prefix = "O"
+	}
+	// batches are placed round-robin, next dir is tried if write fails
+	next := int(atomic.AddUint32(&p.spoolNext, 1))
+	var err error
+	for i := range p.errorsDirs {
+		dir := p.errorsDirs[(next+i)%len(p.errorsDirs)]
+		db := fmt.Sprintf("%s/%s%d", dir, prefix, at.UnixNano())
+		err = pudge.Set(db, key, val)
+		if cerr := pudge.Close(db); err == nil {
+			err = cerr
+		}
+		if err == nil {
+			p.spooled(db)
+			return nil
+		}
+		p.log(LEVEL_ERR, "Errors dir write error: ", dir, " error: ", err)
+	}
+	p.spoolFailed()
+	return err
+}
+
+// requeue put batch failed to save back to store, so it is sent with next batches
+// key keep token of the batch, so it is not merged with others
+func (p *Proxy) requeue(key string, val []byte, rowcount int) {
+	tc := p.conf().table(extractTable(key))
+	if full := p.store.put(key, append([]byte(nil), val...), nil, rowcount, tc, nil); full != nil {
+		// sender of the batch hold a flush worker, so free one is taken in background
+		p.flushing.Add(1)
+		go func() {
+			p.flushes <- struct{}{}
+			p.flushWorker(key, full)
+		}()
+	}
+}
+
+//sender
+// send forward batch, retry it by table policy and save to errors on failure
+// at is a time of batch, it is kept in errors dir for maxage
+// batch is transformed on every attempt, so it is saved to errors as is and transformed on resend
+// error of the batch saved to errors or requeued is spooledError
+func (p *Proxy) send(key string, val []byte, rowcount int, level int, at time.Time) (err error) {
+	defer p.handlePanic("send()")
+	tc := p.conf().table(extractTable(key))
+	for attempt := 0; ; attempt++ {
+		k, body, terr := p.transform(key, val, tc)
+		if err = terr; err == nil {
+			err = p.sendOnce(k, body, rowcount, tc)
+		}
+		if err == nil || attempt >= tc.retries {
+			break
+		}
+		select {
+		case <-time.After(time.Duration(tc.retrywait) * time.Second):
+			continue
+		case <-p.sends.Done():
+		}
+		break
+	}
+	if err != nil && len(val) > 0 {
+		if serr := p.saveToErrors(key, val, level+1, at); serr != nil {
+			cfg := p.conf()
+			if serr == errSpoolFull && cfg.SpoolFull != spoolReject {
+				p.log(LEVEL_ERR, "Errors dir is full, batch is dropped: ", hidePassword(key), " rows: ", rowcount)
+				p.metrics.Increment(cfg.GraphitePrefixCnt+".spool_dropped", 1)
+				p.metrics.Increment(cfg.GraphitePrefixCnt+".spool_dropped_rows", rowcount)
+				return
+			}
+			p.log(LEVEL_ERR, "Save to errors error: ", hidePassword(key), " error: ", serr)
+			p.metrics.Increment(cfg.GraphitePrefixCnt+".save_errors", 1)
+			p.requeue(key, val, rowcount)
+		}
+		err = &spooledError{err}
+	}
+	return
+}
+
+// transform apply transform chain of table to batch, failed batch is not sent,
+// as columns of clickhouse table don't match it, table structure may be unavailable with clickhouse
+func (p *Proxy) transform(key string, val []byte, tc tableConfig) (string, []byte, error) {
+	if tc.transform == nil {
+		return key, val, nil
+	}
+	k, body, err := tc.transform.apply(key, val, p.tableColumns)
+	if err != nil {
+		cnt := p.conf().GraphitePrefixCnt
+		p.log(LEVEL_ERR, "Transform error: ", hidePassword(key), " error: ", err)
+		p.metrics.Increment(cnt+".transform_errors", 1)
+		p.metrics.Increment(cnt+".bytable."+extractTable(key)+".transform_errors", 1)
+	}
+	return k, body, err
+}
+
+func (p *Proxy) sendOnce(key string, val []byte, rowcount int, tc tableConfig) (err error) {
+	start := time.Now()
+	cfg := p.conf()
+	cnt := cfg.GraphitePrefixCnt
+	if cfg.IsDebug {
+		fmt.Printf("time:%s\tkey:%s\tval:%s\n", time.Now(), key, val)
+	}
+	//send
+	table := extractTable(key)
+	if tc.rename != "" {
+		key = renameTable(key, tc.rename)
+	}
+	if tc.native {
+		err = p.sendNative(key, val)
+		if _, ok := err.(nativeFormatError); !ok {
+			p.sentMetrics(table, rowcount, len(val))
+			p.durationMetrics(len(val), start)
+			if err != nil {
+				p.log(LEVEL_ERR, "Native request error: ", hidePassword(key), " error: ", err)
+				p.chErrors(table)
+			}
+			return
+		}
+		p.log(LEVEL_WARN, "Native request fallback to http: ", hidePassword(key), " error: ", err)
+	}
+	uri := key
+	if strings.HasPrefix(uri, "/") {
+		uri = tc.fwd + uri
+	} else {
+		uri = strings.Replace(uri, cfg.Repl, tc.fwd, 1)
+	}
+	body, encoding := val, tc.compress
+	if encoding != "" {
+		body, err = compress(encoding, val)
+		if err != nil {
+			// send as is
+			p.log(LEVEL_ERR, "Compress error: ", err)
+			body, encoding = val, ""
+		} else if !strings.Contains(uri, "enable_http_compression=") {
+			uri += "&enable_http_compression=1"
+		}
+	}
+	rd := newBatchReader(body)
+	defer rd.Close()
+	req, err := http.NewRequestWithContext(p.sends, "POST", uri /*fmt.Sprintf("%s%s", *fwd, key)*/, rd)
+	if err == nil {
+		req.ContentLength = int64(len(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+	}
+
+	bytes := len(val)
+	compressed := len(body)
+
+	p.sentMetrics(table, rowcount, bytes)
+	if encoding != "" {
+		p.metrics.Increment(cnt+".bytes_sent_compressed", compressed)
+		p.metrics.Increment(cnt+".byhost."+hostname+".bytes_sent_compressed", compressed)
+		p.metrics.Increment(cnt+".bytable."+table+".bytes_sent_compressed", compressed)
+	}
+
+	if err != nil {
+		p.chErrors(table)
+		p.log(LEVEL_ERR, "Create request error: ", hidePassword(uri), " error: ", err)
+		return
+	}
+	resp, err := p.do(req)
+	defer func() {
+		if resp != nil {
+			resp.Body.Close()
+		}
+	}()
+	if err == nil && resp.StatusCode != 200 {
+		bodyResp, _ := ioutil.ReadAll(resp.Body)
+		err = &chError{status: resp.StatusCode, text: string(bodyResp)}
+	}
+	p.durationMetrics(bytes, start)
+	if err != nil {
+		p.log(LEVEL_ERR, "Request error: ", hidePassword(uri), " error: ", err)
+		p.chErrors(table)
+		return
+	}
+	return
+}
+
+// renameTable replace insert table in query param of key
+func renameTable(key, table string) string {
+	query, ok := keyQuery(key)
+	if !ok {
+		return key
+	}
+	return setQuery(key, renameQuery(query, table))
+}
+
+// renameQuery replace table of insert query
+func renameQuery(query, table string) string {
+	m := insertRe.FindStringSubmatchIndex(query)
+	if m == nil {
+		return query
+	}
+	end := m[3]
+	if m[4] >= 0 {
+		end = m[5]
+	}
+	return query[:m[2]] + table + query[end:]
+}
+
+// keyQuery return unescaped query param of key
+func keyQuery(key string) (string, bool) {
+	pos := strings.IndexByte(key, '?')
+	if pos < 0 {
+		return "", false
+	}
+	for _, param := range strings.Split(key[pos+1:], "&") {
+		if strings.HasPrefix(param, "query=") {
+			query, err := url.QueryUnescape(param[len("query="):])
+			return query, err == nil
+		}
+	}
+	return "", false
+}
+
+// setQuery replace query param of key, escaped as http clients do
+func setQuery(key, query string) string {
+	pos := strings.IndexByte(key, '?')
+	if pos < 0 {
+		return key
+	}
+	params := strings.Split(key[pos+1:], "&")
+	for i, param := range params {
+		if strings.HasPrefix(param, "query=") {
+			params[i] = "query=" + strings.ReplaceAll(url.QueryEscape(query), "+", "%20")
+			return key[:pos+1] + strings.Join(params, "&")
+		}
+	}
+	return key
+}
+
+func (p *Proxy) sentMetrics(table string, rowcount, bytes int) {
+	cnt, avg := p.conf().GraphitePrefixCnt, p.conf().GraphitePrefixAvg
+	p.metrics.Increment(cnt+".rows_sent", rowcount)
+	p.metrics.Increment(cnt+".requests_sent", 1)
+	p.metrics.Increment(cnt+".byhost."+hostname+".rows_sent", rowcount)
+	p.metrics.Increment(cnt+".byhost."+hostname+".requests_sent", 1)
+	p.metrics.Increment(cnt+".bytable."+table+".rows_sent", rowcount)
+	p.metrics.Increment(cnt+".bytable."+table+".requests_sent", 1)
+	p.metrics.Increment(cnt+".bytes_sent", bytes)
+	p.metrics.Increment(cnt+".byhost."+hostname+".bytes_sent", bytes)
+	p.metrics.Increment(cnt+".bytable."+table+".bytes_sent", bytes)
+	p.metrics.Increment(avg+".bytes_sent", bytes)
+	p.metrics.Increment(avg+".byhost."+hostname+".bytes_sent", bytes)
+	p.metrics.Increment(avg+".bytable."+table+".bytes_sent", bytes)
+}
+
+func (p *Proxy) durationMetrics(bytes int, start time.Time) {
+	avg := p.conf().GraphitePrefixAvg
+	sendDuration := time.Since(start).Milliseconds()
+	p.metrics.Increment("bytesSent", bytes)
+	p.metrics.Increment("sendDuration", int(sendDuration))
+	p.metrics.Increment(avg+".byhost."+hostname+".send_duration", int(sendDuration))
+}
+
+func (p *Proxy) chErrors(table string) {
+	cnt := p.conf().GraphitePrefixCnt
+	p.metrics.Increment(cnt+".ch_errors", 1)
+	p.metrics.Increment(cnt+".byhost."+hostname+".ch_errors", 1)
+	p.metrics.Increment(cnt+".bytable."+table+".ch_errors", 1)
+}
+
+// checkErr resend batches of errors dir by recovery workers, batches of one table are merged,
+// it is stopped between batches on cancel and files are resent on next run, clickhouse skip sent batches by token
+func (p *Proxy) checkErr(ctx context.Context) (err error) {
+	p.recovery.round.Lock()
+	defer p.recovery.round.Unlock()
+	list, err := p.spoolList()
+	if err != nil {
+		return err
+	}
+	sort.Sort(sort.StringSlice(list))
+	sizes := make([]int64, len(list))
+	for i, file := range list {
+		sizes[i] = fileSize(p.spoolPath(file))
+	}
+	p.recovery.start(sizes)
+	defer p.recovery.start(nil)
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	var once sync.Once
+	// round is stopped on first error
+	stop := func(ferr error) {
+		once.Do(func() { err = ferr })
+		cancel()
+	}
+	var wg sync.WaitGroup
+	batches := make(chan *spoolBatch)
+	for w := 0; w < p.conf().RecoveryWorkers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for b := range batches {
+				if ferr := p.resend(ctx, b); ferr != nil {
+					stop(ferr)
+				}
+			}
+		}()
+	}
+	if ferr := p.mergeSpool(ctx, list, sizes, batches); ferr != nil {
+		stop(ferr)
+	}
+	close(batches)
+	wg.Wait()
+	return
+}
+
+// readSpool return batch of errors dir file, key is empty if file is missed
+func (p *Proxy) readSpool(file string) (string, []byte, error) {
+	// file may be dropped by spool quota
+	path := p.spoolPath(file)
+	if _, err := os.Stat(path); err != nil {
+		return "", nil, nil
+	}
+	db, err := pudge.Open(path, nil)
+	p.log(LEVEL_ERR, "Proccessing error:", file)
+	if err != nil {
+		return "", nil, err
+	}
+	defer db.Close()
+	keys, err := db.Keys(nil, 0, 0, true)
+	if err != nil || len(keys) == 0 {
+		return "", nil, err
+	}
+	// file keep one batch
+	var val []byte
+	if err = db.Get(keys[0], &val); err != nil {
+		return "", nil, err
+	}
+	return string(keys[0]), val, nil
+}
+
+// resend send batch of errors dir files, files are removed after send, failed batch is saved again
+func (p *Proxy) resend(ctx context.Context, b *spoolBatch) (err error) {
+	resent := false
+	defer func() { p.release(b, resent) }()
+	// batch spooled without token get stable one from file name
+	key := p.withToken(b.key, b.files[0]+"-0")
+	if len(b.files) > 1 {
+		// merged batch get token of its files, so it is skipped if the round is repeated
+		key = p.withToken(b.group, mergedToken(b.tokens))
+	}
+	rows, size := b.buf.rowcount, len(b.buf.buffer)
+	if err = p.throttle(ctx, rows, size); err != nil {
+		return err
+	}
+	p.send(key, b.buf.buffer, rows, b.level, b.at)
+	cnt := p.conf().GraphitePrefixCnt
+	p.metrics.Increment(cnt+".recovery_batches", 1)
+	p.metrics.Increment(cnt+".recovery_rows", rows)
+	p.metrics.Increment(cnt+".recovery_bytes", size)
+	if len(b.files) > 1 {
+		p.metrics.Increment(cnt+".recovery_merged", len(b.files))
+	}
+	for _, file := range b.files {
+		if err = p.unspool(file); err != nil {
+			return err
+		}
+	}
+	resent = true
+	return nil
+}
+
+func (p *Proxy) filePathWalkDir(root string) ([]string, error) {
+	var files []string
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			p.log(LEVEL_ERR, "dirwalk error ", err)
+			return err
+		}
+		filename := filepath.Base(path)
+		if !info.IsDir() && !strings.HasSuffix(filename, ".idx") && !strings.HasPrefix(filename, "O") && !strings.HasPrefix(filename, "E") && !strings.HasPrefix(filename, ".") {
+			files = append(files, filename)
+
+		}
+		return nil
+	})
+	return files, err
+}
+
+func (p *Proxy) handlePanic(from string) {
+	if r := recover(); r != nil {
+		p.log(LEVEL_ERR, "Recovering from panic:", r, " from:", from)
+	}
+}
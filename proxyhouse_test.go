@@ -0,0 +1,238 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tidwall/lotsa"
+)
+
+func Test_Slice(t *testing.T) {
+	delim := ","
+	slices := bytes.Split([]byte(",(7499),(9999)"), []byte(delim))
+	fmt.Println(len(slices))
+}
+
+// go test -timeout 50s github.com/recoilme/proxyhouse -run Test_Base
+func Test_Base(t *testing.T) {
+	log.SetOutput(ioutil.Discard) //disable log message on test
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ch.URL })
+	ts := httptest.NewServer(p.Handler())
+	defer ts.Close()
+	fmt.Println("Hello, test")
+
+	lotsa.Output = os.Stdout
+	lotsa.MemUsage = true
+
+	println("-- bulk --")
+	N := 10000
+	fmt.Printf("\n")
+	fmt.Printf("go version %s %s/%s\n", runtime.Version(), runtime.GOOS, runtime.GOARCH)
+	fmt.Printf("\n")
+	fmt.Printf("     number of cpus: %d\n", runtime.NumCPU())
+	fmt.Printf("     number of inserts: %d\n", N)
+	lotsa.Ops(N, runtime.NumCPU(), func(i, _ int) {
+		post(ts.URL, fmt.Sprintf("(%d)", i))
+	})
+	println("done")
+	for req, buf := range p.store.buffers() {
+		slices := bytes.Split(buf.buffer, []byte(","))
+		fmt.Printf("store:\n\nuri:%s\nbody:%d\n", req, len(slices))
+	}
+	for key, buf := range p.store.drain() {
+		p.flush(key, buf)
+	}
+	if rows := ch.rowCount(); rows != N {
+		t.Errorf("want %d rows in clickhouse; got %d", N, rows)
+	}
+}
+
+func post(addr, b string) {
+	bod := strings.NewReader(b)
+	req, err := http.NewRequest("POST", addr+"/?query=INSERT%20INTO%20t%20VALUES", bod)
+	if err != nil {
+		panic(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		panic(err)
+	}
+	defer resp.Body.Close()
+	_, err = ioutil.ReadAll(resp.Body)
+
+	if err != nil {
+		panic(err)
+	}
+}
+
+func TestRenameTable(t *testing.T) {
+	tests := map[string]string{
+		"/?query=INSERT%20INTO%20logs_1%20VALUES":                       "/?query=INSERT%20INTO%20db.logs%20VALUES",
+		"/?user=u&query=INSERT%20INTO%20db.logs_1%20(a)%20FORMAT%20TSV": "/?user=u&query=INSERT%20INTO%20db.logs%20%28a%29%20FORMAT%20TSV",
+		"?query=insert+into+%60db%60.%60logs_1%60+VALUES":               "?query=insert%20into%20db.logs%20VALUES",
+		"/?query=SELECT%201": "/?query=SELECT%201",
+	}
+	for key, want := range tests {
+		if got := renameTable(key, "db.logs"); got != want {
+			t.Errorf("%s: want %s; got %s", key, want, got)
+		}
+	}
+}
+
+func TestSendRetries(t *testing.T) {
+	var calls int32
+	var gotQuery string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if atomic.AddInt32(&calls, 1) < 3 {
+			http.Error(w, "Code: 252. DB::Exception: Too many parts", http.StatusInternalServerError)
+			return
+		}
+		gotQuery = r.URL.Query().Get("query")
+	}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) {
+		c.Rules = []*Rule{{Match: "logs_*", TableConfig: TableConfig{Fwd: ts.URL, Retries: 2, Rename: "logs"}}}
+	})
+
+	if err := p.send("/?query=INSERT%20INTO%20logs_1%20VALUES", []byte("(1)"), 1, 0, time.Now()); err != nil {
+		t.Fatal(err)
+	}
+	if calls != 3 || gotQuery != "INSERT INTO logs VALUES" {
+		t.Errorf("want 3 calls and renamed query; got %d '%s'", calls, gotQuery)
+	}
+}
+
+func TestAppendMaxRows(t *testing.T) {
+	rows := make(chan string, 1)
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := ioutil.ReadAll(r.Body)
+		rows <- string(body)
+	}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) {
+		c.Rules = []*Rule{{Match: "big", TableConfig: TableConfig{Fwd: ts.URL, MaxRows: 3, SyncSec: 60}}}
+	})
+	key := "/?query=INSERT%20INTO%20big%20VALUES"
+	p.Append(key, "INSERT INTO big VALUES", []byte("(1),(2)"))
+	p.Append(key, "INSERT INTO big VALUES", []byte("(3)"))
+	select {
+	case got := <-rows:
+		if got != "(1),(2),(3)" {
+			t.Errorf("want full batch; got '%s'", got)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("full batch is not sent")
+	}
+	if p.store.peek(key) != nil {
+		t.Error("want full batch removed from store")
+	}
+}
+
+// retried batch of a table don't hold batches of other tables
+func TestFlushWorkers(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) {
+		c.Fwd, c.SyncSec, c.FlushWorkers = ch.URL, 1, 2
+		c.Rules = []*Rule{{Match: "slow", TableConfig: TableConfig{Retries: 3, RetryWait: 1}}}
+	})
+	ch.failTable("slow", chFailure{status: http.StatusInternalServerError, code: 252, text: "Too many parts"})
+	p.Append("/?query=INSERT%20INTO%20slow%20VALUES", "", []byte("(1)"))
+	p.Append("/?query=INSERT%20INTO%20fast%20VALUES", "", []byte("(2)"))
+	ctx, cancel := context.WithCancel(context.Background())
+	p.background(ctx, p.backgroundSender)
+	if inserts := ch.waitRows(t, 1, 2500*time.Millisecond); inserts[0].body != "(2)" {
+		t.Errorf("want fast batch sent first; got %+v", inserts)
+	}
+	ch.failTable("slow", chFailure{})
+	cancel()
+	// shutdown wait for retried batch
+	p.Shutdown(context.Background())
+	if ch.rowCount() != 2 {
+		t.Errorf("want retried batch sent; got %d rows", ch.rowCount())
+	}
+}
+
+// full requeued batch wait for a flush worker
+func TestRequeueWorkers(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) {
+		c.Fwd, c.FlushWorkers = ch.URL, 1
+		c.Rules = []*Rule{{Match: "t", TableConfig: TableConfig{MaxRows: 1}}}
+	})
+	// worker is busy
+	p.flushes <- struct{}{}
+	p.requeue("/?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1)
+	time.Sleep(50 * time.Millisecond)
+	if _, requests := ch.received(); requests != 0 {
+		t.Fatalf("want requeued batch wait for worker; got %d requests", requests)
+	}
+	<-p.flushes
+	p.flushing.Wait()
+	if ch.rowCount() != 1 {
+		t.Errorf("want requeued batch sent; got %d rows", ch.rowCount())
+	}
+}
+
+func TestStoreDue(t *testing.T) {
+	p := newTestProxy(t, func(c *Config) {
+		c.Rules = []*Rule{{Match: "slow", TableConfig: TableConfig{SyncSec: 60}}}
+	})
+	s := p.store
+	now := time.Now()
+	s.due(now, nil)
+	p.Append("/?query=INSERT%20INTO%20fast%20VALUES", "", []byte("(1)"))
+	p.Append("/?query=INSERT%20INTO%20slow%20VALUES", "", []byte("(1)"))
+	interval := time.Duration(p.conf().SyncSec) * time.Second
+	if got := s.due(now.Add(interval-time.Millisecond), nil); len(got) != 0 {
+		t.Errorf("want no buffers before syncsec; got %d", len(got))
+	}
+	if got := s.due(now.Add(interval), nil); len(got) != 1 || got["/?query=INSERT%20INTO%20fast%20VALUES"] == nil {
+		t.Errorf("want fast buffer after syncsec; got %v", got)
+	}
+	if got := s.due(now.Add(time.Minute), nil); len(got) != 1 || got["/?query=INSERT%20INTO%20slow%20VALUES"] == nil {
+		t.Errorf("want slow buffer after rule syncsec; got %v", got)
+	}
+}
+
+// peek return buffer by key, tests check it when nothing else appends
+func (store *Store) peek(key string) *Buffer {
+	sh := store.shard(key)
+	sh.Lock()
+	defer sh.Unlock()
+	return sh.Req[key]
+}
+
+// drop remove buffers by keys
+func (store *Store) drop(keys ...string) {
+	for _, key := range keys {
+		sh := store.shard(key)
+		sh.Lock()
+		delete(sh.Req, key)
+		sh.Unlock()
+	}
+}
+
+// buffers return all buffers by keys
+func (store *Store) buffers() map[string]*Buffer {
+	res := make(map[string]*Buffer)
+	for _, sh := range store.shards {
+		sh.Lock()
+		for key, buf := range sh.Req {
+			res[key] = buf
+		}
+		sh.Unlock()
+	}
+	return res
+}
@@ -0,0 +1,293 @@
+package proxyhouse
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// recovery scheduler: batches of errors dir are resent with limited rate and concurrency,
+// live flushes go first, so clickhouse back after outage is not flooded by backlog
+
+// priorities of recovery
+const (
+	recoveryLive  = "live"  // recovery wait while live batches are sent
+	recoveryEqual = "equal" // recovery and live batches are sent together
+)
+
+func validateRecoveryPriority(priority string) error {
+	if priority == recoveryLive || priority == recoveryEqual {
+		return nil
+	}
+	return errors.New("must be live or equal")
+}
+
+// rateLimiter pace events to rate per second
+type rateLimiter struct {
+	mu   sync.Mutex
+	next time.Time
+}
+
+// wait block until n events fit into rate, rate 0 is no limit
+func (l *rateLimiter) wait(ctx context.Context, rate, n int) error {
+	if rate <= 0 {
+		return nil
+	}
+	l.mu.Lock()
+	now := time.Now()
+	if l.next.Before(now) {
+		l.next = now
+	}
+	at := l.next
+	l.next = l.next.Add(time.Duration(float64(n) / float64(rate) * float64(time.Second)))
+	l.mu.Unlock()
+	wait := time.Until(at)
+	if wait <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// recovery keep limiters and backlog of current recovery round
+type recovery struct {
+	batches, rows, bytes rateLimiter
+
+	round sync.Mutex // rounds don't overlap, so files are not resent twice
+
+	mu      sync.Mutex
+	files   int   // backlog files left
+	backlog int64 // backlog bytes left
+	drained int64 // bytes resent in round
+	started time.Time
+}
+
+// start begin recovery round of files with sizes
+func (r *recovery) start(sizes []int64) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files, r.backlog, r.drained, r.started = len(sizes), 0, 0, time.Now()
+	for _, size := range sizes {
+		r.backlog += size
+	}
+}
+
+// done remove resent, expired or failed files from backlog
+func (r *recovery) done(files int, size int64, resent bool) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.files -= files
+	r.backlog -= size
+	if resent {
+		r.drained += size
+	}
+}
+
+// eta return backlog files and bytes and estimated time to drain it by rate of the round,
+// eta is negative if nothing is resent yet
+func (r *recovery) eta() (int, int64, time.Duration) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.files <= 0 {
+		return 0, 0, 0
+	}
+	elapsed := time.Since(r.started)
+	if r.drained == 0 || elapsed <= 0 {
+		return r.files, r.backlog, -1
+	}
+	rate := float64(r.drained) / elapsed.Seconds()
+	return r.files, r.backlog, time.Duration(float64(r.backlog) / rate * float64(time.Second))
+}
+
+// throttle wait for live flushes by priority and for rate limits of config
+func (p *Proxy) throttle(ctx context.Context, rows, bytes int) error {
+	cfg := p.conf()
+	if cfg.RecoveryPriority == recoveryLive {
+		for atomic.LoadInt32(&p.liveFlushes) > 0 {
+			select {
+			case <-ctx.Done():
+				return ctx.Err()
+			case <-time.After(10 * time.Millisecond):
+			}
+		}
+	}
+	r := p.recovery
+	if err := r.batches.wait(ctx, cfg.RecoveryBatches, 1); err != nil {
+		return err
+	}
+	if err := r.rows.wait(ctx, cfg.RecoveryRows, rows); err != nil {
+		return err
+	}
+	return r.bytes.wait(ctx, cfg.RecoveryBytes, bytes)
+}
+
+// recoveryMetrics send backlog gauges, called before counters are sent to graphite
+func (p *Proxy) recoveryMetrics() {
+	files, backlog, eta := p.recovery.eta()
+	if files == 0 {
+		return
+	}
+	cnt := p.conf().GraphitePrefixCnt
+	p.metrics.Increment(cnt+".recovery_backlog_files", files)
+	p.metrics.Increment(cnt+".recovery_backlog_bytes", int(backlog))
+	if eta >= 0 {
+		p.metrics.Increment(cnt+".recovery_eta_seconds", int(eta.Seconds()))
+	}
+}
+
+// spoolBatch is a batch of errors dir files, batches of one key are merged, so clickhouse get less parts
+type spoolBatch struct {
+	key    string   // key of first file
+	group  string   // key without token, batches of a group are merged
+	tokens []string // token of every file, file name if file has no token
+	files  []string
+	size   int64     // size of files
+	level  int       // max resend level of files
+	at     time.Time // oldest batch time, so maxage is not extended by merge
+	buf    *Buffer
+}
+
+// add merge files of batch m into b
+func (b *spoolBatch) add(m *spoolBatch) {
+	b.files = append(b.files, m.files...)
+	b.tokens = append(b.tokens, m.tokens...)
+	b.size += m.size
+	if m.level > b.level {
+		b.level = m.level
+	}
+	if m.at.Before(b.at) {
+		b.at = m.at
+	}
+}
+
+// mergeSpool read errors dir files in order and pass batches to recovery workers,
+// batches of one key are merged as inserts into store, up to recoverymerge bytes or table limits,
+// tokens are dropped from keys, merged batch get token derived from them in resend
+func (p *Proxy) mergeSpool(ctx context.Context, list []string, sizes []int64, out chan<- *spoolBatch) (err error) {
+	limit := p.conf().RecoveryMerge
+	merging := newStore(1)
+	pending := make(map[string]*spoolBatch)
+	defer func() {
+		// batches not passed are resent on next run
+		for _, b := range pending {
+			p.release(b, false)
+		}
+	}()
+	for i, file := range list {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+		b := &spoolBatch{files: []string{file}, size: sizes[i], at: spoolTime(file)}
+		p.setBusy(file, true)
+		level, perr := strconv.Atoi(file[0:1])
+		if perr != nil {
+			// if filename first symbol not digit skip
+			p.release(b, false)
+			continue
+		}
+		key, val, rerr := p.readSpool(file)
+		if rerr != nil || key == "" {
+			p.release(b, false)
+			if rerr != nil {
+				return rerr
+			}
+			continue
+		}
+		b.key, b.level = key, level
+		tc := p.conf().table(extractTable(key))
+		if tc.maxage > 0 && time.Since(b.at) > time.Duration(tc.maxage)*time.Second {
+			p.expired(key, time.Since(b.at))
+			err = p.expireSpool(file)
+			p.release(b, false)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+		query, ok := keyQuery(key)
+		rows := countRows(query, val)
+		if limit == 0 || !ok {
+			b.buf = &Buffer{rowcount: rows, buffer: val}
+			if err = p.dispatch(ctx, out, b); err != nil {
+				return err
+			}
+			continue
+		}
+		b.group = dropParam(key, tokenParam)
+		b.tokens = []string{file}
+		if token := paramValue(key, tokenParam); token != "" {
+			b.tokens[0] = token
+		}
+		if m, ok := pending[b.group]; ok {
+			m.add(b)
+		} else {
+			pending[b.group] = b
+		}
+		mtc := tc
+		if mtc.maxbytes == 0 || mtc.maxbytes > limit {
+			mtc.maxbytes = limit
+		}
+		if full := merging.put(b.group, val, delimiter(query, tc), rows, mtc, nil); full != nil {
+			m := pending[b.group]
+			delete(pending, b.group)
+			m.buf = full
+			if err = p.dispatch(ctx, out, m); err != nil {
+				return err
+			}
+		}
+	}
+	var rest []*spoolBatch
+	for key, buf := range merging.drain() {
+		pending[key].buf = buf
+		rest = append(rest, pending[key])
+	}
+	sort.Slice(rest, func(i, j int) bool { return rest[i].files[0] < rest[j].files[0] })
+	for _, b := range rest {
+		delete(pending, b.group)
+		if err = p.dispatch(ctx, out, b); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// mergedToken return token of merged batch from tokens of its files,
+// so merge of the same files repeated after failure is skipped by clickhouse
+func mergedToken(tokens []string) string {
+	sorted := append([]string(nil), tokens...)
+	sort.Strings(sorted)
+	h := sha256.Sum256([]byte(strings.Join(sorted, "\n")))
+	return "merged-" + hex.EncodeToString(h[:16])
+}
+
+// dispatch pass batch to recovery workers, batch is released if round is stopped
+func (p *Proxy) dispatch(ctx context.Context, out chan<- *spoolBatch, b *spoolBatch) error {
+	select {
+	case out <- b:
+		return nil
+	case <-ctx.Done():
+		p.release(b, false)
+		return ctx.Err()
+	}
+}
+
+// release unmark files of batch and remove them from backlog
+func (p *Proxy) release(b *spoolBatch, resent bool) {
+	for _, file := range b.files {
+		p.setBusy(file, false)
+	}
+	p.recovery.done(len(b.files), b.size, resent)
+}
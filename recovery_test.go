@@ -0,0 +1,245 @@
+package proxyhouse
+
+import (
+	"context"
+	"net/http"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var l rateLimiter
+	ctx := context.Background()
+	start := time.Now()
+	// 10 events per second: first 5 pass now, next wait for 0.5s
+	if err := l.wait(ctx, 10, 5); err != nil {
+		t.Fatal(err)
+	}
+	if err := l.wait(ctx, 10, 1); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 450*time.Millisecond || elapsed > 2*time.Second {
+		t.Errorf("want wait for 0.5s; got %s", elapsed)
+	}
+	// no limit
+	start = time.Now()
+	if err := l.wait(ctx, 0, 1000); err != nil || time.Since(start) > 100*time.Millisecond {
+		t.Errorf("want no wait; got %s %v", time.Since(start), err)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if err := l.wait(ctx, 1, 10); err != context.Canceled {
+		t.Errorf("want wait canceled; got %v", err)
+	}
+}
+
+func TestRecoveryEta(t *testing.T) {
+	r := &recovery{}
+	r.start([]int64{100, 100, 200})
+	if files, backlog, eta := r.eta(); files != 3 || backlog != 400 || eta != -1 {
+		t.Errorf("want unknown eta before resend; got %d %d %s", files, backlog, eta)
+	}
+	r.started = time.Now().Add(-time.Second)
+	r.done(1, 100, true)
+	r.done(1, 100, false)
+	files, backlog, eta := r.eta()
+	if files != 1 || backlog != 200 || eta < 1500*time.Millisecond || eta > 2500*time.Millisecond {
+		t.Errorf("want 200 bytes by 100 bytes/s; got %d %d %s", files, backlog, eta)
+	}
+	r.done(1, 200, true)
+	if files, _, eta = r.eta(); files != 0 || eta != 0 {
+		t.Errorf("want backlog drained; got %d %s", files, eta)
+	}
+}
+
+// recovery wait while live batches are sent
+func TestRecoveryLivePriority(t *testing.T) {
+	for _, priority := range []string{recoveryLive, recoveryEqual} {
+		p := newTestProxy(t, func(c *Config) { c.RecoveryPriority, c.RecoveryBatches = priority, 0 })
+		atomic.AddInt32(&p.liveFlushes, 1)
+		go func() {
+			time.Sleep(200 * time.Millisecond)
+			atomic.AddInt32(&p.liveFlushes, -1)
+		}()
+		start := time.Now()
+		if err := p.throttle(context.Background(), 1, 1); err != nil {
+			t.Fatal(err)
+		}
+		waited := time.Since(start) >= 150*time.Millisecond
+		if waited != (priority == recoveryLive) {
+			t.Errorf("%s: want wait for live batches %v; got %s", priority, priority == recoveryLive, time.Since(start))
+		}
+	}
+}
+
+func TestRecoveryWorkers(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) {
+		c.Fwd = ch.URL
+		c.RecoveryBatches, c.RecoveryRows, c.RecoveryWorkers, c.RecoveryMerge = 0, 20, 4, 0
+	})
+	hourAgo := time.Now().Add(-time.Hour)
+	for i := 0; i < 4; i++ {
+		if err := p.saveToErrors("/?query=INSERT%20INTO%20t%20VALUES", []byte("(1),(2),(3),(4),(5)"), 1, hourAgo.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.scanSpool(); err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now()
+	if err := p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	// 20 rows by 20 rows/s: first batch pass now, the rest wait for 0.75s
+	if elapsed := time.Since(start); elapsed < 600*time.Millisecond || elapsed > 3*time.Second {
+		t.Errorf("want resend paced by rows; got %s", elapsed)
+	}
+	inserts, _ := ch.received()
+	if len(inserts) != 4 || ch.rowCount() != 20 {
+		t.Fatalf("want all batches resent; got %d inserts %d rows", len(inserts), ch.rowCount())
+	}
+	if counter(p, ".recovery_batches") != 4 || counter(p, ".recovery_rows") != 20 {
+		t.Errorf("want recovery metrics; got %d %d", counter(p, ".recovery_batches"), counter(p, ".recovery_rows"))
+	}
+	if files := spooled(t, p.errorsDirs[0]); len(files) != 0 {
+		t.Errorf("want errors dir drained; got %v", files)
+	}
+	if files, _, _ := p.recovery.eta(); files != 0 {
+		t.Errorf("want no backlog; got %d", files)
+	}
+}
+
+// concurrent rounds don't resend file twice
+func TestRecoveryRounds(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	ch.setLatency(20 * time.Millisecond)
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ch.URL; c.RecoveryBatches, c.RecoveryMerge = 0, 0 })
+	for i := 0; i < 4; i++ {
+		if err := p.saveToErrors("/?query=INSERT%20INTO%20t%20VALUES", []byte("(1)"), 1, time.Now()); err != nil {
+			t.Fatal(err)
+		}
+	}
+	errs := make(chan error, 2)
+	for i := 0; i < 2; i++ {
+		go func() { errs <- p.checkErr(context.Background()) }()
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if ch.rowCount() != 4 {
+		t.Errorf("want every file resent once; got %d rows", ch.rowCount())
+	}
+}
+
+func TestRecoveryMerge(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ch.URL; c.RecoveryBatches, c.RecoveryMerge = 0, 12 })
+	// batches are merged up to 12 bytes, single batch keep its token
+	values := "/?query=INSERT%20INTO%20t%20VALUES"
+	hourAgo := time.Now().Add(-time.Hour)
+	for i, b := range []struct{ key, body string }{
+		{values, "(1),(2)"},
+		{values, "(3),(4)"},
+		{"/?query=INSERT%20INTO%20t%20FORMAT%20TSV", "5\n"},
+		{values + "&insert_deduplication_token=c", "(6),(7)"},
+	} {
+		if err := p.saveToErrors(b.key, []byte(b.body), 1+i%2, hourAgo.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := p.scanSpool(); err != nil {
+		t.Fatal(err)
+	}
+	files, _ := p.spoolFiles()
+	// merged batch fail and it is saved as one
+	ch.failNext(chFailure{status: http.StatusServiceUnavailable, code: 242, text: "Table is in readonly mode"})
+	if err := p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	inserts, requests := ch.received()
+	if requests != 3 || len(inserts) != 2 {
+		t.Fatalf("want merged batch failed, TSV and last batch sent; got %d requests %+v", requests, inserts)
+	}
+	for _, in := range inserts {
+		if in.body != "5\n" && (in.body != "(6),(7)" || in.token != "c") {
+			t.Errorf("want batch over merge limit sent with its token; got %+v", in)
+		}
+	}
+	spool, _ := p.spoolFiles()
+	if len(spool) != 1 || spool[0].name[0] != '3' || spool[0].at != files[0].at {
+		t.Fatalf("want merged batch spooled with max level and oldest time; got %+v", spool)
+	}
+	if body := spooledBody(t, p.spoolPath(spool[0].name)); body != "(1),(2),(3),(4)" {
+		t.Errorf("want merged batch; got %s", body)
+	}
+	if counter(p, ".recovery_merged") != 2 || counter(p, ".recovery_batches") != 3 {
+		t.Errorf("want merge metrics; got %d %d", counter(p, ".recovery_merged"), counter(p, ".recovery_batches"))
+	}
+
+	// merged batch keep its token
+	if err := p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	inserts, _ = ch.received()
+	want := mergedToken([]string{files[0].name, files[1].name})
+	if len(inserts) != 3 || inserts[2].body != "(1),(2),(3),(4)" || inserts[2].token != want {
+		t.Errorf("want merged batch resent with token %s; got %+v", want, inserts)
+	}
+	if files := spooled(t, p.errorsDirs[0]); len(files) != 0 {
+		t.Errorf("want errors dir drained; got %v", files)
+	}
+}
+
+// batches flushed with tokens by default config are merged with token derived from theirs
+func TestRecoveryMergeTokens(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) { c.Fwd, c.RecoveryBatches = ch.URL, 0 })
+	ch.failTable("t", chFailure{status: http.StatusServiceUnavailable, code: 242, text: "Table is in readonly mode"})
+	key := "/?query=INSERT%20INTO%20t%20VALUES"
+	for _, body := range []string{"(1)", "(2)", "(3)"} {
+		p.flush(key, &Buffer{rowcount: 1, buffer: []byte(body)})
+	}
+	files, _ := p.spoolFiles()
+	if len(files) != 3 {
+		t.Fatalf("want 3 batches spooled; got %+v", files)
+	}
+	var tokens []string
+	for _, f := range files {
+		k, _, err := p.readSpool(f.name)
+		if err != nil || paramValue(k, tokenParam) == "" {
+			t.Fatalf("want spooled batch with token; got %s %v", k, err)
+		}
+		tokens = append(tokens, paramValue(k, tokenParam))
+	}
+	ch.failTable("t", chFailure{})
+	if err := p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	inserts, _ := ch.received()
+	if len(inserts) != 1 || inserts[0].body != "(1),(2),(3)" || inserts[0].token != mergedToken(tokens) {
+		t.Errorf("want batches merged with derived token %s; got %+v", mergedToken(tokens), inserts)
+	}
+	if mergedToken([]string{"a", "b"}) != mergedToken([]string{"b", "a"}) || mergedToken([]string{"a"}) == mergedToken([]string{"b"}) {
+		t.Error("want token by set of tokens")
+	}
+}
+
+func TestCountRows(t *testing.T) {
+	for _, c := range []struct {
+		query, body string
+		rows        int
+	}{
+		{"INSERT INTO t VALUES", "(1),(2),(3)", 3},
+		{"INSERT INTO t FORMAT TSV", "1\n2\n", 2},
+		{"INSERT INTO t FORMAT CSV", "1\n", 1},
+		{"INSERT INTO t FORMAT RowBinary", "\x01\x02", 1},
+	} {
+		if rows := countRows(c.query, []byte(c.body)); rows != c.rows {
+			t.Errorf("%s: want %d rows; got %d", c.query, c.rows, rows)
+		}
+	}
+}
@@ -0,0 +1,218 @@
+package proxyhouse
+
+import (
+	"context"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// schemaRefresh limit forced refresh of table structure, errors are cached for it too
+const schemaRefresh = 10 * time.Second
+
+// schemaTimeout limit structure query, insert wait for it
+var schemaTimeout = 5 * time.Second
+
+var (
+	errNoTable           = errors.New("Error: table doesn't exist or has no columns")
+	errSchemaUnavailable = errors.New("Error: clickhouse is not available, structure query failed recently")
+)
+
+type tableSchema struct {
+	columns []Column
+	err     error // structure query error, cached for schemaRefresh
+	fetched time.Time
+}
+
+// schemaCache keep table structures and server timezones
+type schemaCache struct {
+	sync.Mutex
+	tables map[string]*tableSchema
+	zones  map[string]*time.Location
+	down   map[string]time.Time // clickhouse not queried until this time after failure
+}
+
+func newSchemaCache() *schemaCache {
+	return &schemaCache{tables: make(map[string]*tableSchema), zones: make(map[string]*time.Location), down: make(map[string]time.Time)}
+}
+
+// tableColumns return insertable columns of table, cached for schemattl seconds, errors for schemaRefresh
+func (p *Proxy) tableColumns(database, table, user, password string) ([]Column, error) {
+	key := database + "." + table
+	p.schema.Lock()
+	ts, ok := p.schema.tables[key]
+	p.schema.Unlock()
+	if ok && ts.err != nil && time.Since(ts.fetched) < schemaRefresh {
+		return nil, ts.err
+	}
+	if ok && ts.err == nil && time.Since(ts.fetched) < time.Duration(p.conf().SchemaTTL)*time.Second {
+		return ts.columns, nil
+	}
+	columns, err := p.describeTable(database, table, user, password)
+	p.schema.Lock()
+	p.schema.tables[key] = &tableSchema{columns: columns, err: err, fetched: time.Now()}
+	p.schema.Unlock()
+	return columns, err
+}
+
+// refreshTable drop cached table structure, if it was not fetched just now
+// return false if structure is fresh already
+func (p *Proxy) refreshTable(database, table string) bool {
+	key := database + "." + table
+	p.schema.Lock()
+	defer p.schema.Unlock()
+	ts, ok := p.schema.tables[key]
+	if ok && time.Since(ts.fetched) < schemaRefresh {
+		return false
+	}
+	delete(p.schema.tables, key)
+	return true
+}
+
+// resetSchema drop all cached table structures
+func (p *Proxy) resetSchema() {
+	p.schema.Lock()
+	p.schema.tables = make(map[string]*tableSchema)
+	p.schema.zones = make(map[string]*time.Location)
+	p.schema.down = make(map[string]time.Time)
+	p.schema.Unlock()
+}
+
+// describeTable ask clickhouse for table structure over http
+func (p *Proxy) describeTable(database, table, user, password string) ([]Column, error) {
+	params := url.Values{}
+	params.Set("query", "SELECT name, type, default_kind FROM system.columns "+
+		"WHERE database = {database:String} AND table = {table:String} FORMAT TabSeparated")
+	params.Set("param_database", database)
+	params.Set("param_table", table)
+	if user != "" {
+		params.Set("user", user)
+	}
+	if password != "" {
+		params.Set("password", password)
+	}
+	body, err := p.schemaQuery(p.conf().table(strings.ToLower(database+"."+table)).fwd, params)
+	if err != nil {
+		return nil, err
+	}
+	var columns []Column
+	for _, row := range parseTSV(body) {
+		if len(row) < 3 {
+			return nil, errRowFormat
+		}
+		switch row[2].Value {
+		case "MATERIALIZED", "ALIAS", "EPHEMERAL":
+			continue
+		}
+		columns = append(columns, Column{Name: row[0].Value, Type: row[1].Value})
+	}
+	if len(columns) == 0 {
+		return nil, errNoTable
+	}
+	return columns, nil
+}
+
+// serverTimezone return timezone of clickhouse serving table, cached until reload
+func (p *Proxy) serverTimezone(database, table, user, password string) (*time.Location, error) {
+	fwd := p.conf().table(strings.ToLower(database + "." + table)).fwd
+	p.schema.Lock()
+	loc, ok := p.schema.zones[fwd]
+	p.schema.Unlock()
+	if ok {
+		return loc, nil
+	}
+	params := url.Values{}
+	params.Set("query", "SELECT timezone() FORMAT TabSeparated")
+	if user != "" {
+		params.Set("user", user)
+	}
+	if password != "" {
+		params.Set("password", password)
+	}
+	body, err := p.schemaQuery(fwd, params)
+	if err != nil {
+		return nil, err
+	}
+	if loc, err = time.LoadLocation(strings.TrimSpace(string(body))); err != nil {
+		return nil, err
+	}
+	p.schema.Lock()
+	p.schema.zones[fwd] = loc
+	p.schema.Unlock()
+	return loc, nil
+}
+
+// schemaQuery run query in clickhouse with schemaTimeout, clickhouse failed to answer
+// is not queried for schemaRefresh, so inserts don't wait for it in outage
+func (p *Proxy) schemaQuery(fwd string, params url.Values) ([]byte, error) {
+	p.schema.Lock()
+	down := time.Now().Before(p.schema.down[fwd])
+	p.schema.Unlock()
+	if down {
+		return nil, errSchemaUnavailable
+	}
+	body, status, err := p.schemaGet(fwd, params)
+	if err != nil || status >= http.StatusInternalServerError {
+		p.schema.Lock()
+		p.schema.down[fwd] = time.Now().Add(schemaRefresh)
+		p.schema.Unlock()
+	}
+	if err != nil {
+		return nil, err
+	}
+	if status != http.StatusOK {
+		return nil, errors.New(strings.TrimSpace(string(body)))
+	}
+	return body, nil
+}
+
+func (p *Proxy) schemaGet(fwd string, params url.Values) ([]byte, int, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), schemaTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", fwd+"/?"+params.Encode(), nil)
+	if err != nil {
+		return nil, 0, err
+	}
+	resp, err := p.client.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	return body, resp.StatusCode, err
+}
+
+// selectColumns return columns by names in given order
+func selectColumns(columns []Column, names []string) ([]Column, error) {
+	if len(names) == 0 {
+		return columns, nil
+	}
+	res := make([]Column, 0, len(names))
+	for _, name := range names {
+		found := false
+		for _, col := range columns {
+			if col.Name == name {
+				res = append(res, col)
+				found = true
+				break
+			}
+		}
+		if !found {
+			return nil, errors.New("Error: no such column " + name)
+		}
+	}
+	return res, nil
+}
+
+// unquoteIdent remove backquotes or double quotes around identifier
+func unquoteIdent(s string) string {
+	s = strings.TrimSpace(s)
+	if len(s) >= 2 && (s[0] == '`' || s[0] == '"') && s[len(s)-1] == s[0] {
+		return s[1 : len(s)-1]
+	}
+	return s
+}
@@ -0,0 +1,96 @@
+package proxyhouse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// fakeSchema answer system.columns queries for tables, given as db.table: name\ttype\tdefault_kind rows
+// server timezone is UTC
+func fakeSchema(t *testing.T, user string, tables map[string]string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		q := r.URL.Query()
+		if q.Get("query") == "SELECT timezone() FORMAT TabSeparated" {
+			w.Write([]byte("UTC\n"))
+			return
+		}
+		if !strings.HasPrefix(q.Get("query"), "SELECT name, type, default_kind FROM system.columns") {
+			http.Error(w, "Code: 62. DB::Exception: Syntax error", http.StatusBadRequest)
+			return
+		}
+		if q.Get("user") != user {
+			http.Error(w, "Code: 516. DB::Exception: Authentication failed", http.StatusForbidden)
+			return
+		}
+		w.Write([]byte(tables[q.Get("param_database")+"."+q.Get("param_table")]))
+	}
+}
+
+func TestTableColumns(t *testing.T) {
+	var calls int32
+	schema := fakeSchema(t, "", map[string]string{"db.t": "id\tUInt64\t\nv\tString\tDEFAULT\nm\tUInt8\tALIAS\n"})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		schema(w, r)
+	}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	columns, err := p.tableColumns("db", "t", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(columns) != 2 || columns[0] != (Column{Name: "id", Type: "UInt64"}) || columns[1].Name != "v" {
+		t.Errorf("unexpected columns %v", columns)
+	}
+	p.tableColumns("db", "t", "", "")
+	if calls != 1 {
+		t.Errorf("want cached columns; got %d calls", calls)
+	}
+	if p.refreshTable("db", "t") {
+		t.Error("want fresh columns not refreshed")
+	}
+	if _, err = p.tableColumns("db", "other", "", ""); err != errNoTable {
+		t.Errorf("want errNoTable; got %v", err)
+	}
+	if _, err = p.tableColumns("db", "t", "u", ""); err != nil {
+		t.Errorf("want cached columns for other user; got %v", err)
+	}
+	p.resetSchema()
+	if _, err = p.tableColumns("db", "t", "u", ""); err == nil || !strings.Contains(err.Error(), "Authentication") {
+		t.Errorf("want clickhouse error; got %v", err)
+	}
+}
+
+// hung or failed clickhouse is not asked for structure again, inserts are not validated
+func TestSchemaUnavailable(t *testing.T) {
+	defer func(d time.Duration) { schemaTimeout = d }(schemaTimeout)
+	schemaTimeout = 100 * time.Millisecond
+	var calls int32
+	hang := make(chan struct{})
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		atomic.AddInt32(&calls, 1)
+		<-hang
+	}))
+	defer ts.Close()
+	defer close(hang)
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if err := p.validateInsert(url.Values{}, http.Header{}, "INSERT INTO t VALUES", []byte("(1)")); err != nil {
+			t.Errorf("want insert accepted; got %v", err)
+		}
+	}
+	if elapsed := time.Since(start); elapsed > time.Second || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("want one structure query timed out; got %d calls in %s", atomic.LoadInt32(&calls), elapsed)
+	}
+	if _, err := p.tableColumns("default", "other", "", ""); err != errSchemaUnavailable || atomic.LoadInt32(&calls) != 1 {
+		t.Errorf("want other table not queried; got %v %d calls", err, atomic.LoadInt32(&calls))
+	}
+}
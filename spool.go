@@ -0,0 +1,323 @@
+package proxyhouse
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// quota of errors dir (spool), batches of long clickhouse outage must not fill the disk
+
+// policies when spool is full
+const (
+	spoolReject     = "reject"     // batch is kept in memory, new inserts are rejected
+	spoolDropOldest = "dropoldest" // oldest spooled batches are removed
+	spoolDropNewest = "dropnewest" // batch is not spooled
+)
+
+var errSpoolFull = errors.New("Error: errors dir is full, try later")
+
+// lockFile of errors dir is held by proxy, it is not a batch file
+const lockFile = ".lock"
+
+// spool keep usage of errors dir, so quota is checked without dir walk on every save
+type spool struct {
+	sync.Mutex
+	files    int
+	bytes    int64
+	failedAt time.Time       // last save failed, inserts are rejected by reject policy for resendint
+	busy     map[string]bool // files resent by recovery, they are not dropped
+}
+
+// spoolFile is a batch file of errors dir
+type spoolFile struct {
+	name string
+	size int64 // with index
+	at   int64 // batch time, unix nanoseconds from name
+}
+
+func validateSpoolFull(policy string) error {
+	switch policy {
+	case spoolReject, spoolDropOldest, spoolDropNewest:
+		return nil
+	}
+	return errors.New("must be reject, dropoldest or dropnewest")
+}
+
+// splitDirs return errors dirs of comma separated list, ERROR_DIR if list is empty
+func splitDirs(list string) []string {
+	var dirs []string
+	for _, dir := range strings.Split(list, ",") {
+		if dir = strings.TrimSpace(dir); dir != "" {
+			dirs = append(dirs, filepath.Clean(dir))
+		}
+	}
+	if len(dirs) == 0 {
+		dirs = []string{ERROR_DIR}
+	}
+	return dirs
+}
+
+func validateDirs(list string) error {
+	seen := make(map[string]bool)
+	for _, dir := range splitDirs(list) {
+		if seen[dir] {
+			return fmt.Errorf("%s is duplicated", dir)
+		}
+		seen[dir] = true
+	}
+	return nil
+}
+
+// openSpool create errors dirs and lock them, locks are released by Shutdown
+func (p *Proxy) openSpool() error {
+	var unlocks []func() error
+	for _, dir := range p.errorsDirs {
+		err := os.MkdirAll(dir, 0750)
+		var unlock func() error
+		if err == nil {
+			unlock, err = lockDir(dir)
+		}
+		if err != nil {
+			for _, unlock := range unlocks {
+				unlock()
+			}
+			return err
+		}
+		unlocks = append(unlocks, unlock)
+	}
+	p.closers = append(p.closers, unlocks...)
+	return nil
+}
+
+// spoolPath return path of batch file in errors dirs, path in first dir if file is missed
+func (p *Proxy) spoolPath(name string) string {
+	if len(p.errorsDirs) > 1 {
+		for _, dir := range p.errorsDirs {
+			path := filepath.Join(dir, name)
+			if _, err := os.Stat(path); err == nil {
+				return path
+			}
+		}
+	}
+	return filepath.Join(p.errorsDirs[0], name)
+}
+
+// spoolList return batch files of errors dirs to resend, missed dirs are skipped
+func (p *Proxy) spoolList() ([]string, error) {
+	var list []string
+	for _, dir := range p.errorsDirs {
+		files, err := p.filePathWalkDir(dir)
+		if err != nil && !os.IsNotExist(err) {
+			return nil, err
+		}
+		list = append(list, files...)
+	}
+	return list, nil
+}
+
+// fileSize return size of batch file with its index, 0 if file is missed
+func fileSize(path string) int64 {
+	var size int64
+	for _, name := range []string{path, path + ".idx"} {
+		if info, err := os.Stat(name); err == nil {
+			size += info.Size()
+		}
+	}
+	return size
+}
+
+// spoolFiles return batch files of errors dirs, failed ones too, oldest first
+func (p *Proxy) spoolFiles() ([]spoolFile, error) {
+	var files []spoolFile
+	for _, dir := range p.errorsDirs {
+		infos, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, info := range infos {
+			name := info.Name()
+			if info.IsDir() || strings.HasSuffix(name, ".idx") || strings.HasPrefix(name, ".") || len(name) < 2 {
+				continue
+			}
+			files = append(files, spoolFile{name: name, size: fileSize(filepath.Join(dir, name)), at: spoolTime(name).UnixNano()})
+		}
+	}
+	sort.Slice(files, func(i, j int) bool { return files[i].at < files[j].at })
+	return files, nil
+}
+
+// spoolTime return time of batch from file name: level or O, E prefix and unix nanoseconds
+// time of unknown file is now, so it is not expired
+func spoolTime(name string) time.Time {
+	if len(name) < 2 {
+		return time.Now()
+	}
+	nanos, err := strconv.ParseInt(name[1:], 10, 64)
+	if err != nil {
+		return time.Now()
+	}
+	return time.Unix(0, nanos)
+}
+
+// scanSpool count usage of errors dir
+func (p *Proxy) scanSpool() error {
+	files, err := p.spoolFiles()
+	if err != nil {
+		return err
+	}
+	s := p.spool
+	s.Lock()
+	defer s.Unlock()
+	s.files, s.bytes = len(files), 0
+	for _, f := range files {
+		s.bytes += f.size
+	}
+	return nil
+}
+
+// fits report if batch of size fits into quota, spool must be locked
+func (p *Proxy) fits(size int64) bool {
+	cfg := p.conf()
+	s := p.spool
+	return (cfg.SpoolMaxFiles == 0 || s.files+1 <= cfg.SpoolMaxFiles) &&
+		(cfg.SpoolMaxBytes == 0 || s.bytes+size <= int64(cfg.SpoolMaxBytes))
+}
+
+// reserveSpool check quota before batch of size is saved, oldest batches are removed by dropoldest policy
+func (p *Proxy) reserveSpool(size int64) error {
+	cfg := p.conf()
+	s := p.spool
+	s.Lock()
+	defer s.Unlock()
+	if p.fits(size) {
+		return nil
+	}
+	p.metrics.Increment(cfg.GraphitePrefixCnt+".spool_full", 1)
+	if cfg.SpoolFull != spoolDropOldest || (cfg.SpoolMaxBytes > 0 && size > int64(cfg.SpoolMaxBytes)) {
+		s.failedAt = time.Now()
+		return errSpoolFull
+	}
+	files, err := p.spoolFiles()
+	if err != nil {
+		return err
+	}
+	for _, f := range files {
+		if p.fits(size) {
+			break
+		}
+		if s.busy[f.name] {
+			continue
+		}
+		if err = p.removeSpoolFile(f.name); err != nil {
+			return err
+		}
+		p.log(LEVEL_ERR, "Errors dir is full, batch is dropped: ", f.name)
+		p.metrics.Increment(cfg.GraphitePrefixCnt+".spool_dropped", 1)
+	}
+	if !p.fits(size) {
+		return errSpoolFull
+	}
+	return nil
+}
+
+// spooled add saved batch file to usage
+func (p *Proxy) spooled(path string) {
+	s := p.spool
+	s.Lock()
+	s.files++
+	s.bytes += fileSize(path)
+	s.failedAt = time.Time{}
+	s.Unlock()
+}
+
+// spoolFailed mark failed save of batch
+func (p *Proxy) spoolFailed() {
+	p.spool.Lock()
+	p.spool.failedAt = time.Now()
+	p.spool.Unlock()
+}
+
+// removeSpoolFile remove batch file with index, spool must be locked
+func (p *Proxy) removeSpoolFile(name string) error {
+	path := p.spoolPath(name)
+	size := fileSize(path)
+	if err := os.Remove(path); err != nil {
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return err
+	}
+	os.Remove(path + ".idx")
+	p.spool.files--
+	p.spool.bytes -= size
+	p.spool.failedAt = time.Time{}
+	return nil
+}
+
+// unspool remove resent batch file
+func (p *Proxy) unspool(name string) error {
+	p.spool.Lock()
+	defer p.spool.Unlock()
+	return p.removeSpoolFile(name)
+}
+
+// setBusy mark file resent by recovery
+func (p *Proxy) setBusy(name string, busy bool) {
+	p.spool.Lock()
+	if busy {
+		p.spool.busy[name] = true
+	} else {
+		delete(p.spool.busy, name)
+	}
+	p.spool.Unlock()
+}
+
+// spoolFull report if inserts are rejected: reject policy and errors dir is full or not writable
+func (p *Proxy) spoolFull() bool {
+	cfg := p.conf()
+	if cfg.SpoolFull != spoolReject {
+		return false
+	}
+	s := p.spool
+	s.Lock()
+	defer s.Unlock()
+	return time.Since(s.failedAt) < time.Duration(cfg.ResendInt)*time.Second || !p.fits(0)
+}
+
+// spoolUsage return files and bytes of errors dir
+func (p *Proxy) spoolUsage() (int, int64) {
+	p.spool.Lock()
+	defer p.spool.Unlock()
+	return p.spool.files, p.spool.bytes
+}
+
+// expired count batch expired by table maxage
+func (p *Proxy) expired(key string, age time.Duration) {
+	cnt, table := p.conf().GraphitePrefixCnt, extractTable(key)
+	p.log(LEVEL_WARN, "Spooled batch is expired: ", hidePassword(key), " age: ", age.Round(time.Second))
+	p.metrics.Increment(cnt+".spool_expired", 1)
+	p.metrics.Increment(cnt+".bytable."+table+".spool_expired", 1)
+}
+
+// expireSpool move batch file to expired ones, E prefix, they are kept but not resent
+func (p *Proxy) expireSpool(name string) error {
+	p.spool.Lock()
+	defer p.spool.Unlock()
+	path := p.spoolPath(name)
+	to := filepath.Join(filepath.Dir(path), "E"+name[1:])
+	if err := os.Rename(path, to); err != nil {
+		return err
+	}
+	if err := os.Rename(path+".idx", to+".idx"); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,256 @@
+package proxyhouse
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/recoilme/pudge"
+)
+
+// spooledBody return batch of errors dir file
+func spooledBody(t *testing.T, path string) string {
+	t.Helper()
+	db, err := pudge.Open(path, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	keys, err := db.Keys(nil, 0, 0, true)
+	if err != nil || len(keys) != 1 {
+		t.Fatalf("want one batch in %s; got %d %v", path, len(keys), err)
+	}
+	var val []byte
+	if err = db.Get(keys[0], &val); err != nil {
+		t.Fatal(err)
+	}
+	return string(val)
+}
+
+// failSend make proxy with clickhouse down and spool quota, spool usage is counted
+func failSend(t *testing.T, change func(c *Config)) *Proxy {
+	t.Helper()
+	ch := newFakeClickHouse(t)
+	ch.failTable("t", chFailure{status: http.StatusServiceUnavailable, code: 242, text: "Table is in readonly mode"})
+	p := newTestProxy(t, func(c *Config) {
+		c.Fwd = ch.URL
+		change(c)
+	})
+	if err := p.scanSpool(); err != nil {
+		t.Fatal(err)
+	}
+	return p
+}
+
+func TestSpoolMaxFiles(t *testing.T) {
+	for _, policy := range []string{spoolReject, spoolDropOldest, spoolDropNewest} {
+		p := failSend(t, func(c *Config) { c.SpoolMaxFiles, c.SpoolFull = 2, policy })
+		key := "/?query=INSERT%20INTO%20t%20VALUES"
+		for i := 1; i <= 3; i++ {
+			p.flush(key, &Buffer{rowcount: 1, buffer: []byte("(" + strconv.Itoa(i) + ")")})
+		}
+		files, err := p.spoolFiles()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if n, _ := p.spoolUsage(); n != 2 || len(files) != 2 {
+			t.Fatalf("%s: want 2 files; got %d %v", policy, n, files)
+		}
+		var bodies []string
+		for _, f := range files {
+			bodies = append(bodies, spooledBody(t, p.spoolPath(f.name)))
+		}
+		want := map[string]string{spoolReject: "(1),(2)", spoolDropOldest: "(2),(3)", spoolDropNewest: "(1),(2)"}[policy]
+		if got := strings.Join(bodies, ","); got != want {
+			t.Errorf("%s: want spooled %s; got %s", policy, want, got)
+		}
+		requeued := len(p.store.buffers())
+		switch policy {
+		case spoolReject:
+			if requeued != 1 || !p.spoolFull() {
+				t.Errorf("reject: want batch kept in memory and inserts rejected; got %d %v", requeued, p.spoolFull())
+			}
+		case spoolDropOldest:
+			if requeued != 0 || counter(p, ".spool_dropped") != 1 || p.spoolFull() {
+				t.Errorf("dropoldest: want oldest dropped; got %d %d", requeued, counter(p, ".spool_dropped"))
+			}
+		case spoolDropNewest:
+			if requeued != 0 || counter(p, ".spool_dropped_rows") != 1 || p.spoolFull() {
+				t.Errorf("dropnewest: want newest dropped; got %d %d", requeued, counter(p, ".spool_dropped_rows"))
+			}
+		}
+	}
+}
+
+func TestSpoolMaxBytes(t *testing.T) {
+	p := failSend(t, func(c *Config) { c.SpoolMaxBytes, c.SpoolFull = 1000, spoolDropOldest })
+	key := "/?query=INSERT%20INTO%20t%20VALUES"
+	// batch larger than quota doesn't drop spooled ones
+	p.flush(key, &Buffer{rowcount: 1, buffer: []byte("(1)")})
+	p.flush(key, &Buffer{rowcount: 1, buffer: []byte("('" + strings.Repeat("x", 1000) + "')")})
+	if n, size := p.spoolUsage(); n != 1 || size <= 0 || size > 1000 {
+		t.Errorf("want small batch kept; got %d files %d bytes", n, size)
+	}
+	if counter(p, ".spool_full") != 1 || counter(p, ".spool_dropped_rows") != 1 {
+		t.Errorf("want large batch dropped; got full %d dropped %d", counter(p, ".spool_full"), counter(p, ".spool_dropped_rows"))
+	}
+}
+
+func TestSpoolReject(t *testing.T) {
+	p := failSend(t, func(c *Config) { c.SpoolMaxFiles = 1 })
+	ts := httptest.NewServer(p.Handler())
+	defer ts.Close()
+	p.flush("/?query=INSERT%20INTO%20t%20VALUES", &Buffer{rowcount: 1, buffer: []byte("(1)")})
+
+	resp, err := http.Post(ts.URL+"/?query=INSERT%20INTO%20t%20VALUES", "", strings.NewReader("(2)"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := ioutil.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") == "" || !strings.Contains(string(body), "full") {
+		t.Errorf("want 503 when errors dir is full; got %d %s", resp.StatusCode, body)
+	}
+
+	// resent batch free space
+	files, _ := p.spoolFiles()
+	if err = p.unspool(files[0].name); err != nil {
+		t.Fatal(err)
+	}
+	if p.spoolFull() {
+		t.Error("want inserts accepted after errors dir is freed")
+	}
+	if _, err = os.Stat(p.spoolPath(files[0].name)); !os.IsNotExist(err) {
+		t.Errorf("want file removed; got %v", err)
+	}
+}
+
+func TestSpoolMaxAge(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	p := newTestProxy(t, func(c *Config) {
+		c.Fwd = ch.URL
+		c.Tables = map[string]*TableConfig{"old": {MaxAge: 3600}}
+	})
+	hourAgo := time.Now().Add(-time.Hour - time.Minute)
+	for _, b := range []struct {
+		table string
+		at    time.Time
+	}{{"old", hourAgo}, {"old", time.Now()}, {"t", hourAgo.Add(time.Second)}} {
+		if err := p.saveToErrors("/?query=INSERT%20INTO%20"+b.table+"%20VALUES", []byte("(1)"), 1, b.at); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// failed resend keep time of batch
+	ch.failNext(chFailure{status: http.StatusServiceUnavailable, code: 242, text: "Table is in readonly mode"})
+
+	if err := p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	inserts, requests := ch.received()
+	if requests != 2 || len(inserts) != 1 {
+		t.Errorf("want batch of t failed and new batch of old sent; got %d requests %+v", requests, inserts)
+	}
+	files, err := p.spoolFiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 2 || files[0].name[0] != 'E' || files[1].name[0] != '2' || files[1].at != hourAgo.Add(time.Second).UnixNano() {
+		t.Fatalf("want expired batch and batch of t with level 2 and batch time; got %+v", files)
+	}
+	if counter(p, ".spool_expired") != 1 || counter(p, ".bytable.old.spool_expired") != 1 {
+		t.Errorf("want expired metrics; got %d", counter(p, ".spool_expired"))
+	}
+	if n, _ := p.spoolUsage(); n != 2 {
+		t.Errorf("want expired batch counted in errors dir usage; got %d", n)
+	}
+	list, _ := p.spoolList()
+	if len(list) != 1 {
+		t.Errorf("want expired batch not resent; got %v", list)
+	}
+}
+
+func TestSpoolDirs(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	root := t.TempDir()
+	dirs := root + "/a, " + root + "/b/c"
+	cfg := DefaultConfig()
+	cfg.Port, cfg.Fwd = 0, ch.URL
+	p, err := New(Options{Config: cfg, ErrorsDir: dirs})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Start(); err != nil {
+		t.Fatal(err)
+	}
+	defer p.Shutdown(context.Background())
+	for _, dir := range []string{root + "/a", root + "/b/c"} {
+		if info, err := os.Stat(dir); err != nil || !info.IsDir() || info.Mode().Perm()&^0750 != 0 {
+			t.Fatalf("want dir created; got %v %v", info, err)
+		}
+	}
+
+	// second proxy can't share errors dir
+	q, err := New(Options{Config: cfg, ErrorsDir: root + "/b/c"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Start(); err == nil || !strings.Contains(err.Error(), "used by other proxyhouse") {
+		q.Shutdown(context.Background())
+		t.Fatalf("want locked errors dir; got %v", err)
+	}
+
+	at := time.Now()
+	for i := 0; i < 4; i++ {
+		if err = p.saveToErrors("/?query=INSERT%20INTO%20t%20VALUES", []byte("("+strconv.Itoa(i)+")"), 1, at.Add(time.Duration(i)*time.Second)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if a, b := spooled(t, root+"/a"), spooled(t, root+"/b/c"); len(a) != 2 || len(b) != 2 {
+		t.Fatalf("want batches placed round-robin; got %v %v", a, b)
+	}
+	if n, _ := p.spoolUsage(); n != 4 {
+		t.Errorf("want usage of all dirs; got %d", n)
+	}
+	if err = p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if ch.rowCount() != 4 || len(spooled(t, root+"/a"))+len(spooled(t, root+"/b/c")) != 0 {
+		t.Errorf("want batches of all dirs resent; got %d rows", ch.rowCount())
+	}
+
+	if _, err = New(Options{Config: cfg, ErrorsDir: root + "/a," + root + "/a/"}); err == nil {
+		t.Error("want duplicated dirs rejected")
+	}
+}
+
+// errors dir is unlocked when start fail
+func TestSpoolStartFailed(t *testing.T) {
+	dir := t.TempDir()
+	cfg := DefaultConfig()
+	cfg.Port = 0
+	cfg.DedupFile = filepath.Join(dir, lockFile, "dedup")
+	p, err := New(Options{Config: cfg, ErrorsDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = p.Start(); err == nil || !strings.Contains(err.Error(), "dedupfile") {
+		p.Shutdown(context.Background())
+		t.Fatalf("want dedupfile error; got %v", err)
+	}
+	cfg.DedupFile = ""
+	q, err := New(Options{Config: cfg, ErrorsDir: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = q.Start(); err != nil {
+		t.Fatalf("want errors dir unlocked; got %v", err)
+	}
+	q.Shutdown(context.Background())
+}
@@ -0,0 +1,288 @@
+package proxyhouse
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// transformation of buffered batches before forward, configured per table as a chain
+
+// Batch is a parsed buffered insert, Objects are set for JSONEachRow, Columns and Rows for other formats
+type Batch struct {
+	Query   string
+	Format  string
+	Columns []string
+	Rows    []Row
+	Objects []map[string]json.RawMessage
+}
+
+// Transformer change batch in place
+type Transformer interface {
+	Transform(b *Batch) error
+}
+
+// TransformConfig is a declarative transformer settings
+type TransformConfig struct {
+	Type   string `yaml:"type"`
+	Column string `yaml:"column"`
+	To     string `yaml:"to"`
+	Value  string `yaml:"value"`
+}
+
+// transformers is a registry of transformer constructors by type
+var transformers = map[string]func(tc TransformConfig) (Transformer, error){
+	"add_column":    newAddColumn,
+	"drop_column":   newDropColumn,
+	"rename_column": newRenameColumn,
+	"rename_table":  newRenameTable,
+}
+
+var errTransformFormat = errors.New("Error: transform supports Values, TSV, CSV and JSONEachRow only")
+
+type transformChain []Transformer
+
+// columnsFunc return insertable columns of table, Proxy.tableColumns in proxy
+type columnsFunc func(database, table, user, password string) ([]Column, error)
+
+// newTransformChain build transformers from config
+func newTransformChain(configs []TransformConfig) (*transformChain, error) {
+	chain := make(transformChain, 0, len(configs))
+	for i, tc := range configs {
+		newTransformer, ok := transformers[tc.Type]
+		if !ok {
+			return nil, fmt.Errorf("transform[%d]: unknown type %s", i, tc.Type)
+		}
+		t, err := newTransformer(tc)
+		if err != nil {
+			return nil, fmt.Errorf("transform[%d]: %s", i, err)
+		}
+		chain = append(chain, t)
+	}
+	return &chain, nil
+}
+
+// apply transform batch by key, return new key and body
+func (chain transformChain) apply(key string, body []byte, describe columnsFunc) (string, []byte, error) {
+	query, ok := keyQuery(key)
+	if !ok {
+		return key, body, errNotInsert
+	}
+	b := &Batch{Query: query, Format: queryFormat(query)}
+	var err error
+	switch b.Format {
+	case formatJSONEachRow:
+		b.Objects, err = parseJSONEachRow(body)
+	case formatValues, formatTSV, formatCSV:
+		if b.Columns, err = batchColumns(key, query, describe); err == nil {
+			b.Rows, err = parseRows(b.Format, body)
+		}
+	default:
+		err = errTransformFormat
+	}
+	if err != nil {
+		return key, body, err
+	}
+	for _, t := range chain {
+		if err = t.Transform(b); err != nil {
+			return key, body, err
+		}
+	}
+	switch b.Format {
+	case formatJSONEachRow:
+		body, err = encodeJSONEachRow(b.Objects)
+	case formatValues:
+		body = encodeValues(b.Rows)
+	case formatTSV:
+		body = encodeTSV(b.Rows)
+	case formatCSV:
+		body, err = encodeCSV(b.Rows)
+	}
+	if err != nil {
+		return key, body, err
+	}
+	return setQuery(key, b.Query), body, nil
+}
+
+// batchColumns return column list of insert query, table columns if query has no list
+func batchColumns(key, query string, describe columnsFunc) ([]string, error) {
+	database, table, names, err := parseInsert(query)
+	if err != nil || len(names) > 0 {
+		return names, err
+	}
+	params, err := url.ParseQuery(key[strings.IndexByte(key, '?')+1:])
+	if err != nil {
+		return nil, err
+	}
+	if database == "" {
+		database = params.Get("database")
+	}
+	if database == "" {
+		database = "default"
+	}
+	columns, err := describe(database, table, params.Get("user"), params.Get("password"))
+	if err != nil {
+		return nil, err
+	}
+	for _, col := range columns {
+		names = append(names, col.Name)
+	}
+	return names, nil
+}
+
+// setColumns write column list into insert query
+func (b *Batch) setColumns() {
+	m := insertRe.FindStringSubmatchIndex(b.Query)
+	if m == nil {
+		return
+	}
+	end := m[3]
+	if m[4] >= 0 {
+		end = m[5]
+	}
+	names := make([]string, len(b.Columns))
+	for i, name := range b.Columns {
+		names[i] = quoteIdent(name)
+	}
+	rest := strings.TrimLeft(b.Query[m[1]:], " \t\r\n")
+	b.Query = b.Query[:end] + " (" + strings.Join(names, ", ") + ") " + rest
+}
+
+func (b *Batch) column(name string) int {
+	for i, col := range b.Columns {
+		if col == name {
+			return i
+		}
+	}
+	return -1
+}
+
+// addColumn add column with the same value to every row
+// value $now is insert time as unix timestamp, $hostname is proxyhouse host
+type addColumn struct {
+	column string
+	value  string
+}
+
+func newAddColumn(tc TransformConfig) (Transformer, error) {
+	if tc.Column == "" {
+		return nil, errors.New("column must be set")
+	}
+	return &addColumn{column: tc.Column, value: tc.Value}, nil
+}
+
+func (t *addColumn) Transform(b *Batch) error {
+	value, number := t.value, false
+	switch t.value {
+	case "$now":
+		value, number = strconv.FormatInt(time.Now().Unix(), 10), true
+	case "$hostname":
+		value, _ = os.Hostname()
+	}
+	if b.Objects != nil {
+		raw, _ := json.Marshal(value)
+		if number {
+			raw = []byte(value)
+		}
+		for _, obj := range b.Objects {
+			obj[t.column] = raw
+		}
+		return nil
+	}
+	i := b.column(t.column)
+	if i < 0 {
+		b.Columns = append(b.Columns, t.column)
+		b.setColumns()
+	}
+	f := Field{Value: value, Quoted: !number}
+	for j, row := range b.Rows {
+		if i < 0 {
+			b.Rows[j] = append(row, f)
+		} else if i < len(row) {
+			row[i] = f
+		}
+	}
+	return nil
+}
+
+type dropColumn struct {
+	column string
+}
+
+func newDropColumn(tc TransformConfig) (Transformer, error) {
+	if tc.Column == "" {
+		return nil, errors.New("column must be set")
+	}
+	return &dropColumn{column: tc.Column}, nil
+}
+
+func (t *dropColumn) Transform(b *Batch) error {
+	if b.Objects != nil {
+		for _, obj := range b.Objects {
+			delete(obj, t.column)
+		}
+		return nil
+	}
+	i := b.column(t.column)
+	if i < 0 {
+		return nil
+	}
+	b.Columns = append(b.Columns[:i], b.Columns[i+1:]...)
+	b.setColumns()
+	for j, row := range b.Rows {
+		if i < len(row) {
+			b.Rows[j] = append(row[:i], row[i+1:]...)
+		}
+	}
+	return nil
+}
+
+type renameColumn struct {
+	column string
+	to     string
+}
+
+func newRenameColumn(tc TransformConfig) (Transformer, error) {
+	if tc.Column == "" || tc.To == "" {
+		return nil, errors.New("column and to must be set")
+	}
+	return &renameColumn{column: tc.Column, to: tc.To}, nil
+}
+
+func (t *renameColumn) Transform(b *Batch) error {
+	if b.Objects != nil {
+		for _, obj := range b.Objects {
+			if raw, ok := obj[t.column]; ok {
+				delete(obj, t.column)
+				obj[t.to] = raw
+			}
+		}
+		return nil
+	}
+	if i := b.column(t.column); i >= 0 {
+		b.Columns[i] = t.to
+		b.setColumns()
+	}
+	return nil
+}
+
+type renameTableTransformer struct {
+	table string
+}
+
+func newRenameTable(tc TransformConfig) (Transformer, error) {
+	if !renameRe.MatchString(tc.To) {
+		return nil, fmt.Errorf("to %s: must be table or db.table", tc.To)
+	}
+	return &renameTableTransformer{table: tc.To}, nil
+}
+
+func (t *renameTableTransformer) Transform(b *Batch) error {
+	b.Query = renameQuery(b.Query, t.table)
+	return nil
+}
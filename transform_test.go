@@ -0,0 +1,180 @@
+package proxyhouse
+
+import (
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTransformChain(t *testing.T) {
+	ts := httptest.NewServer(fakeSchema(t, "u", map[string]string{"db.t": "id\tUInt32\t\nname\tString\t\ndebug\tString\t\n"}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	chain, err := newTransformChain([]TransformConfig{
+		{Type: "drop_column", Column: "debug"},
+		{Type: "rename_column", Column: "name", To: "title"},
+		{Type: "add_column", Column: "host", Value: "web-1"},
+		{Type: "rename_table", To: "db.t_all"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		key, body string
+		wantKey   string
+		wantBody  string
+	}{
+		{
+			"/?query=INSERT%20INTO%20t%20VALUES&database=db&user=u", "(1,'a','x'),(2,'it''s',now())",
+			"/?query=INSERT%20INTO%20db.t_all%20%28id%2C%20title%2C%20host%29%20VALUES&database=db&user=u",
+			"(1,'a','web-1'),(2,'it\\'s','web-1')",
+		},
+		{
+			"?query=INSERT%20INTO%20db.t%20(debug,%20id)%20FORMAT%20TSV", "x\t1\ny\t2\n",
+			"?query=INSERT%20INTO%20db.t_all%20%28id%2C%20host%29%20FORMAT%20TSV",
+			"1\tweb-1\n2\tweb-1\n",
+		},
+		{
+			"?query=INSERT%20INTO%20db.t%20(id,name,debug)%20FORMAT%20CSV", "1,\"a,b\",x\n2,\\N,y\n",
+			"?query=INSERT%20INTO%20db.t_all%20%28id%2C%20title%2C%20host%29%20FORMAT%20CSV",
+			"1,\"a,b\",web-1\n2,\\N,web-1\n",
+		},
+		{
+			"?query=INSERT%20INTO%20db.t%20FORMAT%20JSONEachRow", `{"id":1,"name":"a","debug":"x"},{"id":2}`,
+			"?query=INSERT%20INTO%20db.t_all%20FORMAT%20JSONEachRow",
+			`{"host":"web-1","id":1,"title":"a"}` + "\n" + `{"host":"web-1","id":2}` + "\n",
+		},
+	}
+	for _, tt := range tests {
+		key, body, err := chain.apply(tt.key, []byte(tt.body), p.tableColumns)
+		if err != nil {
+			t.Errorf("%s: %v", tt.key, err)
+			continue
+		}
+		if key != tt.wantKey {
+			t.Errorf("key: want %s; got %s", tt.wantKey, key)
+		}
+		if string(body) != tt.wantBody {
+			t.Errorf("%s: want '%s'; got '%s'", tt.key, tt.wantBody, body)
+		}
+	}
+
+	// batch is not changed on error
+	key := "?query=INSERT%20INTO%20db.t%20FORMAT%20Parquet"
+	if k, b, err := chain.apply(key, []byte("PAR1"), p.tableColumns); err != errTransformFormat || k != key || string(b) != "PAR1" {
+		t.Errorf("want errTransformFormat and batch as is; got %v %s %s", err, k, b)
+	}
+}
+
+func TestTransformValues(t *testing.T) {
+	host, _ := os.Hostname()
+	chain, err := newTransformChain([]TransformConfig{
+		{Type: "add_column", Column: "inserted_at", Value: "$now"},
+		{Type: "add_column", Column: "host", Value: "$hostname"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Now().Unix()
+	_, body, err := chain.apply("?query=INSERT%20INTO%20t%20(id)%20FORMAT%20JSONEachRow", []byte(`{"id":1}`), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix := `{"host":"` + host + `","id":1,"inserted_at":`
+	if !strings.HasPrefix(string(body), prefix) {
+		t.Fatalf("want %s...; got %s", prefix, body)
+	}
+	ts, err := strconv.ParseInt(strings.TrimSpace(strings.TrimSuffix(strings.TrimSpace(string(body)[len(prefix):]), "}")), 10, 64)
+	if err != nil || ts < start || ts > time.Now().Unix() {
+		t.Errorf("want insert time; got %s", body)
+	}
+}
+
+func TestTransformConfig(t *testing.T) {
+	tests := map[string]string{
+		"tables:\n  t:\n    transform:\n      - type: upper":                                   "tables.t.transform[0]: unknown type upper",
+		"tables:\n  t:\n    transform:\n      - type: add_column":                              "tables.t.transform[0]: column must be set",
+		"rules:\n  - match: t\n    transform:\n      - type: rename_column\n        column: a": "rules[0].transform[0]: column and to must be set",
+		"rules:\n  - match: t\n    transform:\n      - type: rename_table\n        to: a b":    "rules[0].transform[0]: to a b",
+	}
+	for data, want := range tests {
+		_, err := LoadConfig(writeConfig(t, data), DefaultConfig(), nil)
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("%q: want error with '%s'; got %v", data, want, err)
+		}
+	}
+}
+
+func TestFlushTransform(t *testing.T) {
+	var gotQuery, gotBody string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotQuery = r.URL.Query().Get("query")
+		body, _ := ioutil.ReadAll(r.Body)
+		gotBody = string(body)
+	}))
+	defer ts.Close()
+	path := writeConfig(t, "fwd: "+ts.URL+`
+rules:
+  - match: events
+    transform:
+      - type: add_column
+        column: src
+        value: proxy
+`)
+	c, err := LoadConfig(path, DefaultConfig(), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := newTestProxy(t, func(cfg *Config) { *cfg = *c })
+
+	p.flush("?query=INSERT%20INTO%20events%20(id)%20FORMAT%20TSV", &Buffer{rowcount: 2, buffer: []byte("1\n2\n")})
+	if gotQuery != "INSERT INTO events (id, src) FORMAT TSV" || gotBody != "1\tproxy\n2\tproxy\n" {
+		t.Errorf("want transformed batch; got '%s' '%s'", gotQuery, gotBody)
+	}
+}
+
+// batch is not forwarded untransformed when table structure is unavailable
+func TestFlushTransformError(t *testing.T) {
+	ch := newFakeClickHouse(t)
+	var ready int32
+	schema := fakeSchema(t, "u", map[string]string{"db.t": "id\tUInt32\t\ndebug\tString\t\n"})
+	ch.schema = func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&ready) == 0 {
+			http.Error(w, "Code: 159. DB::Exception: Timeout exceeded", http.StatusInternalServerError)
+			return
+		}
+		schema(w, r)
+	}
+	p := newTestProxy(t, func(c *Config) {
+		c.Fwd = ch.URL
+		c.Tables = map[string]*TableConfig{"t": {Transform: []TransformConfig{{Type: "drop_column", Column: "debug"}}}}
+	})
+	key := "/?query=INSERT%20INTO%20t%20VALUES&database=db&user=u"
+	p.flush(key, &Buffer{rowcount: 1, buffer: []byte("(1,'x')")})
+	if inserts, _ := ch.received(); len(inserts) != 0 {
+		t.Fatalf("want batch not forwarded; got %+v", inserts)
+	}
+	files, _ := p.spoolFiles()
+	if len(files) != 1 || spooledBody(t, p.spoolPath(files[0].name)) != "(1,'x')" || counter(p, ".transform_errors") != 1 {
+		t.Fatalf("want batch spooled as is; got %+v %d", files, counter(p, ".transform_errors"))
+	}
+
+	atomic.StoreInt32(&ready, 1)
+	// structure error is cached
+	p.resetSchema()
+	if err := p.checkErr(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	inserts, _ := ch.received()
+	if len(inserts) != 1 || inserts[0].query != "INSERT INTO t (id) VALUES" || inserts[0].body != "(1)" {
+		t.Errorf("want batch transformed on resend; got %+v", inserts)
+	}
+}
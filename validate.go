@@ -0,0 +1,163 @@
+package proxyhouse
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// validation of insert rows against table structure, before rows are merged into buffer
+
+// validationError mean insert is rejected by table structure
+type validationError struct {
+	err error
+}
+
+func (e validationError) Error() string {
+	return e.err.Error()
+}
+
+// validateInsert check insert body against table columns
+// insert is accepted if table structure can't be fetched, clickhouse may be down
+func (p *Proxy) validateInsert(params url.Values, header http.Header, query string, body []byte) error {
+	database, table, names, err := parseInsert(query)
+	if err != nil {
+		return validationError{err}
+	}
+	if database == "" {
+		database = params.Get("database")
+	}
+	if database == "" {
+		database = "default"
+	}
+	user, password := params.Get("user"), params.Get("password")
+	if user == "" {
+		user = header.Get("X-ClickHouse-User")
+	}
+	if password == "" {
+		password = header.Get("X-ClickHouse-Key")
+	}
+	format := queryFormat(query)
+	err = p.checkRows(database, table, user, password, names, format, body)
+	if _, ok := err.(validationError); ok && p.refreshTable(database, table) {
+		// table may be altered since structure was cached
+		err = p.checkRows(database, table, user, password, names, format, body)
+	}
+	switch err.(type) {
+	case nil, validationError:
+		return err
+	}
+	p.log(LEVEL_WARN, "Validation skipped, table structure error: ", database, ".", table, " error: ", err)
+	return nil
+}
+
+func (p *Proxy) checkRows(database, table, user, password string, names []string, format string, body []byte) error {
+	switch format {
+	case formatValues, formatTSV, formatCSV, formatJSONEachRow:
+	default:
+		return nil
+	}
+	columns, err := p.tableColumns(database, table, user, password)
+	if err == errNoTable {
+		return validationError{fmt.Errorf("Error: table %s.%s doesn't exist", database, table)}
+	}
+	if err != nil {
+		return err
+	}
+	if format == formatJSONEachRow {
+		return checkJSON(columns, body)
+	}
+	if columns, err = selectColumns(columns, names); err != nil {
+		return validationError{err}
+	}
+	rows, err := parseRows(format, body)
+	if err != nil {
+		return validationError{err}
+	}
+	types := make([]*chType, len(columns))
+	for i, col := range columns {
+		types[i] = checkType(col.Type)
+	}
+	var buf bytes.Buffer
+	for i, row := range rows {
+		if len(row) != len(columns) {
+			return validationError{fmt.Errorf("Error: row %d: want %d columns; got %d", i+1, len(columns), len(row))}
+		}
+		for j, f := range row {
+			if format == formatValues && !f.Quoted && strings.Contains(f.Value, "(") {
+				// expression, evaluated by clickhouse
+				continue
+			}
+			if err := checkField(&buf, types[j], f); err != nil {
+				return validationError{fmt.Errorf("Error: row %d column %s: %s", i+1, columns[j].Name, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// checkJSON check JSONEachRow objects, unknown keys are left to clickhouse settings
+func checkJSON(columns []Column, body []byte) error {
+	types := make(map[string]*chType, len(columns))
+	for _, col := range columns {
+		types[col.Name] = checkType(col.Type)
+	}
+	objects, err := parseJSONEachRow(body)
+	if err != nil {
+		return validationError{err}
+	}
+	var buf bytes.Buffer
+	for n, obj := range objects {
+		for name, raw := range obj {
+			ct, ok := types[name]
+			if !ok || len(raw) == 0 {
+				continue
+			}
+			var f Field
+			switch raw[0] {
+			case '{', '[':
+				continue
+			case 'n':
+				f.Null = true
+			case 't':
+				f.Value = "1"
+			case 'f':
+				f.Value = "0"
+			case '"':
+				json.Unmarshal(raw, &f.Value)
+				f.Quoted = true
+			default:
+				f.Value = string(raw)
+			}
+			if err := checkField(&buf, ct, f); err != nil {
+				return validationError{fmt.Errorf("Error: row %d column %s: %s", n+1, name, err)}
+			}
+		}
+	}
+	return nil
+}
+
+// checkType return type for value checks, nil if type is not checked
+func checkType(t string) *chType {
+	if strings.HasPrefix(t, "LowCardinality(") && strings.HasSuffix(t, ")") {
+		t = t[len("LowCardinality(") : len(t)-1]
+	}
+	ct, err := parseType(t, time.UTC)
+	if err != nil {
+		return nil
+	}
+	return ct
+}
+
+// checkField parse value as native encoder does, NULL become default value in clickhouse
+func checkField(buf *bytes.Buffer, ct *chType, f Field) error {
+	if ct == nil || f.Null {
+		return nil
+	}
+	buf.Reset()
+	return ct.encode(&nativeWriter{w: buf}, f)
+}
@@ -0,0 +1,112 @@
+package proxyhouse
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestValidateInsert(t *testing.T) {
+	tables := map[string]string{
+		"default.t": "id\tUInt32\t\nname\tLowCardinality(String)\t\nts\tDateTime\tDEFAULT\nv\tNullable(Float64)\t\n" +
+			"tags\tArray(String)\t\nm\tUInt8\tMATERIALIZED\n",
+		"default.f": "ts\tDateTime\t\nd\tDate\t\nok\tBool\t\n",
+	}
+	ts := httptest.NewServer(fakeSchema(t, "", tables))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	tests := []struct {
+		query string
+		body  string
+		err   string
+	}{
+		{"INSERT INTO t VALUES", "(1,'a','2020-01-02 03:04:05',NULL,['x']),(2,'b',now(),1.5,[])", ""},
+		{"INSERT INTO t VALUES", "(1,'a','2020-01-02 03:04:05',NULL)", "row 1: want 5 columns; got 4"},
+		{"INSERT INTO t VALUES", "(1,'a',1,2,[]),(-1,'b',1,2,[])", "row 2 column id"},
+		{"INSERT INTO t VALUES", "(1,'a','yesterday',2,[])", "row 1 column ts"},
+		{"INSERT INTO t VALUES", "(1,'a'", "malformed row"},
+		{"INSERT INTO t (id, v) FORMAT TSV", "1\t\\N\n2\t2.5\n", ""},
+		{"INSERT INTO t (id, v) FORMAT TSV", "1\tabc\n", "row 1 column v"},
+		{"INSERT INTO t (id, x) FORMAT TSV", "1\t2\n", "no such column x"},
+		{"INSERT INTO default.t (v, id) FORMAT CSV", "1.5,1\n\\N,\"2\"\n", ""},
+		{"INSERT INTO t (v, id) FORMAT CSV", "1.5,1,3\n", "want 2 columns; got 3"},
+		{"INSERT INTO t FORMAT JSONEachRow", `{"id":1,"name":"a","v":null,"tags":["x"],"other":1},{"id":"2"}` + "\n" + `{"ts":"2020-01-02 03:04:05"}`, ""},
+		{"INSERT INTO t FORMAT JSONEachRow", "{\"id\":1}\n{\"id\":true,\"v\":\"x\"}", "row 2 column v"},
+		{"INSERT INTO t FORMAT JSONEachRow", `{"id":1`, "unexpected EOF"},
+		{"INSERT INTO f FORMAT TSV", "2020-01-02T03:04:05\t2020-01-02\tyes\n2020-01-02\t18263\tOFF\n1577934245\t\\N\tenable\n", ""},
+		{"INSERT INTO f FORMAT TSV", "2020-01-02\t2020-01-02\tmaybe\n", "row 1 column ok"},
+		{"INSERT INTO f FORMAT TSV", "2020-01-02 03:04\t2020-01-02\t1\n", "row 1 column ts"},
+		{"INSERT INTO t FORMAT Parquet", "PAR1", ""},
+		{"INSERT INTO other VALUES", "(1)", "table default.other doesn't exist"},
+		{"SELECT 1", "", "only INSERT"},
+	}
+	for _, tt := range tests {
+		err := p.validateInsert(url.Values{}, http.Header{}, tt.query, []byte(tt.body))
+		if tt.err == "" && err != nil {
+			t.Errorf("%s %s: want no error; got %v", tt.query, tt.body, err)
+		}
+		if tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)) {
+			t.Errorf("%s %s: want error '%s'; got %v", tt.query, tt.body, tt.err, err)
+		}
+	}
+}
+
+func TestValidateAltered(t *testing.T) {
+	tables := map[string]string{"db.t": "id\tUInt32\t\n"}
+	ts := httptest.NewServer(fakeSchema(t, "u", tables))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) { c.Fwd = ts.URL })
+
+	params := url.Values{"database": {"db"}}
+	header := http.Header{"X-Clickhouse-User": {"u"}}
+	if err := p.validateInsert(params, header, "INSERT INTO t VALUES", []byte("(1)")); err != nil {
+		t.Fatal(err)
+	}
+	tables["db.t"] = "id\tUInt32\t\nname\tString\t\n"
+	p.schema.Lock()
+	p.schema.tables["db.t"].fetched = p.schema.tables["db.t"].fetched.Add(-schemaRefresh)
+	p.schema.Unlock()
+	if err := p.validateInsert(params, header, "INSERT INTO t VALUES", []byte("(1,'a')")); err != nil {
+		t.Errorf("want structure refreshed; got %v", err)
+	}
+}
+
+func TestValidateRequest(t *testing.T) {
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+	ts := httptest.NewServer(fakeSchema(t, "", map[string]string{"default.checked": "id\tUInt32\t\n"}))
+	defer ts.Close()
+	p := newTestProxy(t, func(c *Config) {
+		c.Fwd = ts.URL
+		v := true
+		c.Tables = map[string]*TableConfig{
+			"checked": {Validate: &v, SyncSec: 60},
+			"down":    {Validate: &v, SyncSec: 60, Fwd: down.URL},
+		}
+	})
+
+	tests := []struct {
+		table string
+		body  string
+		code  int
+	}{
+		{"checked", "(1)", http.StatusOK},
+		{"checked", "('a')", http.StatusBadRequest},
+		{"checked", "(1,2)", http.StatusBadRequest},
+		{"down", "('a')", http.StatusOK},
+	}
+	for _, tt := range tests {
+		rr := httptest.NewRecorder()
+		req := httptest.NewRequest("POST", "/?query=INSERT%20INTO%20"+tt.table+"%20VALUES", strings.NewReader(tt.body))
+		p.dorequest(rr, req)
+		if rr.Code != tt.code {
+			t.Errorf("%s %s: want %d; got %d %s", tt.table, tt.body, tt.code, rr.Code, rr.Body)
+		}
+	}
+	if got := string(p.store.peek("?query=INSERT%20INTO%20checked%20VALUES").buffer); got != "(1)" {
+		t.Errorf("want only valid rows buffered; got '%s'", got)
+	}
+}